@@ -53,8 +53,9 @@ func FuzzEx02(f *testing.F) {
 			t.SkipNow()
 		}
 
-		sim.instructions[0].Operand = "x0,x0,0" // li -> nop
-		sim.instructions[1].Operand = "x0,x0,0" // li -> nop
+		const nop = 0x00000013               // addi x0, x0, 0
+		sim.writeWord(sim.entryPoint, nop)   // li -> nop
+		sim.writeWord(sim.entryPoint+4, nop) // li -> nop
 
 		sim.registers[5] = t0
 		sim.registers[6] = t1
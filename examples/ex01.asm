@@ -30,3 +30,4 @@ mulu_skip:
     addi    x10, x28, 0         # return value
     jalr    x0, (x1)            # ret
 end:
+# expect: mem[0x0..0x6] == "RISC-V"
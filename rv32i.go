@@ -3,15 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,18 +34,45 @@ const (
 	port         = "8532"      // FYI 8000:web 5:RISC-V 32:RV32I
 	entryPoint   = 0x1000      // just an idea. look well
 	timeoutSec   = 5           // force suspend. for infinite loop detection
+	maxSteps     = 10000000    // force suspend by the number of instructions. deterministic unlike timeoutSec
+	historyDepth = 100000      // instructions to STEP BACK. bounds the memory use
 	HSTS         = false       // if https then set true
 	labelWidth   = 14          // 8 <= labelWidth <= 25
 	operandWidth = 24          // 18 <= operandWidth <= 50
+	systemCalls  = "rars"      // default ECALL environment. rars or linux. -syscalls
+	heapBase     = 0x40000     // initial program break for sbrk/brk
+	stackTop     = 0x7ffffff0  // initial sp for ELF executables
+	dataBase     = 0x10000     // default .data section. -data
 )
 
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatal("no filename")
 	}
-	fileName := os.Args[1] // ignore after the 2nd
+	switch os.Args[1] { // subcommands. otherwise the file name
+	case "lsp": // speaks LSP over stdio
+		if err := NewLanguageServer(os.Stdin, os.Stdout).serve(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "fmt":
+		os.Exit(fmtCommand(os.Args[2:], os.Stdout, os.Stderr))
+	case "run": // headless
+		os.Exit(runCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	case "test": // checks the # expect: comments
+		os.Exit(testCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	timeout, steps := limitFlags(flags)
+	environment := environmentFlag(flags)
+	data := dataFlag(flags)
+	history := flags.Int("history", historyDepth, "the number of instructions to STEP BACK. zero for no history")
+	flags.Parse(os.Args[1:])
+	fileName := flags.Arg(0) // ignore after the 2nd
 
 	handler := NewSimulatorHandler(fileName, entryPoint)
+	handler.environment, handler.dataBase = environment, *data
+	handler.timeout, handler.maxSteps, handler.historyDepth = *timeout, *steps, *history
 	handler.init("shared")
 
 	server := http.Server{
@@ -54,9 +90,15 @@ type SimulatorHandler struct {
 	sims     map[string]*Simulator // designed with 1:n data structure and used 1:1. shared only
 	sharedId string
 
-	fileName   string
-	entryPoint uint32
-	singlePage *template.Template
+	fileName     string
+	entryPoint   uint32
+	dataBase     uint32
+	singlePage   *template.Template
+	environment  *Environment
+	stdin        io.Reader     // nil for EOF. the server's stdin would block the session
+	timeout      time.Duration // -timeout. the initial value for the session
+	maxSteps     uint64        // -steps
+	historyDepth int           // -history
 }
 
 type Simulator struct {
@@ -64,21 +106,54 @@ type Simulator struct {
 
 	fileName string
 
-	entryPoint   uint32
+	entryPoint   uint32 // the first address of the listing
+	dataBase     uint32 // the first address of .data
 	end          *uint32
+	start        uint32 // initial pc
+	stack        uint32 // initial sp. zero if not given
+	segments     []Segment
 	labelMapping map[string]uint32
-	instructions []Instruction
+	instructions []Instruction // listing. follows the memory when the code is overwritten
+	program      []Instruction // as loaded. restored on reset
+	decoded      map[uint32]Instruction
 
 	pc        uint32
 	registers [32]uint32
 	memory    map[uint32][]byte
+	csrs      [16]uint32
+	cycle     uint64
+	instret   uint64
 
 	last *Effect
 
+	timeout     time.Duration         // of RUN. zero for no timeout
+	maxSteps    uint64                // of RUN. zero for no limit
+	breakpoints map[uint32]Breakpoint // by the address. kept by STOP and RELOAD
+	watchpoints []Watchpoint          // kept by STOP and RELOAD
+
+	history      []*Undo // the oldest first
+	historyDepth int     // zero for no history
+	undo         *Undo   // being recorded by executeCurrent
+
+	calls    []Frame     // the shadow call stack. the innermost last
+	warnings Diagnostics // at run time. e.g. mismatched-return
+
+	environment *Environment
+	stdin       *bufio.Reader
+	console     bytes.Buffer
+	brk         uint32
+	exitCode    *int32
+	fault       string
+
 	view       SinglePageView
 	singlePage *template.Template
 
 	validationError io.Writer
+	sources         []Source          // of the lines to validate. the file name and the line number if not given
+	texts           map[Source]string // the source lines for the column spans
+	expansions      []string          // the invocations of the macros by the line. empty if not expanded
+	overlay         map[string]string // read instead of the files. e.g. being edited
+	diagnostics     Diagnostics       // of the last init
 }
 
 type Instruction struct {
@@ -86,6 +161,108 @@ type Instruction struct {
 	MnemonicRaw string
 	Mnemonic    string
 	Operand     string
+
+	Code   uint32
+	Format string // R/I/S/B/U/J. empty if not encoded
+	Pseudo string // the source on the first of the expanded instructions
+	Line   int    // one-based index of the validated lines. zero if disassembled
+}
+
+// the original position of a line expanded by the preprocessor
+type Source struct {
+	FileName string
+	LineNo   int
+}
+
+// where to set again after RELOAD. the same source line, otherwise the same offset from the label
+type Breakpoint struct {
+	Source    Source
+	Expansion string // of the macro. see Simulator.expansion
+	Text      string // of the source line
+	Label     string
+	Offset    uint32
+	Condition string // stops if it holds or fails. e.g. a0 == 0 && t1 > 5
+}
+
+// the state before an instruction. restored by STEP BACK
+type Undo struct {
+	Pc        uint32
+	Registers [][2]uint32 // the index and the old value. usually rd only
+	Memory    [][2]uint32 // the address and the old byte. in the written order
+	Csrs      [16]uint32
+	Cycle     uint64
+	Instret   uint64
+	Console   int // the length
+	Brk       uint32
+	ExitCode  *int32
+	Fault     string
+	Calls     []Frame // nil if unchanged
+	Warnings  int     // the length
+
+	Effect *Effect // of the instruction. for the view after the next one is undone
+}
+
+// an entry of the shadow call stack
+type Frame struct {
+	CallSite uint32
+	Target   uint32 // the callee
+	Sp       uint32 // at entry
+	Link     int    // ra or t0
+}
+
+// stops RUN after the register is written, or the memory range is read or written
+type Watchpoint struct {
+	Expr     string // e.g. a0 or mem[0x100..0x104]
+	Register int    // -1 if memory
+	Start    uint32
+	Size     uint32
+	Read     bool
+	Write    bool
+}
+
+// a validation result at the source. Column and EndColumn are one-based, and zero if the whole line
+type Diagnostic struct {
+	FileName  string
+	LineNo    int // zero if not a line. e.g. ELF
+	Column    int
+	EndColumn int // exclusive
+	Severity  string
+	Code      string // e.g. invalid-rd
+	Message   string
+}
+
+type Diagnostics []Diagnostic
+
+// collected, and written to the sink as text. e.g. stderr
+type Reporter struct {
+	diagnostics Diagnostics
+	sink        io.Writer
+	texts       map[Source]string
+	operands    []Span // the operands in the source by those being validated. nil if the same
+	line        Source // being validated. see Simulator.sourceFor
+	expansion   string // of the line. appended to the messages
+}
+
+// the part of the source line a diagnostic points at. the operand index if not negative
+type Span int
+
+const (
+	spanLine Span = -1 - iota // no columns
+	spanLabel
+	spanMnemonic
+)
+
+// loaded into the memory on reset
+type Segment struct {
+	Address uint32
+	Bytes   []byte
+}
+
+type Encoding struct {
+	Format string
+	Opcode uint32
+	Funct3 uint32
+	Funct7 uint32
 }
 
 type Effect struct {
@@ -97,37 +274,99 @@ type Effect struct {
 	Rs1 int
 	Rs2 int
 
-	RdS, RdU bool
-	RsS, RsU bool
+	RdS, RdU   bool
+	Rs1S, Rs1U bool
+	Rs2S, Rs2U bool
 
 	MemRead  []uint32
 	MemWrite []uint32
+
+	Csr               int
+	CsrRead, CsrWrite bool
+	Trap              bool
+
+	Break bool
+}
+
+// system call environment. chosen by the host with -syscalls
+type Environment struct {
+	Name  string
+	Calls map[uint32]SystemCall // keyed on a7
 }
 
+type SystemCall func(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int)
+
 type SinglePageView struct {
-	InstructionWidth [4]string
+	InstructionWidth [6]string
 	RegisterWidth    [8]string
+	CsrWidth         [3]string
 	MemoryWidth      [17]string
 	MemoryOffset     [16]string
 
 	Codes [32]InstructionRow
 	Regs  [32]RegisterRow
+	Csrs  [16]CsrRow
 	Mems  [32]MemoryRow
 
-	Disabled DisabledButton
-	Step     bool
-	Failed   bool
-	Timeout  bool
+	Console string
+
+	Disabled   DisabledButton
+	Step       bool
+	Failed     bool
+	Timeout    bool
+	Limit      bool   // maxSteps
+	Executed   uint64 // by the last RUN or STEP n
+	Breakpoint string // the address hit
+	Watch      string // which watchpoint fired
+	Undoable   int    // the length of the history
+
+	Watchpoints []string
+	InputError  string // of the breakpoint, watchpoint and limit forms
+	MaxSteps    uint64 // of the session
+	TimeLimit   string // e.g. 5s
+	Break       bool
+	Trap        string
+	Exited      bool
+	ExitCode    int32
+	Fault       string
+
+	Diagnostics []DiagnosticRow
+	Backtrace   []FrameRow // the innermost first
 }
 
 type InstructionRow struct {
 	Address  string
+	Code     string
+	Fields   string
 	Label    string
 	Mnemonic string
 	Operand  string
+	Pseudo   string
 
-	Current  bool
-	RefColor string
+	Current    bool
+	Breakpoint bool
+	Condition  string // of the breakpoint
+	RefColor   string
+	CodeColor  string
+}
+
+type DiagnosticRow struct {
+	Position string // file:line:column
+	Severity string
+	Code     string
+	Message  string
+	Text     string // the source line
+	Marker   string // under the column span. e.g. ^~~
+
+	Color string
+}
+
+type FrameRow struct {
+	Depth    int
+	Function string // the callee
+	CallSite string
+	Caller   string // the label and the offset of the call site. e.g. main+0x14
+	Sp       string // at entry
 }
 
 type RegisterRow struct {
@@ -145,6 +384,15 @@ type RegisterRow struct {
 	UnsignedUnused bool
 }
 
+type CsrRow struct {
+	Name   string
+	Number string
+	Hex    string
+
+	Even  bool
+	Color string
+}
+
 type MemoryRow struct {
 	BaseAddress string
 	Bytes       [16]MemoryValue
@@ -163,20 +411,49 @@ type DisabledButton struct {
 }
 
 const (
-	RUN    = "button=RUN"
-	STEP   = "button=STEP"
-	STOP   = "button=STOP"
-	RELOAD = "button=RELOAD"
+	RUN     = "button=RUN"
+	STEP    = "button=STEP"
+	STEP10  = "button=STEP10"
+	STEP100 = "button=STEP100"
+	BACK    = "button=STEP+BACK"
+	OVER    = "button=STEP+OVER"
+	OUT     = "button=STEP+OUT"
+	TO      = "to=" // run to here. e.g. to=00001000
+	REVERSE = "button=REVERSE+RUN"
+	STOP    = "button=STOP"
+	RELOAD  = "button=RELOAD"
+	BREAK   = "break=" // toggles. e.g. break=00001000
 
 	ColorRead  = "blue"
 	ColorWrite = "red"
 
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
 	ra = "x1" // The standard software calling convention uses x1 as the return address register
 )
 
+// system call number and arguments
+const (
+	a0 = 10
+	a1 = 11
+	a2 = 12
+	a7 = 17
+
+	ebadf = 9 // Linux errno. Bad file number
+)
+
 var (
 	abiNames        [32]string
 	registerMapping map[string]int
+	environments    map[string]*Environment
+	csrNames        [16]string
+	csrNumbers      [16]uint32
+	csrMapping      map[string]int
+	encodings       map[string]Encoding
+	decodings       map[uint32]string
+	pseudoOperands  map[string]int
+	instructionHelp map[string][3]string
 
 	standby, ready, running, executed DisabledButton
 )
@@ -229,6 +506,218 @@ func init() {
 		}
 	}
 
+	csrNames = [...]string{
+		"mstatus",  // Machine status register
+		"misa",     // ISA and extensions
+		"mie",      // Machine interrupt-enable register
+		"mtvec",    // Machine trap-handler base address
+		"mscratch", // Scratch register for machine trap handlers
+		"mepc",     // Machine exception program counter
+		"mcause",   // Machine trap cause
+		"mtval",    // Machine bad address or instruction
+		"mip",      // Machine interrupt pending
+		"mhartid",  // Hardware thread ID
+		"cycle",    // Cycle counter for RDCYCLE instruction
+		"time",     // Timer for RDTIME instruction
+		"instret",  // Instructions-retired counter for RDINSTRET instruction
+		"cycleh",   // Upper 32 bits of cycle, RV32 only
+		"timeh",    // Upper 32 bits of time, RV32 only
+		"instreth", // Upper 32 bits of instret, RV32 only
+	}
+	csrNumbers = [...]uint32{
+		0x300, 0x301, 0x304, 0x305, 0x340, 0x341, 0x342, 0x343, 0x344, 0xf14,
+		0xc00, 0xc01, 0xc02, 0xc80, 0xc81, 0xc82,
+	}
+
+	csrMapping = map[string]int{}
+	for i, v := range csrNames {
+		csrMapping[v] = i // case-sensitive like registers
+	}
+
+	encodings = map[string]Encoding{
+		"add":    {"R", opReg, 0b000, 0b0000000},
+		"sub":    {"R", opReg, 0b000, 0b0100000},
+		"sll":    {"R", opReg, 0b001, 0b0000000},
+		"slt":    {"R", opReg, 0b010, 0b0000000},
+		"sltu":   {"R", opReg, 0b011, 0b0000000},
+		"xor":    {"R", opReg, 0b100, 0b0000000},
+		"srl":    {"R", opReg, 0b101, 0b0000000},
+		"sra":    {"R", opReg, 0b101, 0b0100000},
+		"or":     {"R", opReg, 0b110, 0b0000000},
+		"and":    {"R", opReg, 0b111, 0b0000000},
+		"mul":    {"R", opReg, 0b000, 0b0000001},
+		"mulh":   {"R", opReg, 0b001, 0b0000001},
+		"mulhsu": {"R", opReg, 0b010, 0b0000001},
+		"mulhu":  {"R", opReg, 0b011, 0b0000001},
+		"div":    {"R", opReg, 0b100, 0b0000001},
+		"divu":   {"R", opReg, 0b101, 0b0000001},
+		"rem":    {"R", opReg, 0b110, 0b0000001},
+		"remu":   {"R", opReg, 0b111, 0b0000001},
+		"addi":   {"I", opImm, 0b000, 0},
+		"slti":   {"I", opImm, 0b010, 0},
+		"sltiu":  {"I", opImm, 0b011, 0},
+		"xori":   {"I", opImm, 0b100, 0},
+		"ori":    {"I", opImm, 0b110, 0},
+		"andi":   {"I", opImm, 0b111, 0},
+		"slli":   {"I", opImm, 0b001, 0b0000000}, // funct7 is imm[11:5]
+		"srli":   {"I", opImm, 0b101, 0b0000000},
+		"srai":   {"I", opImm, 0b101, 0b0100000},
+		"lb":     {"I", opLoad, 0b000, 0},
+		"lh":     {"I", opLoad, 0b001, 0},
+		"lw":     {"I", opLoad, 0b010, 0},
+		"lbu":    {"I", opLoad, 0b100, 0},
+		"lhu":    {"I", opLoad, 0b101, 0},
+		"jalr":   {"I", opJalr, 0b000, 0},
+		"fence":  {"I", opMiscMem, 0b000, 0},
+		"ecall":  {"I", opSystem, 0b000, 0},
+		"ebreak": {"I", opSystem, 0b000, 0},
+		"mret":   {"I", opSystem, 0b000, 0},
+		"csrrw":  {"I", opSystem, 0b001, 0},
+		"csrrs":  {"I", opSystem, 0b010, 0},
+		"csrrc":  {"I", opSystem, 0b011, 0},
+		"csrrwi": {"I", opSystem, 0b101, 0},
+		"csrrsi": {"I", opSystem, 0b110, 0},
+		"csrrci": {"I", opSystem, 0b111, 0},
+		"sb":     {"S", opStore, 0b000, 0},
+		"sh":     {"S", opStore, 0b001, 0},
+		"sw":     {"S", opStore, 0b010, 0},
+		"beq":    {"B", opBranch, 0b000, 0},
+		"bne":    {"B", opBranch, 0b001, 0},
+		"blt":    {"B", opBranch, 0b100, 0},
+		"bge":    {"B", opBranch, 0b101, 0},
+		"bltu":   {"B", opBranch, 0b110, 0},
+		"bgeu":   {"B", opBranch, 0b111, 0},
+		"lui":    {"U", opLui, 0, 0},
+		"auipc":  {"U", opAuipc, 0, 0},
+		"jal":    {"J", opJal, 0, 0},
+	}
+
+	decodings = map[uint32]string{}
+	for k, v := range encodings {
+		switch k {
+		case "ecall", "ebreak", "mret": // distinguished by imm
+			continue
+		}
+		decodings[decodingKey(v.Opcode, v.Funct3, v.Funct7)] = k
+	}
+
+	pseudoOperands = map[string]int{ // the number of operands
+		"nop": 0, "ret": 0,
+		"j": 1, "jr": 1, "call": 1, "tail": 1,
+		"li": 2, "la": 2, "mv": 2, "not": 2, "neg": 2, "seqz": 2, "snez": 2, "sltz": 2, "sgtz": 2,
+		"beqz": 2, "bnez": 2, "blez": 2, "bgez": 2, "bltz": 2, "bgtz": 2,
+		"bgt": 3, "ble": 3, "bgtu": 3, "bleu": 3,
+	}
+
+	instructionHelp = map[string][3]string{ // assembly, operation and operand ranges
+		"add":    {"add rd, rs1, rs2", "rd = rs1 + rs2", ""},
+		"addi":   {"addi rd, rs1, immediate", "rd = rs1 + immediate", "immediate: -2048 to 2047"},
+		"sub":    {"sub rd, rs1, rs2", "rd = rs1 - rs2", ""},
+		"and":    {"and rd, rs1, rs2", "rd = rs1 & rs2", ""},
+		"andi":   {"andi rd, rs1, immediate", "rd = rs1 & immediate", "immediate: -2048 to 2047"},
+		"or":     {"or rd, rs1, rs2", "rd = rs1 | rs2", ""},
+		"ori":    {"ori rd, rs1, immediate", "rd = rs1 | immediate", "immediate: -2048 to 2047"},
+		"xor":    {"xor rd, rs1, rs2", "rd = rs1 ^ rs2", ""},
+		"xori":   {"xori rd, rs1, immediate", "rd = rs1 ^ immediate", "immediate: -2048 to 2047"},
+		"sll":    {"sll rd, rs1, rs2", "rd = rs1 << rs2", "the lower 5 bits of rs2"},
+		"slli":   {"slli rd, rs1, shamt", "rd = rs1 << shamt", "shamt: 0 to 31"},
+		"srl":    {"srl rd, rs1, rs2", "rd = rs1 >> rs2 (logical)", "the lower 5 bits of rs2"},
+		"srli":   {"srli rd, rs1, shamt", "rd = rs1 >> shamt (logical)", "shamt: 0 to 31"},
+		"sra":    {"sra rd, rs1, rs2", "rd = rs1 >> rs2 (arithmetic)", "the lower 5 bits of rs2"},
+		"srai":   {"srai rd, rs1, shamt", "rd = rs1 >> shamt (arithmetic)", "shamt: 0 to 31"},
+		"slt":    {"slt rd, rs1, rs2", "if rs1 < rs2 then rd = 1 else rd = 0 (signed)", ""},
+		"sltu":   {"sltu rd, rs1, rs2", "if rs1 < rs2 then rd = 1 else rd = 0 (unsigned)", ""},
+		"slti":   {"slti rd, rs1, immediate", "if rs1 < immediate then rd = 1 else rd = 0 (signed)", "immediate: -2048 to 2047"},
+		"sltiu":  {"sltiu rd, rs1, immediate", "if rs1 < immediate then rd = 1 else rd = 0 (unsigned)", "immediate: 0 to 4095"},
+		"lui":    {"lui rd, immediate", "rd = immediate << 12", "immediate: 0 to 0xfffff"},
+		"auipc":  {"auipc rd, immediate", "rd = pc + (immediate << 12)", "immediate: 0 to 0xfffff"},
+		"lb":     {"lb rd, offset(rs1)", "rd = byte ptr [rs1 + offset] (sign-extended)", "offset: -2048 to 2047"},
+		"lbu":    {"lbu rd, offset(rs1)", "rd = byte ptr [rs1 + offset] (zero-extended)", "offset: -2048 to 2047"},
+		"lh":     {"lh rd, offset(rs1)", "rd = 2 bytes ptr [rs1 + offset] (sign-extended)", "offset: -2048 to 2047"},
+		"lhu":    {"lhu rd, offset(rs1)", "rd = 2 bytes ptr [rs1 + offset] (zero-extended)", "offset: -2048 to 2047"},
+		"lw":     {"lw rd, offset(rs1)", "rd = 4 bytes ptr [rs1 + offset]", "offset: -2048 to 2047"},
+		"sb":     {"sb rs2, offset(rs1)", "byte ptr [rs1 + offset] = rs2", "offset: -2048 to 2047"},
+		"sh":     {"sh rs2, offset(rs1)", "2 bytes ptr [rs1 + offset] = rs2", "offset: -2048 to 2047"},
+		"sw":     {"sw rs2, offset(rs1)", "4 bytes ptr [rs1 + offset] = rs2", "offset: -2048 to 2047"},
+		"jal":    {"jal rd, label", "rd = pc + 4; pc = label", "label: plus-minus 1 MiB. rd is x1 if omitted"},
+		"jalr":   {"jalr rd, offset(rs1)", "rd = pc + 4; pc = (rs1 + offset) & ~1", "offset: -2048 to 2047. rd is x1 if omitted"},
+		"beq":    {"beq rs1, rs2, label", "if rs1 == rs2 then pc = label", "label: plus-minus 4 KiB"},
+		"bne":    {"bne rs1, rs2, label", "if rs1 != rs2 then pc = label", "label: plus-minus 4 KiB"},
+		"blt":    {"blt rs1, rs2, label", "if rs1 < rs2 then pc = label (signed)", "label: plus-minus 4 KiB"},
+		"bltu":   {"bltu rs1, rs2, label", "if rs1 < rs2 then pc = label (unsigned)", "label: plus-minus 4 KiB"},
+		"bge":    {"bge rs1, rs2, label", "if rs1 >= rs2 then pc = label (signed)", "label: plus-minus 4 KiB"},
+		"bgeu":   {"bgeu rs1, rs2, label", "if rs1 >= rs2 then pc = label (unsigned)", "label: plus-minus 4 KiB"},
+		"mul":    {"mul rd, rs1, rs2", "rd = (rs1 * rs2) & 0xffffffff", ""},
+		"mulh":   {"mulh rd, rs1, rs2", "rd = (rs1 * rs2) >> 32 (signed x signed)", ""},
+		"mulhsu": {"mulhsu rd, rs1, rs2", "rd = (rs1 * rs2) >> 32 (signed x unsigned)", ""},
+		"mulhu":  {"mulhu rd, rs1, rs2", "rd = (rs1 * rs2) >> 32 (unsigned x unsigned)", ""},
+		"div":    {"div rd, rs1, rs2", "rd = rs1 / rs2 (signed)", "division by zero is -1"},
+		"divu":   {"divu rd, rs1, rs2", "rd = rs1 / rs2 (unsigned)", "division by zero is 0xffffffff"},
+		"rem":    {"rem rd, rs1, rs2", "rd = rs1 % rs2 (signed)", "division by zero is rs1"},
+		"remu":   {"remu rd, rs1, rs2", "rd = rs1 % rs2 (unsigned)", "division by zero is rs1"},
+		"csrrw":  {"csrrw rd, csr, rs1", "t = csr; csr = rs1; rd = t", "no read if rd is x0"},
+		"csrrs":  {"csrrs rd, csr, rs1", "t = csr; csr = t | rs1; rd = t", "no write if rs1 is x0"},
+		"csrrc":  {"csrrc rd, csr, rs1", "t = csr; csr = t & ~rs1; rd = t", "no write if rs1 is x0"},
+		"csrrwi": {"csrrwi rd, csr, uimm", "t = csr; csr = uimm; rd = t", "uimm: 0 to 31"},
+		"csrrsi": {"csrrsi rd, csr, uimm", "t = csr; csr = t | uimm; rd = t", "uimm: 0 to 31"},
+		"csrrci": {"csrrci rd, csr, uimm", "t = csr; csr = t & ~uimm; rd = t", "uimm: 0 to 31"},
+		"ecall":  {"ecall", "system call", "a7 is the system call number"},
+		"ebreak": {"ebreak", "break", ""},
+		"fence":  {"fence pred, succ", "nop", "pred and succ are optional"},
+		"mret":   {"mret", "pc = mepc; mstatus.MIE = mstatus.MPIE", ""},
+
+		"nop":  {"nop", "addi x0, x0, 0", ""},
+		"li":   {"li rd, immediate", "addi rd, x0, immediate, or lui and addi", "immediate: 32 bit integer"},
+		"la":   {"la rd, label", "auipc rd, offset[31:12]; addi rd, rd, offset[11:0]", ""},
+		"mv":   {"mv rd, rs", "addi rd, rs, 0", ""},
+		"not":  {"not rd, rs", "xori rd, rs, -1", ""},
+		"neg":  {"neg rd, rs", "sub rd, x0, rs", ""},
+		"seqz": {"seqz rd, rs", "sltiu rd, rs, 1", ""},
+		"snez": {"snez rd, rs", "sltu rd, x0, rs", ""},
+		"sltz": {"sltz rd, rs", "slt rd, rs, x0", ""},
+		"sgtz": {"sgtz rd, rs", "slt rd, x0, rs", ""},
+		"j":    {"j label", "jal x0, label", "label: plus-minus 1 MiB"},
+		"jr":   {"jr rs", "jalr x0, 0(rs)", ""},
+		"ret":  {"ret", "jalr x0, 0(x1)", ""},
+		"call": {"call label", "auipc x1, offset[31:12]; jalr x1, offset[11:0](x1)", ""},
+		"tail": {"tail label", "auipc x6, offset[31:12]; jalr x0, offset[11:0](x6)", ""},
+		"beqz": {"beqz rs, label", "beq rs, x0, label", "label: plus-minus 4 KiB"},
+		"bnez": {"bnez rs, label", "bne rs, x0, label", "label: plus-minus 4 KiB"},
+		"blez": {"blez rs, label", "bge x0, rs, label", "label: plus-minus 4 KiB"},
+		"bgez": {"bgez rs, label", "bge rs, x0, label", "label: plus-minus 4 KiB"},
+		"bltz": {"bltz rs, label", "blt rs, x0, label", "label: plus-minus 4 KiB"},
+		"bgtz": {"bgtz rs, label", "blt x0, rs, label", "label: plus-minus 4 KiB"},
+		"bgt":  {"bgt rs, rt, label", "blt rt, rs, label", "label: plus-minus 4 KiB"},
+		"ble":  {"ble rs, rt, label", "bge rt, rs, label", "label: plus-minus 4 KiB"},
+		"bgtu": {"bgtu rs, rt, label", "bltu rt, rs, label", "label: plus-minus 4 KiB"},
+		"bleu": {"bleu rs, rt, label", "bgeu rt, rs, label", "label: plus-minus 4 KiB"},
+	}
+
+	environments = map[string]*Environment{
+		"rars": { // RARS/Venus compatible
+			Name: "rars",
+			Calls: map[uint32]SystemCall{
+				1:  sysPrintInt,
+				4:  sysPrintString,
+				5:  sysReadInt,
+				9:  sysSbrk,
+				10: sysExit0,
+				11: sysPrintChar,
+				17: sysExit, // exit2
+			},
+		},
+		"linux": { // Linux riscv32 ABI
+			Name: "linux",
+			Calls: map[uint32]SystemCall{
+				63:  sysRead,
+				64:  sysWrite,
+				93:  sysExit,
+				94:  sysExit, // exit_group
+				214: sysBrk,
+			},
+		},
+	}
+
 	standby = DisabledButton{true, true, true, false}
 	ready = DisabledButton{false, false, true, false}
 	running = DisabledButton{false, false, false, true}
@@ -237,10 +726,15 @@ func init() {
 
 func NewSimulatorHandler(fileName string, entryPoint uint32) *SimulatorHandler {
 	return &SimulatorHandler{
-		sims:       map[string]*Simulator{},
-		fileName:   fileName,
-		entryPoint: (min(entryPoint, 0xffffff80) + 3) & 0xfffffffc, // aligned on a four byte boundary
-		singlePage: template.Must(template.New("singlePage").Parse(simulatorHTML[1:])),
+		sims:         map[string]*Simulator{},
+		fileName:     fileName,
+		entryPoint:   (min(entryPoint, 0xffffff80) + 3) & 0xfffffffc, // aligned on a four byte boundary
+		dataBase:     dataBase,
+		singlePage:   template.Must(template.New("singlePage").Parse(simulatorHTML[1:])),
+		environment:  environments[systemCalls],
+		timeout:      timeoutSec * time.Second,
+		maxSteps:     maxSteps,
+		historyDepth: historyDepth,
 	}
 }
 
@@ -278,6 +772,14 @@ func (h *SimulatorHandler) newSimulator() *Simulator {
 		h.singlePage,
 		os.Stderr,
 	)
+	sim.dataBase = h.dataBase
+	sim.environment = h.environment
+	if h.stdin != nil {
+		sim.stdin = bufio.NewReader(h.stdin)
+	}
+	sim.timeout = h.timeout
+	sim.maxSteps = h.maxSteps
+	sim.historyDepth = h.historyDepth
 	sim.init()
 	if sim.end == nil {
 		sim.view.setStatus(standby)
@@ -291,17 +793,25 @@ func NewSimulator(fileName string, entryPoint uint32, singlePage *template.Templ
 	sim := Simulator{
 		fileName:        fileName,
 		entryPoint:      entryPoint,
+		start:           entryPoint,
+		dataBase:        dataBase,
 		singlePage:      singlePage,
 		validationError: w,
+		environment:     environments[systemCalls],
+		timeout:         timeoutSec * time.Second,
+		maxSteps:        maxSteps,
+		historyDepth:    historyDepth,
 	}
 
 	padding := strings.Repeat("_", max(70, max(labelWidth, operandWidth))+1)
 
 	const address = len("0x00000000") + 2
+	const code = len("00000000") + 2
 	const label = max(8, min(25, labelWidth))
 	const mnemonic = 8
 	const operand = max(18, min(50, operandWidth))
-	for i, v := range [...]int{address, label, mnemonic, operand} {
+	const pseudo = operand
+	for i, v := range [...]int{address, code, label, mnemonic, operand, pseudo} {
 		sim.view.InstructionWidth[i] = padding[:v]
 	}
 
@@ -321,6 +831,18 @@ func NewSimulator(fileName string, entryPoint uint32, singlePage *template.Templ
 		sim.view.Regs[i].Even = (i % 2) == 0
 	}
 
+	const csrName = len("mscratch") + 2
+	const csrNumber = len("0x000") + 2
+	for i, v := range [...]int{csrName, csrNumber, hex} {
+		sim.view.CsrWidth[i] = padding[:v]
+	}
+
+	for i := range sim.view.Csrs {
+		sim.view.Csrs[i].Name = csrNames[i]
+		sim.view.Csrs[i].Number = fmt.Sprintf("0x%03x", csrNumbers[i])
+		sim.view.Csrs[i].Even = (i % 2) == 0
+	}
+
 	for i := range sim.view.MemoryWidth {
 		sim.view.MemoryWidth[i] = padding[:3]
 	}
@@ -343,14 +865,14 @@ func (h *SimulatorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf := make([]byte, 16) // small margin
-	n, err := r.Body.Read(buf)
+	buf := make([]byte, 1024) // small margin. for the conditions of the breakpoints
+	n, err := io.ReadFull(r.Body, buf)
 	r.Body.Close()
 	if r.Method == "GET" && 0 < n {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if (err != nil && err != io.EOF) || n == len(buf) {
+	if (err != nil && err != io.EOF && err != io.ErrUnexpectedEOF) || n == len(buf) {
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		return
 	}
@@ -378,32 +900,66 @@ func (sim *Simulator) Handle(w http.ResponseWriter, req string) {
 
 	var effect *Effect
 
+	var target uint32
+	if hex, ok := strings.CutPrefix(req, TO); ok {
+		addr, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || sim.listingIndex(uint32(addr)) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		target, req = uint32(addr), TO
+	}
+	if req != "" {
+		sim.view.InputError = ""
+	}
+	if values, err := url.ParseQuery(req); err == nil && (values.Has("break") || values.Has("at") || values.Has("watch") || values.Has("unwatch")) {
+		if !sim.updateDebugPoints(values) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req = "" // as GET
+	}
+	if values, err := url.ParseQuery(req); err == nil && (values.Has("steps") || values.Has("timeout")) {
+		sim.updateLimits(values)
+		req = "" // as GET
+	}
+
 	switch req {
 	case RUN:
-		timeLimit := time.Now().Add(timeoutSec * time.Second)
-		for sim.effectivePc() {
-			effect = sim.executeCurrent()
-			sim.focusViewMemoryRange(effect)  // each
-			if timeLimit.Before(time.Now()) { // timeLimit < now
+		effect = sim.runUntil(sim.maxSteps, true, nil)
+	case STEP10:
+		effect = sim.RunN(10)
+	case STEP100:
+		effect = sim.RunN(100)
+	case OVER:
+		effect = sim.runUntil(sim.maxSteps, true, sim.stepOver())
+	case OUT:
+		effect = sim.runUntil(sim.maxSteps, true, sim.stepOut())
+	case TO:
+		effect = sim.runUntil(sim.maxSteps, true, func() bool { return sim.pc == target })
+	case BACK:
+		sim.stepBack()
+		sim.view.Breakpoint = ""
+		effect = sim.syncViewBack()
+	case REVERSE:
+		sim.view.Breakpoint = ""
+		for sim.stepBack() {
+			if bp, ok := sim.breakpoints[sim.pc]; ok && sim.holds(bp.Condition) {
+				sim.view.Breakpoint = fmt.Sprintf("0x%08x", sim.pc)
 				break
 			}
 		}
-		sim.scrollViewInstruction(effect.Current)
-		sim.syncView()
-		sim.view.Step = false
-		if sim.effectivePc() {
-			sim.view.Timeout = true
-			sim.view.setStatus(running)
-		} else {
-			sim.view.Timeout = false
-			effect.Rd, effect.Rs1, effect.Rs2, effect.MemRead, effect.MemWrite = -1, -1, -1, nil, nil
-			sim.view.setStatus(executed)
-		}
+		effect = sim.syncViewBack()
 	case STEP:
 		effect = sim.executeCurrent()
 		sim.scrollViewInstruction(effect.Current)
 		sim.focusViewMemoryRange(effect)
 		sim.view.Timeout = false
+		sim.view.Limit = false
+		sim.view.Executed = 0
+		sim.view.Breakpoint = ""
+		sim.view.Watch = sim.watchHit(effect)
+		sim.view.Break = effect.Break
 		if sim.effectivePc() {
 			sim.view.Step = true
 			sim.view.setStatus(running)
@@ -433,21 +989,225 @@ func (sim *Simulator) Handle(w http.ResponseWriter, req string) {
 	sim.sendResponse(w, effect)
 }
 
+// RUN with maxSteps, or STEP n. zero n for no limit
+func (sim *Simulator) RunN(n uint64) *Effect {
+	return sim.runUntil(n, false, nil)
+}
+
+// RunN stopping also before the instruction where until holds. n is the instruction limit if limit
+func (sim *Simulator) runUntil(n uint64, limit bool, until func() bool) *Effect {
+	effect, steps, stop := sim.runN(n, until, sim.focusViewMemoryRange) // each
+	sim.scrollViewInstruction(effect.Current)
+	sim.syncView()
+	sim.view.Step = false
+	sim.view.Break = effect.Break
+	sim.view.Executed = steps
+	sim.view.Timeout = stop == "timeout"
+	sim.view.Limit = limit && stop == "limit"
+	sim.view.Breakpoint = ""
+	if stop == "breakpoint" {
+		sim.view.Breakpoint = fmt.Sprintf("0x%08x", sim.pc)
+	}
+	sim.view.Watch = ""
+	if stop == "watch" {
+		sim.view.Watch = sim.watchHit(effect)
+	}
+	if sim.effectivePc() {
+		sim.view.setStatus(running)
+	} else {
+		effect.Rd, effect.Rs1, effect.Rs2, effect.MemRead, effect.MemWrite = -1, -1, -1, nil, nil
+		effect.Csr = -1
+		sim.view.setStatus(executed)
+	}
+	return effect
+}
+
+// up to n instructions. stops by ebreak, breakpoint, until, watch, limit, timeout or ended.
+// not by the breakpoint and until at the first. until is called before each instruction
+func (sim *Simulator) runN(n uint64, until func() bool, each func(*Effect)) (effect *Effect, executed uint64, stop string) {
+	timeLimit := time.Now().Add(sim.timeout)
+	for sim.effectivePc() {
+		if n != 0 && n <= executed {
+			return effect, executed, "limit"
+		}
+		if until != nil && until() && 0 < executed {
+			return effect, executed, "reached"
+		}
+		if bp, ok := sim.breakpoints[sim.pc]; ok && 0 < executed && sim.holds(bp.Condition) {
+			return effect, executed, "breakpoint"
+		}
+		if sim.timeout != 0 && timeLimit.Before(time.Now()) && 0 < executed { // timeLimit < now. at least one instruction
+			return effect, executed, "timeout"
+		}
+		effect = sim.executeCurrent()
+		executed++
+		if each != nil {
+			each(effect)
+		}
+		if effect.Break {
+			return effect, executed, "break"
+		}
+		if sim.watchHit(effect) != "" {
+			return effect, executed, "watch"
+		}
+	}
+	return effect, executed, "ended"
+}
+
+// the nearest label at or before the address in the listing. e.g. main+0x14
+func (sim *Simulator) symbolize(addr uint32) string {
+	name, base := "", uint32(0)
+	for label, v := range sim.labelMapping {
+		if v <= addr && sim.entryPoint <= v && (name == "" || base < v || (base == v && label < name)) {
+			name, base = label, v
+		}
+	}
+	switch {
+	case name == "":
+		return fmt.Sprintf("0x%08x", addr)
+	case base == addr:
+		return name
+	}
+	return fmt.Sprintf("%s+0x%x", name, addr-base)
+}
+
+// until returned to pc+4 at the same stack depth if the current instruction is a call. otherwise one instruction
+func (sim *Simulator) stepOver() func() bool {
+	if !isCall(sim.fetch(sim.currentInstructionIndex())) {
+		return func() bool { return true }
+	}
+	ret, sp := sim.pc+4, sim.registers[2]
+	return func() bool { return sim.pc == ret && sp <= sim.registers[2] }
+}
+
+// until the current function returned through ra. counts the nested calls
+func (sim *Simulator) stepOut() func() bool {
+	depth, returned := 0, false
+	return func() bool {
+		if returned {
+			return true
+		}
+		inst := sim.fetch(sim.currentInstructionIndex())
+		switch {
+		case isCall(inst):
+			depth++
+		case isReturn(inst) && depth == 0:
+			returned = true // stops after it
+		case isReturn(inst):
+			depth--
+		}
+		return false
+	}
+}
+
+// jal or jalr writing ra
+func isCall(inst Instruction) bool {
+	switch inst.Mnemonic {
+	case "jal":
+		rd, _ := decodeJ(inst.Operand, nil)
+		return rd == 1
+	case "jalr":
+		rd, _, _ := decodeJalr(inst.Operand)
+		return rd == 1
+	}
+	return false
+}
+
+// jalr x0, 0(ra) as ret
+func isReturn(inst Instruction) bool {
+	if inst.Mnemonic != "jalr" {
+		return false
+	}
+	rd, rs1, _ := decodeJalr(inst.Operand)
+	return rd == 0 && rs1 == 1
+}
+
+// the view as it was after the previous instruction. keeps Breakpoint
+func (sim *Simulator) syncViewBack() *Effect {
+	var effect *Effect
+	if n := len(sim.history); 0 < n {
+		effect = sim.history[n-1].Effect
+	}
+	if effect != nil {
+		sim.scrollViewInstruction(effect.Current)
+		sim.focusViewMemoryRange(effect)
+	} else {
+		sim.scrollViewInstruction(sim.currentInstructionIndex())
+	}
+	sim.syncView()
+	sim.view.Step = true
+	sim.view.Timeout = false
+	sim.view.Limit = false
+	sim.view.Executed = 0
+	sim.view.Watch = ""
+	sim.view.Break = false
+	sim.view.setStatus(running)
+	return effect
+}
+
+// empty is always. stops also if the condition fails. e.g. exitcode before exit
+func (sim *Simulator) holds(condition string) bool {
+	if condition == "" {
+		return true
+	}
+	ok, _, err := sim.condition(condition)
+	return ok || err != nil
+}
+
+// which watchpoint fired by the instruction. empty if none
+func (sim *Simulator) watchHit(effect *Effect) string {
+	if effect == nil {
+		return ""
+	}
+	addr := sim.entryPoint + uint32(effect.Current*4)
+	for _, v := range sim.watchpoints {
+		if 0 <= v.Register {
+			if effect.Rd == v.Register {
+				return fmt.Sprintf("watchpoint(%s) written at 0x%08x", v.Expr, addr)
+			}
+			continue
+		}
+		for _, access := range []struct {
+			on    bool
+			addrs []uint32
+			verb  string
+		}{{v.Write, effect.MemWrite, "written"}, {v.Read, effect.MemRead, "read"}} {
+			if !access.on {
+				continue
+			}
+			for _, a := range access.addrs {
+				if a-v.Start < v.Size { // v.Start <= a < v.Start+v.Size
+					return fmt.Sprintf("watchpoint(%s) %s at 0x%08x", v.Expr, access.verb, addr)
+				}
+			}
+		}
+	}
+	return ""
+}
+
 func (sim *Simulator) sendResponse(w http.ResponseWriter, effect *Effect) {
 	for i := range sim.view.Codes {
 		sim.view.Codes[i].Current = false
 		sim.view.Codes[i].RefColor = ""
+		sim.view.Codes[i].CodeColor = ""
 	}
 	for i := range sim.view.Regs {
 		sim.view.Regs[i].Color = ""
 		sim.view.Regs[i].SignedUnused = false
 		sim.view.Regs[i].UnsignedUnused = false
 	}
+	for i := range sim.view.Csrs {
+		sim.view.Csrs[i].Color = ""
+	}
+	sim.view.Trap = ""
 	for i := range sim.view.Mems {
 		for j := range sim.view.Mems[i].Bytes {
 			sim.view.Mems[i].Bytes[j].Color = ""
 		}
 	}
+	sim.syncViewCsr()         // counters are always changing
+	sim.syncViewInstruction() // self-modifying code
+	sim.view.MaxSteps, sim.view.TimeLimit = sim.maxSteps, sim.timeout.String()
 
 	if effect != nil {
 		base := sim.instructionViewBase()
@@ -464,15 +1224,15 @@ func (sim *Simulator) sendResponse(w http.ResponseWriter, effect *Effect) {
 		rs1 := effect.Rs1
 		if 0 <= rs1 {
 			sim.view.Regs[rs1].Color = ColorRead
-			sim.view.Regs[rs1].SignedUnused = !effect.RsS
-			sim.view.Regs[rs1].UnsignedUnused = !effect.RsU
+			sim.view.Regs[rs1].SignedUnused = !effect.Rs1S
+			sim.view.Regs[rs1].UnsignedUnused = !effect.Rs1U
 		}
 
 		rs2 := effect.Rs2
 		if 0 <= rs2 {
 			sim.view.Regs[rs2].Color = ColorRead
-			sim.view.Regs[rs2].SignedUnused = !effect.RsS
-			sim.view.Regs[rs2].UnsignedUnused = !effect.RsU
+			sim.view.Regs[rs2].SignedUnused = !effect.Rs2S
+			sim.view.Regs[rs2].UnsignedUnused = !effect.Rs2U
 		}
 
 		rd := effect.Rd
@@ -487,10 +1247,27 @@ func (sim *Simulator) sendResponse(w http.ResponseWriter, effect *Effect) {
 			sim.view.Regs[rd].UnsignedUnused = !effect.RdU
 		}
 
+		if effect.Trap {
+			for _, v := range [...]string{"mstatus", "mepc", "mcause", "mtval"} {
+				sim.view.Csrs[csrMapping[v]].Color = ColorWrite
+			}
+			sim.view.Trap = exceptionNames[int(sim.csrs[csrMapping["mcause"]])]
+		}
+		if csr := effect.Csr; 0 <= csr {
+			if effect.CsrWrite {
+				sim.view.Csrs[csr].Color = ColorWrite
+			} else if effect.CsrRead {
+				sim.view.Csrs[csr].Color = ColorRead
+			}
+		}
+
 		if effect.MemRead != nil {
 			for _, addr := range effect.MemRead {
 				i, j := sim.view.memoryIndex(addr)
 				sim.view.Mems[i].Bytes[j].Color = ColorRead
+				if row := sim.codeRow(addr); 0 <= row {
+					sim.view.Codes[row].CodeColor = ColorRead
+				}
 			}
 		}
 		if effect.MemWrite != nil {
@@ -498,10 +1275,38 @@ func (sim *Simulator) sendResponse(w http.ResponseWriter, effect *Effect) {
 				i, j := sim.view.memoryIndex(addr)
 				sim.view.Mems[i].Bytes[j].Hex = fmt.Sprintf("%02x", sim.readMemory(addr))
 				sim.view.Mems[i].Bytes[j].Color = ColorWrite
+				if row := sim.codeRow(addr); 0 <= row {
+					sim.view.Codes[row].CodeColor = ColorWrite
+				}
 			}
 		}
 	}
 
+	sim.view.Undoable = len(sim.history)
+	sim.view.Watchpoints = sim.view.Watchpoints[:0]
+	for _, v := range sim.watchpoints {
+		sim.view.Watchpoints = append(sim.view.Watchpoints, v.String())
+	}
+
+	sim.syncViewDiagnostic() // with the warnings at run time
+	sim.view.Backtrace = sim.view.Backtrace[:0]
+	for i, v := range slices.Backward(sim.calls) {
+		sim.view.Backtrace = append(sim.view.Backtrace, FrameRow{
+			Depth:    len(sim.calls) - 1 - i,
+			Function: sim.symbolize(v.Target),
+			CallSite: fmt.Sprintf("0x%08x", v.CallSite),
+			Caller:   sim.symbolize(v.CallSite),
+			Sp:       fmt.Sprintf("0x%08x", v.Sp),
+		})
+	}
+
+	sim.view.Console = sim.console.String()
+	sim.view.Exited = sim.exitCode != nil
+	if sim.view.Exited {
+		sim.view.ExitCode = *sim.exitCode
+	}
+	sim.view.Fault = sim.fault
+
 	body := bytes.Buffer{}
 	if err := sim.singlePage.Execute(&body, sim.view); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -533,7 +1338,7 @@ func (sim *Simulator) sendResponse(w http.ResponseWriter, effect *Effect) {
 }
 
 func (sim *Simulator) effectivePc() bool {
-	return (sim.end != nil) && (sim.pc&3 == 0) && (sim.entryPoint <= sim.pc) && (sim.pc <= *sim.end)
+	return (sim.end != nil) && (sim.exitCode == nil) && (sim.fault == "") && (sim.pc&3 == 0) && (sim.entryPoint <= sim.pc) && (sim.pc <= *sim.end)
 }
 
 func (sim *Simulator) currentInstructionIndex() int {
@@ -558,6 +1363,9 @@ func (sim *Simulator) readMemory(addr uint32) byte {
 }
 
 func (sim *Simulator) writeMemory(addr uint32, b byte) {
+	if sim.undo != nil {
+		sim.undo.Memory = append(sim.undo.Memory, [2]uint32{addr, uint32(sim.readMemory(addr))})
+	}
 	base, offset := addr&0xffffff00, addr&0xff
 	if _, ok := sim.memory[base]; !ok {
 		sim.memory[base] = make([]byte, 16*16)
@@ -565,919 +1373,4369 @@ func (sim *Simulator) writeMemory(addr uint32, b byte) {
 	sim.memory[base][offset] = b
 }
 
-func (sim *Simulator) init() {
-	lines := sim.readFile()
-	valid := sim.validate(lines)
-	if !valid {
-		lines = [][3]string{}
-	}
-	sim.load(lines)
-	sim.reset()
-	sim.view.Failed = !valid
+func (sim *Simulator) readWord(addr uint32) uint32 {
+	m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1), sim.readMemory(addr + 2), sim.readMemory(addr + 3)}
+	return uint32(m[0]) | (uint32(m[1]) << 8) | (uint32(m[2]) << 16) | (uint32(m[3]) << 24) // little-endian
 }
 
-func (sim *Simulator) readFile() [][3]string {
-	file, err := os.Open(sim.fileName)
-	if err != nil {
-		log.Fatal(err)
+func (sim *Simulator) writeWord(addr uint32, v uint32) {
+	for i := range uint32(4) {
+		sim.writeMemory(addr+i, byte(v>>(i*8))) // little-endian
 	}
-	defer file.Close()
+}
 
-	lines := [][3]string{}
-	for s := bufio.NewScanner(file); s.Scan(); {
-		lines = append(lines, splitLine(s.Text()))
+// above the loaded segments
+func (sim *Simulator) heapStart() uint32 {
+	brk := uint32(heapBase)
+	for _, v := range sim.segments {
+		brk = max(brk, (v.Address+uint32(len(v.Bytes))+0xfff)&^0xfff)
 	}
-
-	return lines
+	return brk
 }
 
-func splitLine(line string) [3]string {
-	trimed := strings.TrimSpace(line)
-
-	if trimed == "" || (trimed[0] == '.' && !strings.Contains(trimed, ":")) {
-		return [3]string{}
+// the row of the instruction view. -1 if not in view
+func (sim *Simulator) codeRow(addr uint32) int {
+	if sim.end == nil || addr < sim.entryPoint || *sim.end+3 < addr {
+		return -1
 	}
-
-	// comment
-	c := strings.IndexAny(trimed, "#;")
-	if c == -1 {
-		c = len(trimed)
+	row := int((addr-sim.entryPoint)/4) - sim.instructionViewBase()
+	if row < 0 || len(sim.view.Codes) <= row {
+		return -1
 	}
+	return row
+}
 
-	definedLabel, mnemonic, operand := "", "", ""
-
-	// label
-	l := strings.Index(trimed[:c], ":")
-	if l != -1 {
-		l++
-		definedLabel = strings.TrimSpace(trimed[:l]) // definedLabel = label + ":"
+func (sim *Simulator) init() {
+	var diagnostics Diagnostics
+	if sim.isElf() {
+		diagnostics = sim.loadElf()
+		if !diagnostics.valid() {
+			sim.load([][3]string{})
+		}
 	} else {
-		l = 0
-	}
-
-	// instruction
-	instruction := strings.TrimSpace(trimed[l:c])
-	if instruction != "" {
-		i := strings.IndexAny(instruction, "\t ")
-		if i == -1 {
-			mnemonic = instruction
-		} else {
-			mnemonic = strings.TrimSpace(instruction[:i])
-			operand = strings.TrimSpace(instruction[i:])
+		lines, sources, expansions, preprocessed := sim.readFile()
+		sim.sources, sim.expansions = sources, expansions
+		diagnostics = append(preprocessed, sim.validate(lines)...)
+		if !diagnostics.valid() {
+			lines = [][3]string{}
+		}
+		sim.load(lines)
+		if diagnostics.valid() {
+			diagnostics = append(diagnostics, sim.lint(lines)...)
 		}
 	}
-
-	return [3]string{definedLabel, mnemonic, operand}
+	sim.rebindBreakpoints()
+	sim.reset()
+	sim.diagnostics = diagnostics
+	sim.view.Failed = !diagnostics.valid()
+	sim.syncViewDiagnostic()
 }
 
-func (sim *Simulator) load(validated [][3]string) {
-	sim.labelMapping = map[string]uint32{}
-
-	nextAddress := sim.entryPoint
-	candiLabel := ""
-	filtered := [][3]string{}
-	for _, v := range validated {
-		definedLabel, mnemonic, operand := v[0], v[1], v[2]
-		if definedLabel == "" && mnemonic == "" {
-			continue
+// break toggles, at sets with the condition if, watch adds with on (r, w or rw) and unwatch removes by the index.
+// false if the request is malformed. invalid inputs are shown in the view
+func (sim *Simulator) updateDebugPoints(values url.Values) bool {
+	switch {
+	case values.Has("break"):
+		return sim.toggleBreakpoint(values.Get("break"))
+	case values.Has("at"):
+		at, condition := strings.TrimSpace(values.Get("at")), strings.TrimSpace(values.Get("if"))
+		addr, err := evaluate(at, sim.symbols())
+		i := sim.listingIndex(uint32(addr))
+		if err != nil || i < 0 {
+			sim.view.InputError = fmt.Sprintf("invalid address(%s) not an instruction", at)
+			return true
 		}
-		if definedLabel != "" {
-			label := definedLabel[:len(definedLabel)-1] // remove the trailing ':'
-			sim.labelMapping[label] = nextAddress       // case-sensitive
+		if condition != "" {
+			if _, _, err := sim.condition(condition); err != nil && !errors.Is(err, errNotExited) {
+				sim.view.InputError = err.Error()
+				return true
+			}
 		}
-		if mnemonic == "" {
-			candiLabel = definedLabel
-			continue
+		if sim.breakpoints == nil {
+			sim.breakpoints = map[uint32]Breakpoint{}
 		}
-		if definedLabel == "" {
-			definedLabel = candiLabel
+		sim.breakpoints[uint32(addr)] = sim.breakpoint(i, condition)
+		sim.syncViewInstruction()
+	case values.Has("watch"):
+		watch, err := sim.newWatchpoint(strings.TrimSpace(values.Get("watch")), values.Get("on"))
+		if err != nil {
+			sim.view.InputError = err.Error()
+			return true
 		}
-		filtered = append(filtered, [3]string{definedLabel, mnemonic, operand})
-		nextAddress += 4
-		candiLabel = ""
+		sim.watchpoints = append(sim.watchpoints, watch)
+	default:
+		i, err := strconv.Atoi(values.Get("unwatch"))
+		if err != nil || i < 0 || len(sim.watchpoints) <= i {
+			return false
+		}
+		sim.watchpoints = slices.Delete(sim.watchpoints, i, i+1)
 	}
+	return true
+}
 
-	count := len(filtered)
-
-	if candiLabel != "" && count != 0 {
-		filtered = append(filtered, [3]string{candiLabel, "", ""})
-		count++
+// steps and timeout of RUN for the session. zero for no limit. invalid inputs are shown in the view
+func (sim *Simulator) updateLimits(values url.Values) {
+	steps, timeout := sim.maxSteps, sim.timeout
+	if values.Has("steps") {
+		n, err := strconv.ParseUint(strings.TrimSpace(values.Get("steps")), 10, 64)
+		if err != nil {
+			sim.view.InputError = fmt.Sprintf("invalid steps(%s) not a number of instructions", values.Get("steps"))
+			return
+		}
+		steps = n
+	}
+	if values.Has("timeout") {
+		d, err := time.ParseDuration(strings.TrimSpace(values.Get("timeout")))
+		if err != nil || d < 0 {
+			sim.view.InputError = fmt.Sprintf("invalid timeout(%s) not a duration. e.g. 5s", values.Get("timeout"))
+			return
+		}
+		timeout = d
 	}
+	sim.maxSteps, sim.timeout = steps, timeout
+}
 
-	sim.instructions = make([]Instruction, max(count, len(sim.view.Codes)))
+// e.g. mem[0x0..0x4] on read/write
+func (v Watchpoint) String() string {
+	on := "read/write"
+	if !v.Write {
+		on = "read"
+	} else if !v.Read {
+		on = "write"
+	}
+	return v.Expr + " on " + on
+}
 
-	for i := range sim.instructions {
-		definedLabel, mnemonic, operand := "", "", ""
-		if i < count {
-			definedLabel, mnemonic, operand = filtered[i][0], filtered[i][1], filtered[i][2]
+// a register on write, or mem[a..b] on r, w or rw (default)
+func (sim *Simulator) newWatchpoint(expr, on string) (Watchpoint, error) {
+	if n, ok := registerMapping[expr]; ok {
+		if on == "r" {
+			return Watchpoint{}, fmt.Errorf("invalid watch(%s) registers on write only", expr)
 		}
-		sim.instructions[i].Label = definedLabel
-		sim.instructions[i].MnemonicRaw = mnemonic
-		sim.instructions[i].Mnemonic = normalizeMnemonic(mnemonic)
-		sim.instructions[i].Operand = normalizeOperand(operand)
-		if len(sim.view.Codes) <= i {
-			continue
-		}
-		sim.view.Codes[i].Address = fmt.Sprintf("0x%08x", sim.entryPoint+uint32(i*4))
-		sim.view.Codes[i].Label = formatLabel(definedLabel, sim.view.InstructionWidth)
-		sim.view.Codes[i].Mnemonic = mnemonic
-		sim.view.Codes[i].Operand = formatOperand(operand, sim.view.InstructionWidth)
+		return Watchpoint{Expr: expr, Register: n, Write: true}, nil
 	}
-
-	if count == 0 {
-		sim.end = nil
-	} else {
-		end := sim.entryPoint + uint32(count-1)*4
-		sim.end = &end
+	start, size, ok, err := sim.memoryRange(expr)
+	if err != nil {
+		return Watchpoint{}, err
 	}
+	if !ok {
+		return Watchpoint{}, fmt.Errorf("invalid watch(%s) a register or mem[a..b]", expr)
+	}
+	watch := Watchpoint{Expr: expr, Register: -1, Start: start, Size: size}
+	switch on {
+	case "r":
+		watch.Read = true
+	case "w":
+		watch.Write = true
+	case "", "rw":
+		watch.Read, watch.Write = true, true
+	default:
+		return Watchpoint{}, fmt.Errorf("invalid access(%s) r, w or rw", on)
+	}
+	return watch, nil
 }
 
-func normalizeMnemonic(mnemonic string) string {
-	return strings.ToLower(mnemonic)
-}
-
-func normalizeOperand(operand string) string {
-	return strings.ReplaceAll(strings.ReplaceAll(operand, "\t", ""), " ", "")
-}
-
-func formatLabel(definedLabel string, width [4]string) string {
-	return format(definedLabel, len(width[1])-1)
-}
-
-func formatOperand(operand string, width [4]string) string {
-	return format(strings.ReplaceAll(normalizeOperand(operand), ",", ", "), len(width[3])-2)
+// the address in hex. false if not an instruction
+func (sim *Simulator) toggleBreakpoint(hex string) bool {
+	addr, err := strconv.ParseUint(hex, 16, 32)
+	i := sim.listingIndex(uint32(addr))
+	if err != nil || i < 0 {
+		return false
+	}
+	if sim.breakpoints == nil {
+		sim.breakpoints = map[uint32]Breakpoint{}
+	}
+	if _, ok := sim.breakpoints[uint32(addr)]; ok {
+		delete(sim.breakpoints, uint32(addr))
+	} else {
+		sim.breakpoints[uint32(addr)] = sim.breakpoint(i, "")
+	}
+	sim.syncViewInstruction()
+	return true
 }
 
-func format(s string, maxlen int) string {
-	bytes := []byte(s)
-	if len(bytes) <= maxlen {
-		return s
+// -1 if out of the listing
+func (sim *Simulator) listingIndex(addr uint32) int {
+	if addr < sim.entryPoint || addr&3 != 0 || len(sim.instructions) <= int((addr-sim.entryPoint)/4) {
+		return -1
 	}
-	bytes[maxlen-3], bytes[maxlen-2], bytes[maxlen-1] = '.', '.', '.'
-	return string(bytes[:maxlen])
+	return int((addr - sim.entryPoint) / 4)
 }
 
-func (sim *Simulator) reset() {
-	sim.pc = sim.entryPoint
-	for i := range sim.registers {
-		sim.registers[i] = 0
+func (sim *Simulator) breakpoint(i int, condition string) Breakpoint {
+	bp := Breakpoint{Condition: condition}
+	if inst := sim.instructions[i]; 0 < inst.Line {
+		fileName, lineNo := sim.source(inst.Line)
+		bp.Source = Source{fileName, lineNo}
+		bp.Expansion = sim.expansion(inst.Line)
+		bp.Text = sim.texts[bp.Source]
 	}
-	sim.memory = map[uint32][]byte{}
-
-	sim.scrollViewInstruction(0)
-	for i := range sim.view.Mems {
-		sim.view.Mems[i].BaseAddress = fmt.Sprintf("0x%08x", uint32(i*16))
+	for j := i; 0 <= j; j-- {
+		if label := sim.instructions[j].Label; label != "" {
+			bp.Label = strings.TrimSuffix(label, ":")
+			bp.Offset = uint32(i-j) * 4
+			break
+		}
 	}
-	sim.syncView()
-	sim.view.Step = false
-	sim.view.Timeout = false
-
-	sim.last = nil
+	return bp
 }
 
-func (sim *Simulator) scrollViewInstruction(current int) {
-	const viewSize = len(sim.view.Codes)
-	const middle = viewSize / 2
-	if sim.instructionViewBase() <= current && current <= sim.instructionViewBase()+middle {
+// after the load. dropped if neither the source line nor the label is found
+func (sim *Simulator) rebindBreakpoints() {
+	if len(sim.breakpoints) == 0 {
 		return
 	}
-
-	base := current - middle
-	instructionSize := len(sim.instructions)
-	if instructionSize < current+middle {
-		base = instructionSize - viewSize
+	type expanded struct {
+		Source
+		Expansion string
 	}
-	base = max(base, 0)
-
-	if sim.instructionViewBase() == base {
-		return
+	lines := map[expanded]int{} // the first instruction of each source line. the body lines by the invocation
+	for i, v := range sim.instructions {
+		if v.Line == 0 {
+			continue
+		}
+		fileName, lineNo := sim.source(v.Line)
+		key := expanded{Source{fileName, lineNo}, sim.expansion(v.Line)}
+		if _, ok := lines[key]; !ok {
+			lines[key] = i
+		}
 	}
 
-	for i, v := range sim.instructions[base : base+viewSize] {
-		sim.view.Codes[i].Address = fmt.Sprintf("0x%08x", sim.entryPoint+uint32((base+i)*4))
-		sim.view.Codes[i].Label = formatLabel(v.Label, sim.view.InstructionWidth)
-		sim.view.Codes[i].Mnemonic = v.MnemonicRaw
-		sim.view.Codes[i].Operand = formatOperand(v.Operand, sim.view.InstructionWidth)
+	rebound := map[uint32]Breakpoint{}
+	for _, bp := range sim.breakpoints {
+		i, ok := lines[expanded{bp.Source, bp.Expansion}]
+		if !ok || sim.texts[bp.Source] != bp.Text {
+			addr, found := sim.labelMapping[bp.Label]
+			i = sim.listingIndex(addr + bp.Offset)
+			if !found || i < 0 {
+				continue
+			}
+		}
+		rebound[sim.entryPoint+uint32(i*4)] = sim.breakpoint(i, bp.Condition)
 	}
+	sim.breakpoints = rebound
 }
 
-func (sim *Simulator) instructionViewBase() int {
-	addr := sim.view.Codes[0].Address
-	if addr == "" {
-		return -1
+func (sim *Simulator) isElf() bool {
+	file, err := os.Open(sim.fileName)
+	if err != nil {
+		return false // reported by readFile
 	}
-	base, _ := strconv.ParseUint(addr, 0, 32)
-	return int(uint32(base)-sim.entryPoint) / 4
-}
-
-func (sim *Simulator) syncView() {
-	sim.syncViewRegister()
-	sim.syncViewMemory()
-}
+	defer file.Close()
 
-func (sim *Simulator) syncViewRegister() {
-	for i, v := range sim.registers {
-		sim.view.Regs[i].Signed = fmt.Sprintf("%d", int32(v))
-		sim.view.Regs[i].Unsigned = fmt.Sprintf("%d", v)
-		sim.view.Regs[i].Bin = fmt.Sprintf("%032b", v)
-		sim.view.Regs[i].Hex = fmt.Sprintf("%08x", v)
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
 	}
+	return string(magic) == elf.ELFMAG
 }
 
-func (sim *Simulator) syncViewMemory() {
-	// upper half
-	base := sim.view.memoryBase()
-	sim.readMemory(base) // if not exists, be generated
-	mems := sim.memory[base]
-	for i, v := range mems {
-		ii, j := sim.view.memoryIndex(base + uint32(i))
-		sim.view.Mems[ii].Bytes[j].Hex = fmt.Sprintf("%02x", v)
+// e.g. riscv32-unknown-elf-gcc -march=rv32im_zicsr -mabi=ilp32
+func (sim *Simulator) loadElf() Diagnostics {
+	r := sim.newReporter()
+	fileName := sim.fileName
+
+	file, err := elf.Open(fileName)
+	if err != nil {
+		logerr(r, fileName, 0, "invalid-executable", spanLine, "%v", err)
+		return r.diagnostics
 	}
+	defer file.Close()
 
-	// lower half
-	base += uint32(len(mems))
-	sim.readMemory(base) // if not exists, be generated
-	mems = sim.memory[base]
-	for i, v := range mems {
-		ii, j := sim.view.memoryIndex(base + uint32(i))
-		sim.view.Mems[ii].Bytes[j].Hex = fmt.Sprintf("%02x", v)
+	if file.Class != elf.ELFCLASS32 || file.Data != elf.ELFDATA2LSB || file.Machine != elf.EM_RISCV || file.Type != elf.ET_EXEC {
+		logerr(r, fileName, 0, "unsupported-executable", spanLine, "not a RV32 little-endian executable(%s %s %s %s)", file.Class, file.Data, file.Machine, file.Type)
+		return r.diagnostics
 	}
-}
 
-func (sim *Simulator) focusViewMemoryRange(effect *Effect) {
-	either := effect.MemWrite
-	if either == nil {
-		either = effect.MemRead
+	const maxMemsz = 64 << 20 // avoid unlimited
+	segments := []Segment{}
+	text := -1
+	for _, v := range file.Progs {
+		if v.Type != elf.PT_LOAD || v.Memsz == 0 {
+			continue
+		}
+		if v.Memsz < v.Filesz || maxMemsz < v.Memsz || 1<<32 < v.Vaddr+v.Memsz {
+			logerr(r, fileName, 0, "invalid-segment", spanLine, "segment(0x%08x) p_filesz 0x%x p_memsz 0x%x up to 64 MiB", v.Vaddr, v.Filesz, v.Memsz)
+			return r.diagnostics
+		}
+		b := make([]byte, v.Memsz) // zero-filled after Filesz. e.g. .bss
+		if _, err := v.ReadAt(b[:v.Filesz], 0); err != nil {
+			logerr(r, fileName, 0, "invalid-segment", spanLine, "segment(0x%08x) %v", v.Vaddr, err)
+			return r.diagnostics
+		}
+		if text == -1 && v.Flags&elf.PF_X != 0 {
+			text = len(segments)
+		}
+		segments = append(segments, Segment{uint32(v.Vaddr), b})
 	}
-	if either == nil {
-		return
+	if text == -1 || segments[text].Address&3 != 0 {
+		logerr(r, fileName, 0, "executable-segment-not-found", spanLine, "no executable segment aligned on a four byte boundary")
+		return r.diagnostics
 	}
 
-	base := sim.view.memoryBase()
-	minAddr := slices.Min(either)
-	maxAddr := slices.Max(either)
-	if base <= minAddr && maxAddr < base+(16*16*2) {
-		return
+	sim.labelMapping = map[string]uint32{}
+	symbols, _ := file.Symbols() // none if stripped
+	for _, v := range symbols {
+		switch elf.ST_TYPE(v.Info) {
+		case elf.STT_NOTYPE, elf.STT_OBJECT, elf.STT_FUNC:
+		default:
+			continue
+		}
+		if v.Name == "" || v.Name[0] == '$' || v.Section == elf.SHN_UNDEF { // $x and $d are mapping symbols
+			continue
+		}
+		sim.labelMapping[v.Name] = uint32(v.Value)
 	}
+	labels := addressLabels(sim.labelMapping)
 
-	if maxAddr < 0x200 {
-		base = 0
-	} else {
-		base = min(minAddr&0xffffff00, 0xfffffe00)
+	// the listing is the first executable segment. the other segments are data
+	sim.entryPoint = segments[text].Address
+	code := segments[text].Bytes
+	count := len(code) / 4
+	sim.instructions = make([]Instruction, max(count, len(sim.view.Codes)))
+	for i := range sim.instructions {
+		addr := sim.entryPoint + uint32(i*4)
+		if i < count {
+			sim.instructions[i] = disassemble(binary.LittleEndian.Uint32(code[i*4:]), addr, labels)
+			if label, ok := labels[addr]; ok {
+				sim.instructions[i].Label = label + ":"
+			}
+		}
+		if i < len(sim.view.Codes) {
+			sim.view.Codes[i].Address = fmt.Sprintf("0x%08x", addr)
+		}
 	}
-	for i := range sim.view.Mems {
-		sim.view.Mems[i].BaseAddress = fmt.Sprintf("0x%08x", base+uint32(i*16))
+	if i := sim.listingIndex(uint32(file.Entry)); i < 0 || count <= i { // the listing is padded
+		logerr(r, fileName, 0, "invalid-entry", spanLine, "entry point(0x%08x) not in the executable segment", file.Entry)
+		return r.diagnostics
 	}
+	sim.program = slices.Clone(sim.instructions)
+	sim.syncViewInstruction()
 
-	sim.syncViewMemory()
+	sim.segments = segments
+	sim.start = uint32(file.Entry)
+	sim.stack = stackTop
+	if count == 0 {
+		sim.end = nil
+	} else {
+		end := sim.entryPoint + uint32(count-1)*4
+		sim.end = &end
+	}
+	return r.diagnostics
 }
 
-func (view *SinglePageView) memoryBase() uint32 {
-	base, _ := strconv.ParseUint(view.Mems[0].BaseAddress, 0, 32)
-	return uint32(base)
+// .include and .macro are expanded
+func (sim *Simulator) readFile() ([][3]string, []Source, []string, Diagnostics) {
+	sim.texts = map[Source]string{}
+	p := Preprocessor{r: sim.newReporter(), macros: map[string]*Macro{}, overlay: sim.overlay}
+	if err := p.include(sim.fileName); err != nil { // e.g. not found
+		p.error(Source{sim.fileName, 0}, "invalid-file", spanLine, "%v", err)
+	}
+	if p.defining != nil {
+		p.error(p.defining.Source, "missing-.endm", spanMnemonic, "missing .endm(%s)", p.defining.Name)
+	}
+	return p.lines, p.sources, p.expansions, p.r.diagnostics
 }
 
-func (view *SinglePageView) memoryIndex(addr uint32) (i, j int) {
-	base := view.memoryBase()
-	if addr < base {
-		return -1, -1
+// the original position of the line. one-based. the body line if expanded from a macro
+func (sim *Simulator) source(lineNo int) (string, int) {
+	if 0 < lineNo && lineNo <= len(sim.sources) {
+		return sim.sources[lineNo-1].FileName, sim.sources[lineNo-1].LineNo
 	}
-	size := len(view.Mems[0].Bytes)
-	i, j = int(addr-base)/size, int(addr-base)%size
-	return
+	return sim.fileName, lineNo
 }
 
-func (view *SinglePageView) setStatus(status DisabledButton) {
-	view.Disabled = status
+// e.g. in macro(addz) invoked at main.s:3. empty if not expanded
+func (sim *Simulator) expansion(lineNo int) string {
+	if 0 < lineNo && lineNo <= len(sim.expansions) {
+		return sim.expansions[lineNo-1]
+	}
+	return ""
 }
 
-func (view *SinglePageView) wasDisabled(req string) bool {
-	switch req {
-	case RUN:
-		return view.Disabled.Run
-	case STEP:
-		return view.Disabled.Step
-	case STOP:
-		return view.Disabled.Stop
-	case RELOAD:
-		return view.Disabled.Reload
-	}
-	return false
+// source noted on r. its diagnostics are given the invocation of the macro
+func (sim *Simulator) sourceFor(r *Reporter, lineNo int) (string, int) {
+	fileName, n := sim.source(lineNo)
+	r.line, r.expansion = Source{fileName, n}, sim.expansion(lineNo)
+	return fileName, n
 }
 
-func (sim *Simulator) validate(lines [][3]string) bool {
-	valid := true
+type Macro struct {
+	Name    string
+	Params  []string
+	Lines   [][3]string
+	Sources []Source // of the lines
+	Source  Source   // of .macro
+}
 
-	w := sim.validationError
-	fileName := sim.fileName
+type Preprocessor struct {
+	r        *Reporter
+	lines    [][3]string
+	sources  []Source
+	macros   map[string]*Macro // case-insensitive
+	defining *Macro
+	included []string          // the files being included
+	overlay  map[string]string // the text by the file name
+	expanded int               // the number of the expansions. replaces \@
+	depth    int
+
+	expansions []string // by the line. see Simulator.expansion
+	expansion  string   // of the macro being expanded
+	outermost  Source   // the invocation in the nested expansions
+}
 
-	definedLabelMap := map[string]struct{}{}
-	filtered := [][3]string{}
-	for i, v := range lines {
-		lineNo, definedLabel, mnemonic, operand := i+1, v[0], v[1], v[2]
-		if definedLabel != "" {
-			if !validateLabel(definedLabel) {
-				valid = false
-				logerr(w, fileName, lineNo, "invalid label(%s)", definedLabel)
-			} else if _, ok := definedLabelMap[definedLabel]; ok {
-				valid = false
-				logerr(w, fileName, lineNo, "label duplicated(%s)", definedLabel)
-			} else {
-				definedLabelMap[definedLabel] = struct{}{} // case-sensitive
-			}
-		}
-		if mnemonic != "" {
-			filtered = append(filtered, [3]string{strconv.Itoa(lineNo), mnemonic, operand})
-		}
+func (p *Preprocessor) include(fileName string) error {
+	fileName = filepath.Clean(fileName)
+	if slices.Contains(p.included, fileName) {
+		return fmt.Errorf("recursive include(%s)", fileName)
 	}
-
-	for _, v := range filtered {
-		lineNo, _ := strconv.Atoi(v[0])
-		mnemonic, operand := v[1], v[2]
-		switch strings.ToLower(mnemonic) { // case-insensitive
-		case "add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu":
-			valid = validateR(w, fileName, lineNo, operand) && valid
-		case "addi", "andi", "ori", "xori":
-			valid = validateI(w, fileName, lineNo, operand) && valid
-		case "sb", "sh", "sw":
-			valid = validateS(w, fileName, lineNo, operand) && valid
-		case "beq", "bne", "blt", "bltu", "bge", "bgeu":
-			valid = validateB(w, fileName, lineNo, operand, definedLabelMap) && valid
-		case "lui", "auipc":
-			valid = validateU(w, fileName, lineNo, operand) && valid
-		case "jal":
-			valid = validateJ(w, fileName, lineNo, operand, definedLabelMap) && valid
-		case "jalr":
-			valid = validateJalr(w, fileName, lineNo, operand) && valid
-		case "slli", "srli", "srai", "slti", "sltiu":
-			valid = validateShift(w, fileName, lineNo, operand) && valid
-		case "lbu", "lb", "lhu", "lh", "lw":
-			valid = validateLoad(w, fileName, lineNo, operand) && valid
-		case "ecall", "ebreak", "fence":
-			valid = false
-			logerr(w, fileName, lineNo, "unimplemented instruction(%s)", mnemonic)
-		case "csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci":
-			// once it was RV32I, but was excluded in Ratified version. move to Zicsr. no longer RV32I Base Integer Instruction Set
-			valid = false
-			logerr(w, fileName, lineNo, "unimplemented Zicsr instruction(%s)", mnemonic)
-		case "fence.i":
-			// once it was RV32I, but was excluded in Ratified version. move to Zifencei. no longer RV32I Base Integer Instruction Set
-			valid = false
-			logerr(w, fileName, lineNo, "unimplemented Zifencei instruction(%s)", mnemonic)
-		default:
-			valid = false
-			logerr(w, fileName, lineNo, "unknown instruction(%s)", mnemonic)
+	var src io.Reader
+	if text, ok := p.overlay[fileName]; ok {
+		src = strings.NewReader(text)
+	} else {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
 		}
+		defer file.Close()
+		src = file
 	}
 
-	return valid
+	p.included = append(p.included, fileName)
+	defer func() { p.included = p.included[:len(p.included)-1] }()
+
+	lineNo := 0
+	for s := bufio.NewScanner(src); s.Scan(); {
+		lineNo++
+		p.r.texts[Source{fileName, lineNo}] = s.Text()
+		p.line(splitLine(s.Text()), Source{fileName, lineNo})
+	}
+	return nil
 }
 
-// unspecified. avoid unlimited
-func validateLabel(label string) bool {
-	if len(label) < 2 || 4096 < len(label) {
-		return false
+func (p *Preprocessor) line(line [3]string, source Source) {
+	definedLabel, mnemonic, operand := line[0], line[1], line[2]
+	directive := normalizeMnemonic(mnemonic)
+	if p.defining != nil {
+		switch directive {
+		case ".endm":
+			p.defining = nil
+		case ".macro":
+			p.error(source, "nested-macro", spanMnemonic, "nested macro(%s)", operand)
+		default:
+			p.defining.Lines = append(p.defining.Lines, line)
+			p.defining.Sources = append(p.defining.Sources, source)
+		}
+		return
 	}
-	bytes := []byte(label)
-	if !validateLabelFirstChar(bytes[0]) {
-		return false
+
+	macro, ok := p.macros[directive]
+	if !ok && directive != ".macro" && directive != ".endm" && directive != ".include" {
+		p.lines = append(p.lines, line)
+		p.sources = append(p.sources, source)
+		p.expansions = append(p.expansions, p.expansion)
+		return
 	}
-	if bytes[len(bytes)-1] != ':' { // trailing
-		return false
+	if definedLabel != "" { // at the first of the expanded lines
+		p.lines = append(p.lines, [3]string{definedLabel, "", ""})
+		p.sources = append(p.sources, source)
+		p.expansions = append(p.expansions, p.expansion)
 	}
-	for _, v := range bytes[1 : len(bytes)-1] {
-		if !validateLabelChar(v) {
-			return false
+	switch {
+	case ok:
+		p.expand(macro, operand, source)
+	case directive == ".macro":
+		p.define(operand, source)
+	case directive == ".endm":
+		p.error(source, "unexpected-.endm", spanMnemonic, "unexpected .endm")
+	case directive == ".include": // relative to the including file
+		name, ok := unquoteString(operand)
+		if !ok || name == "" {
+			p.error(source, "parse-failed", 0, "parse failed(%s)", operand)
+			return
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(source.FileName), name)
+		}
+		if err := p.include(name); err != nil {
+			p.error(source, "invalid-include", 0, "%v", err)
 		}
 	}
-	return true
-}
-
-func validateLabelFirstChar(c byte) bool {
-	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || c == '_' || c == '.' || c == '$'
-}
-
-func validateLabelChar(c byte) bool {
-	return validateLabelFirstChar(c) || ('0' <= c && c <= '9')
 }
 
-func validateR(w io.Writer, fileName string, lineNo int, operand string) bool {
-	const exp = 3
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		logerr(w, fileName, lineNo, "parse failed")
-		return false
+// .macro name param, ... also separated by spaces
+func (p *Preprocessor) define(operand string, source Source) {
+	fields := strings.FieldsFunc(operand, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(fields) == 0 {
+		p.error(source, "parse-failed", spanLine, "parse failed")
+		return
 	}
-	valid := true
-	rd, rs1, rs2 := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
-	if _, ok := registerMapping[rd]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rd(%s)", rd)
+	macro := &Macro{Name: fields[0], Params: fields[1:], Source: source}
+	p.defining = macro // the body is skipped even if invalid
+	if !validateLabel(macro.Name + ":") {
+		p.error(source, "invalid-macro", 0, "invalid macro(%s)", macro.Name)
+		return
 	}
-	if _, ok := registerMapping[rs1]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs1(%s)", rs1)
+	for i, v := range macro.Params {
+		if !validateLabel(v+":") || slices.Contains(macro.Params[:i], v) {
+			p.error(source, "invalid-parameter", 0, "invalid parameter(%s)", v)
+			return
+		}
 	}
-	if _, ok := registerMapping[rs2]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs2(%s)", rs2)
+	if _, ok := p.macros[normalizeMnemonic(macro.Name)]; ok {
+		p.error(source, "macro-duplicated", 0, "macro duplicated(%s)", macro.Name)
+		return
 	}
-	return valid
-}
-
-func validateI(w io.Writer, fileName string, lineNo int, operand string) bool {
-	return validateImmediate(w, fileName, lineNo, operand, false)
+	p.macros[normalizeMnemonic(macro.Name)] = macro
 }
 
-func validateS(w io.Writer, fileName string, lineNo int, operand string) bool {
-	return validateOffset(w, fileName, lineNo, operand, true)
-}
-
-func validateB(w io.Writer, fileName string, lineNo int, operand string, definedLabelMap map[string]struct{}) bool {
-	const exp = 3
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		logerr(w, fileName, lineNo, "parse failed")
-		return false
+// \param by the argument, \@ by the number of the expansions and \() by nothing. e.g. loop\@:
+func (p *Preprocessor) expand(macro *Macro, operand string, source Source) {
+	const maxDepth = 64
+	args := []string{}
+	if operand != "" {
+		args = splitUnquoted(operand)
 	}
-	rs1, rs2, definedLabel := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])+":"
-	valid := true
-	if _, ok := registerMapping[rs1]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs1(%s)", rs1)
+	if len(args) != len(macro.Params) {
+		p.error(source, "arguments-mismatched", spanMnemonic, "macro(%s) expects %d arguments", macro.Name, len(macro.Params))
+		return
 	}
-	if _, ok := registerMapping[rs2]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs2(%s)", rs2)
+	if maxDepth <= p.depth {
+		p.error(source, "macro-nested-too-deep", spanMnemonic, "macro(%s) nested too deep", macro.Name)
+		return
 	}
-	if _, ok := definedLabelMap[definedLabel]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "label not found(%s)", definedLabel)
+
+	params := slices.Clone(macro.Params)
+	slices.SortStableFunc(params, func(a, b string) int { return len(b) - len(a) }) // \ab before \a
+	oldnew := []string{"\\@", strconv.Itoa(p.expanded), "\\()", ""}
+	for _, v := range params {
+		oldnew = append(oldnew, "\\"+v, args[slices.Index(macro.Params, v)])
 	}
-	// validation of the following specifications is unimplemented
-	// The conditional branch range is plus-minus 4 KiB
-	return valid
-}
+	r := strings.NewReplacer(oldnew...)
+	p.expanded++
 
-func validateU(w io.Writer, fileName string, lineNo int, operand string) bool {
-	const exp = 2
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		logerr(w, fileName, lineNo, "parse failed")
-		return false
+	// errors are reported at the body lines with the invocation, and the outermost if nested. like GNU as
+	saved, outermost := p.expansion, p.outermost
+	if p.depth == 0 {
+		p.outermost = source
 	}
-	rd, imm := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1])
-	valid := true
-	if _, ok := registerMapping[rd]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rd(%s)", rd)
+	p.expansion = fmt.Sprintf("in macro(%s) invoked at %s:%d", macro.Name, source.FileName, source.LineNo)
+	if 0 < p.depth {
+		p.expansion += fmt.Sprintf(", expanded from %s:%d", p.outermost.FileName, p.outermost.LineNo)
 	}
-	if _, err := strconv.ParseUint(imm, 0, 20); err != nil {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid immediate(%s) 20 bit unsigned integer", imm)
+	p.depth++
+	for i, v := range macro.Lines {
+		p.line(splitLine(r.Replace(strings.TrimSpace(v[0]+" "+v[1]+" "+v[2]))), macro.Sources[i])
 	}
-	return valid
+	p.depth--
+	p.expansion, p.outermost = saved, outermost
 }
 
-func validateJ(w io.Writer, fileName string, lineNo int, operand string, definedLabelMap map[string]struct{}) bool {
-	const exp = 2
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		if len(operands) != 1 {
-			logerr(w, fileName, lineNo, "parse failed")
-			return false
-		}
-		operands = []string{"", operands[0]}
+func (p *Preprocessor) error(source Source, code string, at Span, format string, a ...any) {
+	if p.expansion != "" {
+		format, a = format+" %s", append(a, p.expansion)
 	}
-	rd, definedLabel := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1])+":"
-	if rd == "" {
-		rd = ra
+	logerr(p.r, source.FileName, source.LineNo, code, at, format, a...)
+}
+
+func splitLine(line string) [3]string {
+	trimed := strings.TrimSpace(line)
+
+	if trimed == "" {
+		return [3]string{}
 	}
-	valid := true
-	if _, ok := registerMapping[rd]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rd(%s)", rd)
+
+	// comment
+	c := indexUnquoted(trimed, "#;")
+	if c == -1 {
+		c = len(trimed)
 	}
-	if _, ok := definedLabelMap[definedLabel]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "label not found(%s)", definedLabel)
+
+	definedLabel, mnemonic, operand := "", "", ""
+
+	// label
+	l := indexUnquoted(trimed[:c], ":")
+	if l != -1 {
+		l++
+		definedLabel = strings.TrimSpace(trimed[:l]) // definedLabel = label + ":"
+	} else {
+		l = 0
 	}
-	// validation of the following specifications is unimplemented
-	// Jumps can therefore target a plus-minus 1 MiB range
-	return valid
-}
 
-func validateJalr(w io.Writer, fileName string, lineNo int, operand string) bool {
-	operands := strings.SplitN(operand, ",", 3)
-	if len(operands) == 1 {
-		operand = ra + "," + operand
-	} else if len(operands) == 2 && strings.TrimSpace(operands[0]) == "" {
-		operand = ra + operand
+	// instruction
+	instruction := strings.TrimSpace(trimed[l:c])
+	if instruction != "" {
+		i := strings.IndexAny(instruction, "\t ")
+		if i == -1 {
+			mnemonic = instruction
+		} else {
+			mnemonic = strings.TrimSpace(instruction[:i])
+			operand = strings.TrimSpace(instruction[i:])
+		}
 	}
-	return validateOffset(w, fileName, lineNo, operand, false)
+
+	return [3]string{definedLabel, mnemonic, operand}
 }
 
-func validateShift(w io.Writer, fileName string, lineNo int, operand string) bool {
-	return validateImmediate(w, fileName, lineNo, operand, true)
+// outside of string and character literals
+func indexUnquoted(s, chars string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0 && c == '\\':
+			i++ // escaped
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.IndexByte(chars, c) != -1:
+			return i
+		}
+	}
+	return -1
 }
 
-func validateLoad(w io.Writer, fileName string, lineNo int, operand string) bool {
-	return validateOffset(w, fileName, lineNo, operand, false)
+func splitUnquoted(s string) []string {
+	operands := []string{}
+	for {
+		i := indexUnquoted(s, ",")
+		if i == -1 {
+			return append(operands, strings.TrimSpace(s))
+		}
+		operands = append(operands, strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+	}
 }
 
-func validateImmediate(w io.Writer, fileName string, lineNo int, operand string, shift bool) bool {
-	const exp = 3
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		logerr(w, fileName, lineNo, "parse failed")
-		return false
+func (sim *Simulator) load(validated [][3]string) {
+	sim.labelMapping = map[string]uint32{}
+	symbols := newSymbols() // labels and constants
+
+	nextAddress := sim.entryPoint
+	dataAddress := sim.dataBase
+	text := true
+	candiLabel := ""
+	filtered := [][3]string{}
+	indexes := []int{}          // of the filtered lines
+	directives := [][3]string{} // in the data section. with the line index
+	for i, v := range validated {
+		definedLabel, mnemonic, operand := v[0], v[1], v[2]
+		if definedLabel == "" && mnemonic == "" {
+			continue
+		}
+		if definedLabel != "" {
+			label := definedLabel[:len(definedLabel)-1] // remove the trailing ':'
+			addr := nextAddress
+			if !text {
+				addr = dataAddress
+			}
+			if isLocalLabel(definedLabel) {
+				symbols.locals.define(label, i, addr) // not in labelMapping. redefinable
+			} else {
+				sim.labelMapping[label] = addr // case-sensitive
+				symbols.values[label] = addr
+			}
+		}
+		symbols.line = i
+		if isDirective(mnemonic) {
+			directive := normalizeMnemonic(mnemonic)
+			if directive == ".equ" || directive == ".set" {
+				name, expr, _ := strings.Cut(operand, ",")
+				v, _ := evaluate(expr, symbols)
+				symbols.values[strings.TrimSpace(name)] = uint32(v)
+			} else if section, ok := sectionOf(directive, operand); ok {
+				text = section == ".text"
+			} else if !text {
+				directives = append(directives, [3]string{directive, operand, strconv.Itoa(i)})
+				dataAddress += uint32(len(assembleData(directive, operand, dataAddress, symbols)))
+			}
+			continue
+		}
+		if !text {
+			continue
+		}
+		if mnemonic == "" {
+			candiLabel = definedLabel
+			continue
+		}
+		if definedLabel == "" {
+			definedLabel = candiLabel
+		}
+		filtered = append(filtered, [3]string{definedLabel, mnemonic, operand})
+		indexes = append(indexes, i)
+		nextAddress += uint32(pseudoSize(normalizeMnemonic(mnemonic), normalizeOperand(operand), symbols) * 4)
+		candiLabel = ""
 	}
-	rd, rs1, imm := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
-	valid := true
-	if _, ok := registerMapping[rd]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rd(%s)", rd)
+
+	data := []byte{}
+	for _, v := range directives {
+		i, _ := strconv.Atoi(v[2])
+		symbols.line = i
+		data = append(data, assembleData(v[0], v[1], sim.dataBase+uint32(len(data)), symbols)...)
 	}
-	if _, ok := registerMapping[rs1]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs1(%s)", rs1)
+
+	// pseudo-instructions are expanded after the labels are resolved
+	rows := []Instruction{}
+	rowIndexes := []int{} // of the lines
+	for j, v := range filtered {
+		definedLabel, mnemonic, operand := v[0], v[1], v[2]
+		pc := sim.entryPoint + uint32(len(rows)*4)
+		symbols.line = indexes[j]
+		expanded := expandPseudo(normalizeMnemonic(mnemonic), normalizeOperand(operand), pc, symbols)
+		if expanded == nil {
+			rows = append(rows, Instruction{Label: definedLabel, MnemonicRaw: mnemonic, Mnemonic: normalizeMnemonic(mnemonic), Operand: normalizeOperand(operand), Line: indexes[j] + 1})
+			rowIndexes = append(rowIndexes, indexes[j])
+			continue
+		}
+		for i, e := range expanded {
+			inst := Instruction{MnemonicRaw: e[0], Mnemonic: e[0], Operand: e[1], Line: indexes[j] + 1}
+			if i == 0 {
+				inst.Label = definedLabel
+				inst.Pseudo = strings.TrimSpace(mnemonic + " " + strings.Join(splitUnquoted(normalizeOperand(operand)), ", "))
+			}
+			rows = append(rows, inst)
+			rowIndexes = append(rowIndexes, indexes[j])
+		}
 	}
-	if shift {
-		if shamt, err := strconv.ParseInt(imm, 0, 5+1); err != nil || (shamt < 0 || 31 < shamt) {
-			valid = false
-			logerr(w, fileName, lineNo, "invalid shamt(%s) 0 <= shamt <= 31", imm)
+
+	if candiLabel != "" && len(rows) != 0 {
+		rows = append(rows, Instruction{Label: candiLabel})
+	}
+
+	count := len(rows)
+
+	sim.instructions = make([]Instruction, max(count, len(sim.view.Codes)))
+	copy(sim.instructions, rows)
+
+	// the target of %pcrel_lo is given by the auipc at the label
+	pcrelHi := map[uint32]uint32{}
+	for i, v := range rows {
+		for _, r := range relocations(v.Operand) {
+			if r[0] == "pcrel_hi" && v.Mnemonic == "auipc" {
+				symbols.line = rowIndexes[i]
+				target, _ := evaluate(r[1], symbols)
+				pcrelHi[sim.entryPoint+uint32(i*4)] = uint32(target)
+			}
+		}
+	}
+
+	for i := range sim.instructions {
+		pc := sim.entryPoint + uint32(i*4)
+		if i < len(rowIndexes) {
+			symbols.line = rowIndexes[i]
+		}
+		resolved := sim.instructions[i]
+		resolved.Operand = resolve(resolved.Operand, pc, symbols, pcrelHi)
+		sim.instructions[i].Code, sim.instructions[i].Format = encode(resolved, pc, symbols)
+		if len(sim.view.Codes) <= i {
+			continue
 		}
+		sim.view.Codes[i].Address = fmt.Sprintf("0x%08x", sim.entryPoint+uint32(i*4))
+	}
+	sim.program = slices.Clone(sim.instructions)
+	sim.syncViewInstruction()
+
+	code := make([]byte, count*4)
+	for i, v := range sim.program[:count] {
+		binary.LittleEndian.PutUint32(code[i*4:], v.Code)
+	}
+	sim.segments = []Segment{{sim.entryPoint, code}}
+	if len(data) != 0 {
+		sim.segments = append(sim.segments, Segment{sim.dataBase, data})
+	}
+	sim.start = sim.entryPoint
+	sim.stack = 0
+
+	if count == 0 {
+		sim.end = nil
 	} else {
-		if _, err := strconv.ParseInt(imm, 0, 12); err != nil {
-			valid = false
-			logerr(w, fileName, lineNo, "invalid immediate(%s) 12 bit signed integer", imm)
+		end := sim.entryPoint + uint32(count-1)*4
+		sim.end = &end
+	}
+}
+
+func normalizeMnemonic(mnemonic string) string {
+	return strings.ToLower(mnemonic)
+}
+
+// without the spaces except in the quotes. e.g. ' '
+func normalizeOperand(operand string) string {
+	b := []byte{}
+	for {
+		i := indexUnquoted(operand, " \t")
+		if i == -1 {
+			return string(append(b, operand...))
 		}
+		b, operand = append(b, operand[:i]...), operand[i+1:]
 	}
-	return valid
 }
 
-func validateOffset(w io.Writer, fileName string, lineNo int, operand string, store bool) bool {
-	const exp = 2
-	operands := strings.SplitN(operand, ",", exp+1)
-	if len(operands) != exp {
-		logerr(w, fileName, lineNo, "parse failed")
-		return false
+func formatLabel(definedLabel string, width [6]string) string {
+	return format(definedLabel, len(width[2])-1)
+}
+
+func formatOperand(operand string, width [6]string) string {
+	return format(strings.Join(splitUnquoted(normalizeOperand(operand)), ", "), len(width[4])-2)
+}
+
+func formatPseudo(pseudo string, width [6]string) string {
+	return format(pseudo, len(width[5])-2)
+}
+
+func formatCode(inst Instruction) (code, fields string) {
+	if inst.Format == "" {
+		return "", ""
 	}
-	b := strings.Index(operands[1], "(")
-	e := strings.Index(operands[1], ")")
-	if b <= 0 || e <= 0 || e < b || e != len(operands[1])-1 {
-		logerr(w, fileName, lineNo, "parse failed(%s)", strings.TrimSpace(operands[1]))
-		return false
+	c := inst.Code
+	bits := func(hi, lo int) string {
+		return fmt.Sprintf("%0*b", hi-lo+1, (c>>lo)&(1<<(hi-lo+1)-1))
 	}
-	rdrs2, offset, rs1 := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1][:b]), strings.TrimSpace(operands[1][b+1:e])
-	valid := true
-	if _, ok := registerMapping[rdrs2]; !ok {
-		valid = false
-		if store {
-			logerr(w, fileName, lineNo, "invalid rs2(%s)", rdrs2)
-		} else {
-			logerr(w, fileName, lineNo, "invalid rd(%s)", rdrs2)
-		}
+	switch inst.Format {
+	case "R":
+		fields = fmt.Sprintf("funct7:%s rs2:%s rs1:%s funct3:%s rd:%s opcode:%s", bits(31, 25), bits(24, 20), bits(19, 15), bits(14, 12), bits(11, 7), bits(6, 0))
+	case "I":
+		fields = fmt.Sprintf("imm[11:0]:%s rs1:%s funct3:%s rd:%s opcode:%s", bits(31, 20), bits(19, 15), bits(14, 12), bits(11, 7), bits(6, 0))
+	case "S":
+		fields = fmt.Sprintf("imm[11:5]:%s rs2:%s rs1:%s funct3:%s imm[4:0]:%s opcode:%s", bits(31, 25), bits(24, 20), bits(19, 15), bits(14, 12), bits(11, 7), bits(6, 0))
+	case "B":
+		fields = fmt.Sprintf("imm[12|10:5]:%s rs2:%s rs1:%s funct3:%s imm[4:1|11]:%s opcode:%s", bits(31, 25), bits(24, 20), bits(19, 15), bits(14, 12), bits(11, 7), bits(6, 0))
+	case "U":
+		fields = fmt.Sprintf("imm[31:12]:%s rd:%s opcode:%s", bits(31, 12), bits(11, 7), bits(6, 0))
+	case "J":
+		fields = fmt.Sprintf("imm[20|10:1|11|19:12]:%s rd:%s opcode:%s", bits(31, 12), bits(11, 7), bits(6, 0))
 	}
-	if _, ok := registerMapping[rs1]; !ok {
-		valid = false
-		logerr(w, fileName, lineNo, "invalid rs1(%s)", rs1)
+	return fmt.Sprintf("%08x", c), inst.Format + "-type " + fields
+}
+
+func format(s string, maxlen int) string {
+	bytes := []byte(s)
+	if len(bytes) <= maxlen {
+		return s
 	}
-	if offset != "" {
-		if _, err := strconv.ParseInt(offset, 0, 12); err != nil {
-			valid = false
-			logerr(w, fileName, lineNo, "invalid offset(%s) 12 bit signed integer", offset)
+	bytes[maxlen-3], bytes[maxlen-2], bytes[maxlen-1] = '.', '.', '.'
+	return string(bytes[:maxlen])
+}
+
+func (sim *Simulator) reset() {
+	sim.pc = sim.start
+	for i := range sim.registers {
+		sim.registers[i] = 0
+	}
+	sim.registers[2] = sim.stack // sp
+	sim.memory = map[uint32][]byte{}
+	for _, v := range sim.segments { // unified code and data
+		for i, b := range v.Bytes {
+			sim.writeMemory(v.Address+uint32(i), b)
 		}
 	}
-	return valid
-}
+	copy(sim.instructions, sim.program)
+	sim.decoded = map[uint32]Instruction{}
 
-func logerr(w io.Writer, fileName string, lineNo int, format string, a ...any) {
-	datetime := time.Now().Format(time.DateTime)
-	prefix := fmt.Sprintf("%s %s:%d ", datetime, fileName, lineNo)
-	fmt.Fprintln(w, prefix+fmt.Sprintf(format, a...))
+	sim.resetCsr()
+
+	sim.console.Reset()
+	sim.brk = sim.heapStart()
+	sim.exitCode = nil
+	sim.fault = ""
+
+	sim.scrollViewInstruction(0)
+	sim.syncViewInstruction()
+	for i := range sim.view.Mems {
+		sim.view.Mems[i].BaseAddress = fmt.Sprintf("0x%08x", uint32(i*16))
+	}
+	sim.syncView()
+	sim.view.Step = false
+	sim.view.Timeout = false
+	sim.view.Limit = false
+	sim.view.Executed = 0
+	sim.view.Breakpoint = ""
+	sim.view.Watch = ""
+	sim.view.Break = false
+
+	sim.last = nil
+	sim.history = nil
+	sim.calls = nil
+	sim.warnings = nil
 }
 
-func (sim *Simulator) executeCurrent() *Effect {
-	current := sim.currentInstructionIndex()
-	mnemonic, operand := sim.instructions[current].Mnemonic, sim.instructions[current].Operand // validated and normalized
+func (sim *Simulator) scrollViewInstruction(current int) {
+	const viewSize = len(sim.view.Codes)
+	const middle = viewSize / 2
+	if sim.instructionViewBase() <= current && current <= sim.instructionViewBase()+middle {
+		return
+	}
 
-	var imm, offset uint32 // sign-extended
-	var shamt, readBytes, writeBytes int
-	var addr uint32
-	var target *uint32
+	base := current - middle
+	instructionSize := len(sim.instructions)
+	if instructionSize < current+middle {
+		base = instructionSize - viewSize
+	}
+	base = max(base, 0)
 
-	jump := false
-	rd, rs1, rs2 := -1, -1, -1
-	rdS, rsS := true, true // used by signed
-	rdU, rsU := true, true // used by unsigned
+	if sim.instructionViewBase() == base {
+		return
+	}
 
-	x := sim.registers // short name for read
+	for i := range sim.view.Codes {
+		sim.view.Codes[i].Address = fmt.Sprintf("0x%08x", sim.entryPoint+uint32((base+i)*4))
+	}
+	sim.syncViewInstruction()
+}
 
-	switch mnemonic {
-	case "add":
-		rd, rs1, rs2 = decodeR(operand)
-		sim.registers[rd] = x[rs1] + x[rs2]
-	case "addi":
-		rd, rs1, imm = decodeI(operand)
-		sim.registers[rd] = x[rs1] + imm
-	case "sub":
-		rd, rs1, rs2 = decodeR(operand)
-		sim.registers[rd] = x[rs1] - x[rs2]
-	case "and":
-		rd, rs1, rs2 = decodeR(operand)
-		sim.registers[rd] = x[rs1] & x[rs2]
-	case "or":
-		rd, rs1, rs2 = decodeR(operand)
-		sim.registers[rd] = x[rs1] | x[rs2]
+func (sim *Simulator) syncViewInstruction() {
+	base := sim.instructionViewBase()
+	if base < 0 {
+		return
+	}
+	for i := range sim.view.Codes {
+		if len(sim.instructions) <= base+i {
+			break
+		}
+		v := sim.instructions[base+i]
+		sim.view.Codes[i].Code, sim.view.Codes[i].Fields = formatCode(v)
+		sim.view.Codes[i].Label = formatLabel(v.Label, sim.view.InstructionWidth)
+		sim.view.Codes[i].Mnemonic = v.MnemonicRaw
+		sim.view.Codes[i].Operand = formatOperand(v.Operand, sim.view.InstructionWidth)
+		sim.view.Codes[i].Pseudo = formatPseudo(v.Pseudo, sim.view.InstructionWidth)
+		bp, ok := sim.breakpoints[sim.entryPoint+uint32((base+i)*4)]
+		sim.view.Codes[i].Breakpoint, sim.view.Codes[i].Condition = ok, bp.Condition
+	}
+}
+
+func (sim *Simulator) instructionViewBase() int {
+	addr := sim.view.Codes[0].Address
+	if addr == "" {
+		return -1
+	}
+	base, _ := strconv.ParseUint(addr, 0, 32)
+	return int(uint32(base)-sim.entryPoint) / 4
+}
+
+func (sim *Simulator) syncView() {
+	sim.syncViewRegister()
+	sim.syncViewMemory()
+}
+
+func (sim *Simulator) syncViewDiagnostic() {
+	sim.view.Diagnostics = []DiagnosticRow{}
+	for _, v := range slices.Concat(sim.diagnostics, sim.warnings) {
+		row := DiagnosticRow{
+			Position: fmt.Sprintf("%s:%d", v.FileName, v.LineNo),
+			Severity: v.Severity,
+			Code:     v.Code,
+			Message:  v.Message,
+			Text:     sim.texts[Source{v.FileName, v.LineNo}],
+			Color:    ColorWrite,
+		}
+		if v.Severity != SeverityError {
+			row.Color = ColorRead
+		}
+		if 0 < v.Column && v.Column <= len(row.Text)+1 {
+			row.Position += fmt.Sprintf(":%d", v.Column)
+			indent := []byte(row.Text[:v.Column-1])
+			for i := range indent {
+				if indent[i] != '\t' {
+					indent[i] = ' '
+				}
+			}
+			row.Marker = string(indent) + "^" + strings.Repeat("~", max(0, v.EndColumn-v.Column-1))
+		}
+		sim.view.Diagnostics = append(sim.view.Diagnostics, row)
+	}
+}
+
+func (sim *Simulator) syncViewRegister() {
+	for i, v := range sim.registers {
+		sim.view.Regs[i].Signed = fmt.Sprintf("%d", int32(v))
+		sim.view.Regs[i].Unsigned = fmt.Sprintf("%d", v)
+		sim.view.Regs[i].Bin = fmt.Sprintf("%032b", v)
+		sim.view.Regs[i].Hex = fmt.Sprintf("%08x", v)
+	}
+}
+
+func (sim *Simulator) syncViewCsr() {
+	for i := range sim.view.Csrs {
+		sim.view.Csrs[i].Hex = fmt.Sprintf("%08x", sim.readCsr(i))
+	}
+}
+
+func (sim *Simulator) syncViewMemory() {
+	// upper half
+	base := sim.view.memoryBase()
+	sim.readMemory(base) // if not exists, be generated
+	mems := sim.memory[base]
+	for i, v := range mems {
+		ii, j := sim.view.memoryIndex(base + uint32(i))
+		sim.view.Mems[ii].Bytes[j].Hex = fmt.Sprintf("%02x", v)
+	}
+
+	// lower half
+	base += uint32(len(mems))
+	sim.readMemory(base) // if not exists, be generated
+	mems = sim.memory[base]
+	for i, v := range mems {
+		ii, j := sim.view.memoryIndex(base + uint32(i))
+		sim.view.Mems[ii].Bytes[j].Hex = fmt.Sprintf("%02x", v)
+	}
+}
+
+func (sim *Simulator) focusViewMemoryRange(effect *Effect) {
+	either := effect.MemWrite
+	if either == nil {
+		either = effect.MemRead
+	}
+	if either == nil {
+		return
+	}
+
+	base := sim.view.memoryBase()
+	minAddr := slices.Min(either)
+	maxAddr := slices.Max(either)
+	if base <= minAddr && maxAddr < base+(16*16*2) {
+		return
+	}
+
+	if maxAddr < 0x200 {
+		base = 0
+	} else {
+		base = min(minAddr&0xffffff00, 0xfffffe00)
+	}
+	for i := range sim.view.Mems {
+		sim.view.Mems[i].BaseAddress = fmt.Sprintf("0x%08x", base+uint32(i*16))
+	}
+
+	sim.syncViewMemory()
+}
+
+func (view *SinglePageView) memoryBase() uint32 {
+	base, _ := strconv.ParseUint(view.Mems[0].BaseAddress, 0, 32)
+	return uint32(base)
+}
+
+func (view *SinglePageView) memoryIndex(addr uint32) (i, j int) {
+	base := view.memoryBase()
+	if addr < base {
+		return -1, -1
+	}
+	size := len(view.Mems[0].Bytes)
+	i, j = int(addr-base)/size, int(addr-base)%size
+	return
+}
+
+func (view *SinglePageView) setStatus(status DisabledButton) {
+	view.Disabled = status
+}
+
+func (view *SinglePageView) wasDisabled(req string) bool {
+	if strings.HasPrefix(req, TO) {
+		return view.Disabled.Run
+	}
+	switch req {
+	case RUN:
+		return view.Disabled.Run
+	case STEP, STEP10, STEP100, OVER, OUT:
+		return view.Disabled.Step
+	case BACK, REVERSE:
+		return view.Undoable == 0
+	case STOP:
+		return view.Disabled.Stop
+	case RELOAD:
+		return view.Disabled.Reload
+	}
+	return false
+}
+
+func (sim *Simulator) validate(lines [][3]string) Diagnostics {
+	r := sim.newReporter()
+	for i, v := range lines[min(len(sim.sources), len(lines)):] { // not read from the file
+		fileName, lineNo := sim.source(len(sim.sources) + i + 1)
+		r.texts[Source{fileName, lineNo}] = strings.TrimSpace(v[0] + " " + v[1] + " " + v[2])
+	}
+
+	symbols := newSymbols() // labels and constants
+	filtered := [][4]string{}
+	nextAddress := sim.entryPoint
+	dataAddress := sim.dataBase
+	section := ".text"
+	forward := [][3]string{} // line number, name and expression. sizes are given by the symbols defined so far
+	for i, v := range lines {
+		definedLabel, mnemonic, operand := v[0], v[1], v[2]
+		fileName, lineNo := sim.sourceFor(r, i+1)
+		if definedLabel != "" {
+			label := strings.TrimSuffix(definedLabel, ":")
+			if isLocalLabel(definedLabel) {
+				if section == ".text" {
+					symbols.locals.define(label, i, nextAddress)
+				} else {
+					symbols.locals.define(label, i, dataAddress)
+				}
+			} else if !validateLabel(definedLabel) {
+				logerr(r, fileName, lineNo, "invalid-label", spanLabel, "invalid label(%s)", definedLabel)
+			} else if _, ok := symbols.values[label]; ok {
+				logerr(r, fileName, lineNo, "label-duplicated", spanLabel, "label duplicated(%s)", definedLabel)
+			} else if section == ".text" {
+				symbols.values[label] = nextAddress // case-sensitive
+			} else {
+				symbols.values[label] = dataAddress
+			}
+		}
+		symbols.line = i
+		if size := sizeOperand(normalizeMnemonic(mnemonic), operand); size != "" {
+			if _, err := evaluate(size, symbols); err != nil {
+				name := "immediate"
+				if isDirective(mnemonic) {
+					name = "size"
+				}
+				forward = append(forward, [3]string{strconv.Itoa(i + 1), name, size})
+			}
+		}
+		if isDirective(mnemonic) {
+			directive := normalizeMnemonic(mnemonic)
+			if directive == ".equ" || directive == ".set" {
+				validateConstant(r, fileName, lineNo, operand, symbols)
+				continue
+			}
+			if s, ok := sectionOf(directive, operand); ok {
+				section = s
+			} else if section == ".data" {
+				dataAddress += uint32(len(assembleData(directive, operand, dataAddress, symbols)))
+			}
+			filtered = append(filtered, [4]string{strconv.Itoa(i + 1), mnemonic, operand, section})
+			continue
+		}
+		if mnemonic != "" {
+			filtered = append(filtered, [4]string{strconv.Itoa(i + 1), mnemonic, operand, section})
+			if section == ".text" {
+				nextAddress += uint32(pseudoSize(normalizeMnemonic(mnemonic), normalizeOperand(operand), symbols) * 4)
+			}
+		}
+	}
+	for _, v := range forward {
+		n, _ := strconv.Atoi(v[0])
+		symbols.line = n - 1
+		if _, err := evaluate(v[2], symbols); err == nil { // otherwise reported below
+			fileName, lineNo := sim.sourceFor(r, n)
+			at := Span(1) // li rd, immediate
+			if v[1] == "size" {
+				at = 0
+			}
+			logerr(r, fileName, lineNo, "invalid-"+v[1], at, "invalid %s(%s) symbol defined later", v[1], v[2])
+		}
+	}
+	if sim.dataBase < dataAddress && sim.entryPoint < dataAddress && sim.dataBase < nextAddress {
+		fileName, lineNo := sim.sourceFor(r, len(lines))
+		logerr(r, fileName, lineNo, "section-overlapped", spanLine, "text(0x%08x-0x%08x) overlaps data(0x%08x-0x%08x)", sim.entryPoint, nextAddress, sim.dataBase, dataAddress)
+	}
+
+	pc := sim.entryPoint
+	pcrelHi := map[uint32]struct{}{}
+	pcrelLo := [][4]string{} // line number, label, its address and the operand index
+	for _, v := range filtered {
+		n, _ := strconv.Atoi(v[0])
+		fileName, lineNo := sim.sourceFor(r, n)
+		mnemonic, operand, section := v[1], v[2], v[3]
+		symbols.line = n - 1
+		if isDirective(mnemonic) {
+			validateDirective(r, fileName, lineNo, normalizeMnemonic(mnemonic), operand, section, symbols)
+			continue
+		}
+		if section != ".text" {
+			logerr(r, fileName, lineNo, "misplaced-instruction", spanMnemonic, "instruction(%s) in %s section", mnemonic, section)
+			continue
+		}
+		sim.validateInstruction(r, fileName, lineNo, mnemonic, operand, pc, symbols)
+		for _, reloc := range relocations(normalizeOperand(operand)) {
+			switch {
+			case reloc[0] == "pcrel_hi" && normalizeMnemonic(mnemonic) == "auipc":
+				pcrelHi[pc] = struct{}{}
+			case reloc[0] == "pcrel_lo":
+				if addr, ok := symbols.lookup(reloc[1]); ok { // otherwise reported by validateRelocation
+					at := slices.IndexFunc(splitUnquoted(operand), func(s string) bool { return strings.Contains(s, "%pcrel_lo(") })
+					pcrelLo = append(pcrelLo, [4]string{v[0], reloc[1], strconv.FormatUint(uint64(addr), 10), strconv.Itoa(at)})
+				}
+			}
+		}
+		pc += uint32(pseudoSize(normalizeMnemonic(mnemonic), normalizeOperand(operand), symbols) * 4)
+	}
+	for _, v := range pcrelLo {
+		n, _ := strconv.Atoi(v[0])
+		fileName, lineNo := sim.sourceFor(r, n)
+		addr, _ := strconv.ParseUint(v[2], 10, 32)
+		if _, found := pcrelHi[uint32(addr)]; !found {
+			at, _ := strconv.Atoi(v[3])
+			logerr(r, fileName, lineNo, "auipc-not-found", Span(at), "label(%s) is not at auipc with %%pcrel_hi", v[1]+":")
+		}
+	}
+
+	return r.diagnostics
+}
+
+// common mistakes in the loaded program. warnings do not block RUN
+func (sim *Simulator) lint(lines [][3]string) Diagnostics {
+	r := sim.newReporter()
+
+	count := slices.IndexFunc(sim.program, func(v Instruction) bool { return v.Mnemonic == "" }) // except for the trailing label
+	if count == -1 {
+		count = len(sim.program)
+	}
+	program := sim.program[:count]
+	end := sim.entryPoint + uint32(count*4) // past the last instruction
+
+	// jump targets, call targets and written registers
+	targets := map[uint32]struct{}{}
+	calls := []uint32{}
+	written := [32]bool{}
+	for i, v := range program {
+		pc := sim.entryPoint + uint32(i*4)
+		opcode, rd := v.Code&0x7f, v.Code>>7&0x1f
+		switch opcode {
+		case opBranch:
+			targets[pc+uint32(offsetB(v.Code))] = struct{}{}
+		case opJal:
+			targets[pc+uint32(offsetJ(v.Code))] = struct{}{}
+			if rd == 1 {
+				calls = append(calls, pc+uint32(offsetJ(v.Code)))
+			}
+		case opJalr: // call. auipc ra and jalr ra
+			if prev := sim.program[max(0, i-1)]; rd == 1 && 0 < i && prev.Code&0x7f == opAuipc && prev.Code>>7&0x1f == 1 && v.Code>>15&0x1f == 1 {
+				calls = append(calls, pc-4+prev.Code&0xfffff000+uint32(int32(v.Code)>>20))
+			}
+		case opSystem:
+			if v.Code>>12&0b111 == 0 {
+				written[a0] = true // by the system calls
+			}
+		}
+		if opcode != opStore && opcode != opBranch {
+			written[rd] = true
+		}
+	}
+	if sim.stack != 0 {
+		written[2] = true
+	}
+
+	// the operand in the source. rearranged by the pseudo instruction
+	at := func(v Instruction, i int) Span {
+		if v.Pseudo == "" {
+			return Span(i)
+		}
+		_, operand, _ := strings.Cut(v.Pseudo, " ")
+		return pseudoSpans(splitUnquoted(operand), splitUnquoted(v.Operand))[i]
+	}
+
+	unconditional := false // after jal x0
+	reported := false
+	for i, v := range program {
+		pc := sim.entryPoint + uint32(i*4)
+		fileName, lineNo := sim.sourceFor(r, v.Line)
+		operands := strings.FieldsFunc(v.Operand, func(c rune) bool { return c == ',' || c == '(' || c == ')' })
+		opcode, rd, rs1 := v.Code&0x7f, v.Code>>7&0x1f, v.Code>>15&0x1f
+
+		if _, ok := targets[pc]; ok || v.Label != "" {
+			unconditional, reported = false, false
+		}
+		if unconditional && !reported {
+			mnemonic := v.MnemonicRaw
+			if v.Pseudo != "" {
+				mnemonic, _, _ = strings.Cut(v.Pseudo, " ")
+			}
+			logwarn(r, fileName, lineNo, "unreachable-instruction", spanMnemonic, "unreachable instruction(%s) after jal x0", mnemonic)
+			reported = true // once until the next label
+		}
+
+		switch opcode {
+		case opReg, opImm, opLoad, opLui, opAuipc:
+			if rd == 0 && v.Code != 0x00000013 { // except for nop
+				logwarn(r, fileName, lineNo, "ineffective-write", at(v, 0), "ineffective write(%s) to x0", operands[0])
+			}
+		case opBranch, opJal:
+			offset := offsetB(v.Code)
+			if opcode == opJal {
+				offset = offsetJ(v.Code)
+				unconditional = unconditional || rd == 0
+			}
+			if target := pc + uint32(offset); target < sim.entryPoint || end < target { // except for the label after the last instruction. e.g. end:
+				logwarn(r, fileName, lineNo, "target-out-of-range", at(v, len(splitUnquoted(v.Operand))-1), "target out of range(%s) beyond the end of the program", operands[len(operands)-1])
+			}
+		case opJalr:
+			if !written[rs1] {
+				name := fmt.Sprintf("x%d", rs1)
+				for _, v := range operands[1:] {
+					if n, ok := registerMapping[v]; ok && n == int(rs1) {
+						name = v
+					}
+				}
+				logwarn(r, fileName, lineNo, "unwritten-register", at(v, len(splitUnquoted(v.Operand))-1), "unwritten register(%s) as the jalr target", name)
+			}
+		}
+	}
+
+	// callee-saved registers from the call target to ret. saved by sw and restored by lw on sp
+	saved := func(n uint32) bool { return n == 8 || n == 9 || (18 <= n && n <= 27) } // s0-s11
+	for _, call := range calls {
+		if call < sim.entryPoint || end <= call || call&3 != 0 {
+			continue
+		}
+		stored, restored := map[uint32]bool{}, map[uint32]bool{}
+		clobbered := map[uint32]Instruction{} // at the first write
+		order := []uint32{}
+		for _, v := range program[(call-sim.entryPoint)/4:] {
+			opcode, rd, rs1, rs2 := v.Code&0x7f, v.Code>>7&0x1f, v.Code>>15&0x1f, v.Code>>20&0x1f
+			if v.Code == 0x00008067 { // ret
+				break
+			}
+			switch {
+			case opcode == opStore && rs1 == 2 && saved(rs2):
+				stored[rs2] = true
+			case opcode == opLoad && rs1 == 2 && saved(rd):
+				restored[rd] = true
+			case opcode != opStore && opcode != opBranch && saved(rd):
+				if _, ok := clobbered[rd]; !ok {
+					clobbered[rd] = v
+					order = append(order, rd)
+				}
+			}
+		}
+		for _, n := range order {
+			if stored[n] && restored[n] {
+				continue
+			}
+			v := clobbered[n]
+			fileName, lineNo := sim.sourceFor(r, v.Line)
+			operand, _, _ := strings.Cut(v.Operand, ",")
+			logwarn(r, fileName, lineNo, "callee-saved-register-clobbered", at(v, 0), "callee-saved register clobbered(%s) without being restored", operand)
+		}
+	}
+
+	// referenced by any operand. the entry is used. e.g. main
+	used := map[string]bool{}
+	for _, v := range lines {
+		for _, token := range strings.FieldsFunc(v[2], func(c rune) bool { return c < 0 || 0x7f < c || !validateLabelChar(byte(c)) }) {
+			used[token] = true
+		}
+	}
+	for i, v := range lines {
+		label := strings.TrimSuffix(v[0], ":")
+		if label == "" || isLocalLabel(v[0]) || used[label] {
+			continue
+		}
+		if addr, ok := sim.labelMapping[label]; ok && addr == sim.start {
+			continue
+		}
+		fileName, lineNo := sim.sourceFor(r, i+1)
+		logwarn(r, fileName, lineNo, "unused-label", spanLabel, "unused label(%s)", v[0])
+	}
+
+	return r.diagnostics
+}
+
+func (sim *Simulator) validateInstruction(r *Reporter, fileName string, lineNo int, mnemonic, operand string, pc uint32, symbols *Symbols) bool {
+	valid := true
+	switch strings.ToLower(mnemonic) { // case-insensitive
+	case "add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu":
+		valid = validateR(r, fileName, lineNo, operand)
+	case "mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu": // RV32M
+		valid = validateR(r, fileName, lineNo, operand)
+	case "addi", "andi", "ori", "xori":
+		valid = validateI(r, fileName, lineNo, operand, symbols)
+	case "sb", "sh", "sw":
+		valid = validateS(r, fileName, lineNo, operand, symbols)
+	case "beq", "bne", "blt", "bltu", "bge", "bgeu":
+		valid = validateB(r, fileName, lineNo, operand, pc, symbols)
+	case "lui", "auipc":
+		valid = validateU(r, fileName, lineNo, strings.ToLower(mnemonic), operand, symbols)
+	case "jal":
+		valid = validateJ(r, fileName, lineNo, operand, pc, symbols)
+	case "jalr":
+		valid = validateJalr(r, fileName, lineNo, operand, symbols)
+	case "slli", "srli", "srai", "slti", "sltiu":
+		valid = validateShift(r, fileName, lineNo, operand, symbols)
+	case "lbu", "lb", "lhu", "lh", "lw":
+		valid = validateLoad(r, fileName, lineNo, operand, symbols)
+	case "ecall", "ebreak", "mret":
+		valid = validateNoOperand(r, fileName, lineNo, operand)
+	case "fence":
+		valid = validateFence(r, fileName, lineNo, operand)
+	case "csrrw", "csrrs", "csrrc":
+		// once it was RV32I, but was excluded in Ratified version. move to Zicsr
+		valid = validateCsr(r, fileName, lineNo, operand)
+	case "csrrwi", "csrrsi", "csrrci":
+		valid = validateCsrImmediate(r, fileName, lineNo, operand, symbols)
+	case "fence.i":
+		// once it was RV32I, but was excluded in Ratified version. move to Zifencei. no longer RV32I Base Integer Instruction Set
+		valid = false
+		logerr(r, fileName, lineNo, "unimplemented-zifencei-instruction", spanMnemonic, "unimplemented Zifencei instruction(%s)", mnemonic)
+	default:
+		if _, ok := pseudoOperands[strings.ToLower(mnemonic)]; ok {
+			return sim.validatePseudo(r, fileName, lineNo, strings.ToLower(mnemonic), operand, pc, symbols)
+		}
+		valid = false
+		logerr(r, fileName, lineNo, "unknown-instruction", spanMnemonic, "unknown instruction(%s)", mnemonic)
+	}
+	return valid
+}
+
+// validated by the expanded instructions except for immediates and labels beyond their range
+func (sim *Simulator) validatePseudo(r *Reporter, fileName string, lineNo int, mnemonic, operand string, pc uint32, symbols *Symbols) bool {
+	operands := []string{}
+	if operand != "" {
+		operands = splitUnquoted(operand)
+	}
+	if len(operands) != pseudoOperands[mnemonic] {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	for i := range operands {
+		operands[i] = strings.TrimSpace(operands[i])
+	}
+
+	valid := true
+	switch mnemonic {
+	case "li":
+		if _, ok := registerMapping[operands[0]]; !ok {
+			valid = false
+			logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", operands[0])
+		}
+		return validateExpression(r, fileName, lineNo, "immediate", 1, operands[1], symbols, math.MinInt32, math.MaxUint32, "32 bit integer") && valid
+	case "la":
+		if _, ok := registerMapping[operands[0]]; !ok {
+			valid = false
+			logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", operands[0])
+		}
+		fallthrough
+	case "call", "tail": // plus-minus 2 GiB. the whole address space
+		if _, ok := symbols.lookup(operands[len(operands)-1]); !ok {
+			valid = false
+			logerr(r, fileName, lineNo, "label-not-found", Span(len(operands)-1), "label not found(%s)", operands[len(operands)-1]+":")
+		}
+		return valid
+	}
+
+	for _, v := range expandPseudo(mnemonic, normalizeOperand(operand), pc, nil) {
+		restore := r.remap(pseudoSpans(operands, splitUnquoted(v[1])))
+		valid = sim.validateInstruction(r, fileName, lineNo, v[0], v[1], pc, symbols) && valid
+		restore()
+		pc += 4
+	}
+	return valid
+}
+
+// unknown directives are ignored. e.g. .globl
+func validateDirective(r *Reporter, fileName string, lineNo int, directive, operand, section string, symbols *Symbols) bool {
+	switch directive {
+	case ".text", ".data", ".bss", ".rodata", ".section":
+		if directive == ".section" && operand == "" {
+			logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+			return false
+		}
+		return true
+	case ".word", ".half", ".byte", ".ascii", ".asciz", ".string", ".space", ".zero":
+		if section == ".text" {
+			logerr(r, fileName, lineNo, "misplaced-data-directive", spanMnemonic, "data directive(%s) in .text section", directive)
+			return false
+		}
+	case ".equ", ".set": // defined by validate
+		return true
+	case ".align":
+		n, err := evaluate(operand, symbols)
+		if err != nil || n < 0 || 12 < n {
+			logerr(r, fileName, lineNo, "invalid-alignment", 0, "invalid alignment(%s) 0 <= n <= 12", describe(operand, n))
+			return false
+		}
+		if section == ".text" && 2 < n {
+			logerr(r, fileName, lineNo, "invalid-alignment", 0, "invalid alignment(%s) n <= 2 in .text section", operand)
+			return false
+		}
+		return true
+	default:
+		return true
+	}
+
+	if operand == "" {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	valid := true
+	switch directive {
+	case ".word", ".half", ".byte":
+		bits := map[string]int{".word": 32, ".half": 16, ".byte": 8}[directive]
+		for i, v := range splitUnquoted(operand) {
+			valid = validateExpression(r, fileName, lineNo, "value", Span(i), v, symbols, -(1<<(bits-1)), (1<<bits)-1, fmt.Sprintf("%d bit integer", bits)) && valid
+		}
+	case ".ascii", ".asciz", ".string":
+		for i, v := range splitUnquoted(operand) {
+			if _, ok := unquoteString(v); !ok {
+				valid = false
+				logerr(r, fileName, lineNo, "invalid-string", Span(i), "invalid string(%s)", v)
+			}
+		}
+	case ".space", ".zero":
+		valid = validateExpression(r, fileName, lineNo, "size", 0, operand, symbols, 0, 1<<20-1, "less than 1 MiB")
+	}
+	return valid
+}
+
+// name, expression. evaluated by the symbols defined so far
+func validateConstant(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	name, expr, ok := strings.Cut(operand, ",")
+	name, expr = strings.TrimSpace(name), strings.TrimSpace(expr)
+	if !ok || expr == "" {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	if !validateLabel(name + ":") {
+		logerr(r, fileName, lineNo, "invalid-symbol", 0, "invalid symbol(%s)", name)
+		return false
+	}
+	if _, ok := symbols.values[name]; ok {
+		logerr(r, fileName, lineNo, "symbol-duplicated", 0, "symbol duplicated(%s)", name)
+		return false
+	}
+	v, err := evaluate(expr, symbols)
+	if err != nil {
+		logerr(r, fileName, lineNo, "invalid-value", 1, "invalid value(%s) %v", expr, err)
+		return false
+	}
+	if v < math.MinInt32 || math.MaxUint32 < v {
+		logerr(r, fileName, lineNo, "invalid-value", 1, "invalid value(%s) 32 bit integer", describe(expr, v))
+		return false
+	}
+	symbols.values[name] = uint32(v)
+	return true
+}
+
+// e.g. 1: referenced by 1b or 1f
+func isLocalLabel(definedLabel string) bool {
+	number := strings.TrimSuffix(definedLabel, ":")
+	return number != definedLabel && number != "" && strings.Trim(number, "0123456789") == ""
+}
+
+// labels and constants by the name. numeric local labels are resolved for the line
+type Symbols struct {
+	values map[string]uint32
+	locals LocalLabels
+	line   int // the index. Nb and Nf are relative to it
+}
+
+func newSymbols() *Symbols {
+	return &Symbols{values: map[string]uint32{}, locals: LocalLabels{}}
+}
+
+// the labels of the loaded program. no local labels
+func (sim *Simulator) symbols() *Symbols {
+	return &Symbols{values: sim.labelMapping}
+}
+
+// nil has no symbols
+func (s *Symbols) lookup(name string) (uint32, bool) {
+	if s == nil {
+		return 0, false
+	}
+	if v, ok := s.values[name]; ok {
+		return v, true
+	}
+	return s.locals.resolve(name, s.line)
+}
+
+// numeric local labels by the number. the line index and the address of each definition in order
+type LocalLabels map[string][][2]uint32
+
+// in the order of the lines
+func (l LocalLabels) define(number string, index int, addr uint32) {
+	l[number] = append(l[number], [2]uint32{uint32(index), addr})
+}
+
+// Nb is the nearest definition backward including the line itself, and Nf forward. by binary search
+func (l LocalLabels) resolve(name string, index int) (uint32, bool) {
+	number, direction := name[:max(0, len(name)-1)], name[max(0, len(name)-1):]
+	definitions := l[number]
+	i := sort.Search(len(definitions), func(i int) bool { return index < int(definitions[i][0]) }) // the first forward
+	switch {
+	case direction == "b" && 0 < i:
+		return definitions[i-1][1], true
+	case direction == "f" && i < len(definitions):
+		return definitions[i][1], true
+	}
+	return 0, false
+}
+
+// unspecified. avoid unlimited
+func validateLabel(label string) bool {
+	if len(label) < 2 || 4096 < len(label) {
+		return false
+	}
+	bytes := []byte(label)
+	if !validateLabelFirstChar(bytes[0]) {
+		return false
+	}
+	if bytes[len(bytes)-1] != ':' { // trailing
+		return false
+	}
+	for _, v := range bytes[1 : len(bytes)-1] {
+		if !validateLabelChar(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateLabelFirstChar(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || c == '_' || c == '.' || c == '$'
+}
+
+func validateLabelChar(c byte) bool {
+	return validateLabelFirstChar(c) || ('0' <= c && c <= '9')
+}
+
+func validateR(r *Reporter, fileName string, lineNo int, operand string) bool {
+	const exp = 3
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	valid := true
+	rd, rs1, rs2 := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	if _, ok := registerMapping[rs1]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs1", 1, "invalid rs1(%s)", rs1)
+	}
+	if _, ok := registerMapping[rs2]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs2", 2, "invalid rs2(%s)", rs2)
+	}
+	return valid
+}
+
+func validateI(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	return validateImmediate(r, fileName, lineNo, operand, false, symbols)
+}
+
+func validateS(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	return validateOffset(r, fileName, lineNo, operand, true, symbols)
+}
+
+func validateB(r *Reporter, fileName string, lineNo int, operand string, pc uint32, symbols *Symbols) bool {
+	const exp = 3
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	rs1, rs2, label := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
+	definedLabel := label + ":"
+	valid := true
+	if _, ok := registerMapping[rs1]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs1", 0, "invalid rs1(%s)", rs1)
+	}
+	if _, ok := registerMapping[rs2]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs2", 1, "invalid rs2(%s)", rs2)
+	}
+	if addr, ok := symbols.lookup(label); !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "label-not-found", 2, "label not found(%s)", definedLabel)
+	} else if offset := int32(addr - pc); offset < -4096 || 4094 < offset {
+		valid = false
+		logerr(r, fileName, lineNo, "label-out-of-range", 2, "label out of range(%s) plus-minus 4 KiB", definedLabel)
+	}
+	return valid
+}
+
+// %hi for lui and %pcrel_hi for auipc
+func validateU(r *Reporter, fileName string, lineNo int, mnemonic, operand string, symbols *Symbols) bool {
+	const exp = 2
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	rd, imm := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1])
+	valid := true
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	if name, _, ok := parseRelocation(imm); ok {
+		if relocation := map[string]string{"lui": "hi", "auipc": "pcrel_hi"}[mnemonic]; name != relocation {
+			logerr(r, fileName, lineNo, "invalid-relocation", 1, "invalid relocation(%s) %%%s for %s", imm, relocation, mnemonic)
+			return false
+		}
+		return validateRelocation(r, fileName, lineNo, 1, imm, "hi", "pcrel_hi", symbols) && valid
+	}
+	return validateExpression(r, fileName, lineNo, "immediate", 1, imm, symbols, 0, 1<<20-1, "20 bit unsigned integer") && valid
+}
+
+func validateJ(r *Reporter, fileName string, lineNo int, operand string, pc uint32, symbols *Symbols) bool {
+	const exp = 2
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		if len(operands) != 1 {
+			logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+			return false
+		}
+		operands = []string{"", operands[0]}
+		defer r.remap([]Span{spanLine, 0})()
+	}
+	rd, label := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1])
+	definedLabel := label + ":"
+	if rd == "" {
+		rd = ra
+	}
+	valid := true
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	if addr, ok := symbols.lookup(label); !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "label-not-found", 1, "label not found(%s)", definedLabel)
+	} else if offset := int32(addr - pc); offset < -(1<<20) || (1<<20)-2 < offset {
+		valid = false
+		logerr(r, fileName, lineNo, "label-out-of-range", 1, "label out of range(%s) plus-minus 1 MiB", definedLabel)
+	}
+	return valid
+}
+
+func validateJalr(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	operands := strings.SplitN(operand, ",", 3)
+	if len(operands) == 1 {
+		operand = ra + "," + operand
+		defer r.remap([]Span{spanLine, 0})()
+	} else if len(operands) == 2 && strings.TrimSpace(operands[0]) == "" {
+		operand = ra + operand
+	}
+	return validateOffset(r, fileName, lineNo, operand, false, symbols)
+}
+
+func validateShift(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	return validateImmediate(r, fileName, lineNo, operand, true, symbols)
+}
+
+func validateLoad(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	return validateOffset(r, fileName, lineNo, operand, false, symbols)
+}
+
+func validateCsr(r *Reporter, fileName string, lineNo int, operand string) bool {
+	const exp = 3
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	rd, csr, rs1 := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
+	valid := true
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	if _, ok := registerMapping[rs1]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs1", 2, "invalid rs1(%s)", rs1)
+	}
+	return validateCsrNumber(r, fileName, lineNo, 1, csr) && valid
+}
+
+func validateCsrImmediate(r *Reporter, fileName string, lineNo int, operand string, symbols *Symbols) bool {
+	const exp = 3
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	rd, csr, imm := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
+	valid := true
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	valid = validateExpression(r, fileName, lineNo, "uimm", 2, imm, symbols, 0, 31, "0 <= uimm <= 31") && valid
+	return validateCsrNumber(r, fileName, lineNo, 1, csr) && valid
+}
+
+// unimplemented or read-only is not an error here, but raises an illegal instruction exception
+func validateCsrNumber(r *Reporter, fileName string, lineNo int, at Span, csr string) bool {
+	if _, ok := csrMapping[csr]; ok {
+		return true
+	}
+	if _, err := strconv.ParseUint(csr, 0, 12); err != nil {
+		logerr(r, fileName, lineNo, "invalid-csr", at, "invalid csr(%s)", csr)
+		return false
+	}
+	return true
+}
+
+func validateNoOperand(r *Reporter, fileName string, lineNo int, operand string) bool {
+	if operand != "" {
+		logerr(r, fileName, lineNo, "parse-failed", 0, "parse failed(%s)", operand)
+		return false
+	}
+	return true
+}
+
+func validateFence(r *Reporter, fileName string, lineNo int, operand string) bool {
+	if operand == "" {
+		return true // fence iorw, iorw
+	}
+	const exp = 2
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	valid := true
+	for i, v := range operands {
+		set := strings.ToLower(strings.TrimSpace(v))
+		if set == "" || strings.Trim(set, "iorw") != "" {
+			valid = false
+			logerr(r, fileName, lineNo, "invalid-ordering", Span(i), "invalid ordering(%s) combination of i, o, r and w", strings.TrimSpace(v))
+		}
+	}
+	return valid
+}
+
+func validateImmediate(r *Reporter, fileName string, lineNo int, operand string, shift bool, symbols *Symbols) bool {
+	const exp = 3
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	rd, rs1, imm := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1]), strings.TrimSpace(operands[2])
+	valid := true
+	if _, ok := registerMapping[rd]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rd)
+	}
+	if _, ok := registerMapping[rs1]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs1", 1, "invalid rs1(%s)", rs1)
+	}
+	if shift {
+		valid = validateExpression(r, fileName, lineNo, "shamt", 2, imm, symbols, 0, 31, "0 <= shamt <= 31") && valid
+	} else if _, _, ok := parseRelocation(imm); ok {
+		valid = validateRelocation(r, fileName, lineNo, 2, imm, "lo", "pcrel_lo", symbols) && valid
+	} else {
+		valid = validateExpression(r, fileName, lineNo, "immediate", 2, imm, symbols, -(1<<11), 1<<11-1, "12 bit signed integer") && valid
+	}
+	return valid
+}
+
+func validateOffset(r *Reporter, fileName string, lineNo int, operand string, store bool, symbols *Symbols) bool {
+	const exp = 2
+	operands := splitUnquoted(operand)
+	if len(operands) != exp {
+		logerr(r, fileName, lineNo, "parse-failed", spanLine, "parse failed")
+		return false
+	}
+	b := strings.LastIndex(operands[1], "(") // %lo(symbol)(rs1)
+	e := strings.LastIndex(operands[1], ")")
+	if b < 0 || e <= 0 || e < b || e != len(operands[1])-1 {
+		logerr(r, fileName, lineNo, "parse-failed", 1, "parse failed(%s)", strings.TrimSpace(operands[1]))
+		return false
+	}
+	rdrs2, offset, rs1 := strings.TrimSpace(operands[0]), strings.TrimSpace(operands[1][:b]), strings.TrimSpace(operands[1][b+1:e])
+	valid := true
+	if _, ok := registerMapping[rdrs2]; !ok {
+		valid = false
+		if store {
+			logerr(r, fileName, lineNo, "invalid-rs2", 0, "invalid rs2(%s)", rdrs2)
+		} else {
+			logerr(r, fileName, lineNo, "invalid-rd", 0, "invalid rd(%s)", rdrs2)
+		}
+	}
+	if _, ok := registerMapping[rs1]; !ok {
+		valid = false
+		logerr(r, fileName, lineNo, "invalid-rs1", 1, "invalid rs1(%s)", rs1)
+	}
+	if _, _, ok := parseRelocation(offset); ok {
+		valid = validateRelocation(r, fileName, lineNo, 1, offset, "lo", "pcrel_lo", symbols) && valid
+	} else if offset != "" {
+		valid = validateExpression(r, fileName, lineNo, "offset", 1, offset, symbols, -(1<<11), 1<<11-1, "12 bit signed integer") && valid
+	}
+	return valid
+}
+
+// hi and lo, or pcrel_hi and pcrel_lo. the label of %pcrel_lo is checked by validate
+func validateRelocation(r *Reporter, fileName string, lineNo int, at Span, s, absolute, pcrel string, symbols *Symbols) bool {
+	name, symbol, _ := parseRelocation(s)
+	if name != absolute && name != pcrel {
+		logerr(r, fileName, lineNo, "invalid-relocation", at, "invalid relocation(%s) %%%s or %%%s", s, absolute, pcrel)
+		return false
+	}
+	if name == "pcrel_lo" {
+		if _, ok := symbols.lookup(symbol); !ok {
+			logerr(r, fileName, lineNo, "label-not-found", at, "label not found(%s)", symbol+":")
+			return false
+		}
+		return true
+	}
+	if _, err := evaluate(symbol, symbols); err != nil {
+		logerr(r, fileName, lineNo, "invalid-relocation", at, "invalid relocation(%s) %v", s, err)
+		return false
+	}
+	return true
+}
+
+// evaluated within min and max
+func validateExpression(r *Reporter, fileName string, lineNo int, name string, at Span, expr string, symbols *Symbols, min, max int64, description string) bool {
+	v, err := evaluate(expr, symbols)
+	if err != nil {
+		logerr(r, fileName, lineNo, "invalid-"+name, at, "invalid %s(%s) %v", name, expr, err)
+		return false
+	}
+	if v < min || max < v {
+		logerr(r, fileName, lineNo, "invalid-"+name, at, "invalid %s(%s) %s", name, describe(expr, v), description)
+		return false
+	}
+	return true
+}
+
+// the expression and its value. e.g. 1<<12 = 4096
+func describe(expr string, v int64) string {
+	if _, err := strconv.ParseInt(expr, 0, 64); err == nil {
+		return expr
+	}
+	return fmt.Sprintf("%s = %d", expr, v)
+}
+
+func logerr(r *Reporter, fileName string, lineNo int, code string, at Span, format string, a ...any) {
+	r.report(SeverityError, fileName, lineNo, code, at, format, a...)
+}
+
+func logwarn(r *Reporter, fileName string, lineNo int, code string, at Span, format string, a ...any) {
+	r.report(SeverityWarning, fileName, lineNo, code, at, format, a...)
+}
+
+// sharing the source lines
+func (sim *Simulator) newReporter() *Reporter {
+	if sim.texts == nil {
+		sim.texts = map[Source]string{}
+	}
+	return &Reporter{sink: sim.validationError, texts: sim.texts}
+}
+
+// the code is independent of the message. e.g. invalid-rd
+func (r *Reporter) report(severity, fileName string, lineNo int, code string, at Span, format string, a ...any) {
+	message := fmt.Sprintf(format, a...)
+	source := Source{fileName, lineNo}
+	if r.expansion != "" && r.line == source {
+		message += " " + r.expansion
+	}
+	d := Diagnostic{FileName: fileName, LineNo: lineNo, Severity: severity, Code: code, Message: message}
+	if 0 <= at && r.operands != nil {
+		if int(at) < len(r.operands) {
+			at = r.operands[at]
+		} else {
+			at = spanLine
+		}
+	}
+	d.Column, d.EndColumn = span(r.texts[source], at)
+	r.diagnostics = append(r.diagnostics, d)
+
+	if r.sink == nil {
+		return
+	}
+	datetime := time.Now().Format(time.DateTime)
+	prefix := fmt.Sprintf("%s %s:%d ", datetime, fileName, lineNo)
+	if severity != SeverityError {
+		prefix += severity + ": "
+	}
+	fmt.Fprintln(r.sink, prefix+message)
+}
+
+// one-based. zero if not in the line
+func span(text string, at Span) (int, int) {
+	fields := splitLine(text)
+	switch {
+	case at == spanLabel && fields[0] != "":
+		start := strings.Index(text, fields[0])
+		return start + 1, start + 1 + len(fields[0])
+	case at == spanMnemonic && fields[1] != "":
+		start, end := mnemonicSpan(text)
+		return start + 1, end + 1
+	case 0 <= at && fields[2] != "":
+		_, end := mnemonicSpan(text)
+		offset, operand := end+strings.Index(text[end:], fields[2]), fields[2]
+		for range at {
+			i := indexUnquoted(operand, ",")
+			if i == -1 {
+				return 0, 0
+			}
+			offset, operand = offset+i+1, operand[i+1:]
+		}
+		if i := indexUnquoted(operand, ","); i != -1 {
+			operand = operand[:i]
+		}
+		v := strings.TrimSpace(operand)
+		if v == "" {
+			return 0, 0
+		}
+		start := offset + strings.Index(operand, v)
+		return start + 1, start + 1 + len(v)
+	}
+	return 0, 0
+}
+
+// while validating the operands rearranged from the source. restored by the returned function
+func (r *Reporter) remap(operands []Span) func() {
+	saved := r.operands
+	if saved != nil {
+		for i, v := range operands {
+			if 0 <= v {
+				operands[i] = spanLine
+				if int(v) < len(saved) {
+					operands[i] = saved[v]
+				}
+			}
+		}
+	}
+	r.operands = operands
+	return func() { r.operands = saved }
+}
+
+// the operands of the expanded instruction in those of the pseudo instruction. e.g. 0(rs) of jr rs
+func pseudoSpans(operands, expanded []string) []Span {
+	spans := make([]Span, len(expanded))
+	for i, v := range expanded {
+		spans[i] = spanLine // not from the source. e.g. x0
+		for j, w := range operands {
+			if w != "" && (v == w || strings.HasSuffix(v, "("+w+")")) {
+				spans[i] = Span(j)
+				break
+			}
+		}
+	}
+	return spans
+}
+
+// no errors. warnings are allowed
+func (d Diagnostics) valid() bool {
+	return !slices.ContainsFunc(d, func(v Diagnostic) bool { return v.Severity == SeverityError })
+}
+
+func (sim *Simulator) executeCurrent() *Effect {
+	if 0 < sim.historyDepth {
+		sim.undo = &Undo{Pc: sim.pc, Csrs: sim.csrs, Cycle: sim.cycle, Instret: sim.instret, Console: sim.console.Len(), Brk: sim.brk, ExitCode: sim.exitCode, Fault: sim.fault, Warnings: len(sim.warnings)}
+	}
+
+	current := sim.currentInstructionIndex()
+	inst := sim.fetch(current)
+	mnemonic, operand := inst.Mnemonic, inst.Operand // decoded and normalized
+
+	var imm, offset uint32 // sign-extended
+	var shamt, readBytes, writeBytes int
+	var addr uint32
+	var target *uint32
+
+	jump, pause := false, false
+	rd, rs1, rs2 := -1, -1, -1
+	csr, csrRead, csrWrite := -1, false, false
+	exception, tval := -1, uint32(0)
+	rdS, rs1S, rs2S := true, true, true // used by signed
+	rdU, rs1U, rs2U := true, true, true // used by unsigned
+
+	x := sim.registers // short name for read
+
+	switch mnemonic {
+	case "add":
+		rd, rs1, rs2 = decodeR(operand)
+		sim.registers[rd] = x[rs1] + x[rs2]
+	case "addi":
+		rd, rs1, imm = decodeI(operand)
+		sim.registers[rd] = x[rs1] + imm
+	case "sub":
+		rd, rs1, rs2 = decodeR(operand)
+		sim.registers[rd] = x[rs1] - x[rs2]
+	case "and":
+		rd, rs1, rs2 = decodeR(operand)
+		sim.registers[rd] = x[rs1] & x[rs2]
+	case "or":
+		rd, rs1, rs2 = decodeR(operand)
+		sim.registers[rd] = x[rs1] | x[rs2]
 	case "xor":
 		rd, rs1, rs2 = decodeR(operand)
-		sim.registers[rd] = x[rs1] ^ x[rs2]
-	case "andi":
-		rd, rs1, imm = decodeI(operand)
-		sim.registers[rd] = x[rs1] & imm
-	case "ori":
-		rd, rs1, imm = decodeI(operand)
-		sim.registers[rd] = x[rs1] | imm
-	case "xori":
-		rd, rs1, imm = decodeI(operand)
-		sim.registers[rd] = x[rs1] ^ imm
-	case "sll":
+		sim.registers[rd] = x[rs1] ^ x[rs2]
+	case "andi":
+		rd, rs1, imm = decodeI(operand)
+		sim.registers[rd] = x[rs1] & imm
+	case "ori":
+		rd, rs1, imm = decodeI(operand)
+		sim.registers[rd] = x[rs1] | imm
+	case "xori":
+		rd, rs1, imm = decodeI(operand)
+		sim.registers[rd] = x[rs1] ^ imm
+	case "sll":
+		rd, rs1, rs2 = decodeR(operand)
+		shamt = int(x[rs2] & 0b11111)       // lower 5 bits
+		sim.registers[rd] = x[rs1] << shamt // logical left shift
+	case "slli":
+		rd, rs1, shamt = decodeShift(operand)
+		sim.registers[rd] = x[rs1] << shamt // logical left shift
+	case "srl":
+		rd, rs1, rs2 = decodeR(operand)
+		shamt = int(x[rs2] & 0b11111)       // lower 5 bits
+		sim.registers[rd] = x[rs1] >> shamt // logical right shift
+	case "srli":
+		rd, rs1, shamt = decodeShift(operand)
+		sim.registers[rd] = x[rs1] >> shamt // logical right shift
+	case "sra":
+		rd, rs1, rs2 = decodeR(operand)
+		shamt = int(x[rs2] & 0b11111)                      // lower 5 bits
+		sim.registers[rd] = uint32(int32(x[rs1]) >> shamt) // arithmetic right shift
+	case "srai":
+		rd, rs1, shamt = decodeShift(operand)
+		sim.registers[rd] = uint32(int32(x[rs1]) >> shamt) // arithmetic right shift
+	case "slt":
+		rd, rs1, rs2 = decodeR(operand)
+		if int32(x[rs1]) < int32(x[rs2]) {
+			sim.registers[rd] = 1
+		} else {
+			sim.registers[rd] = 0
+		}
+		rs1U, rs2U = false, false
+	case "sltu":
+		rd, rs1, rs2 = decodeR(operand)
+		if x[rs1] < x[rs2] {
+			sim.registers[rd] = 1
+		} else {
+			sim.registers[rd] = 0
+		}
+		rs1S, rs2S = false, false
+	case "slti":
+		rd, rs1, imm = decodeI(operand)
+		if int32(x[rs1]) < int32(imm) {
+			sim.registers[rd] = 1
+		} else {
+			sim.registers[rd] = 0
+		}
+		rs1U, rs2U = false, false
+	case "sltiu":
+		rd, rs1, imm = decodeI(operand)
+		if x[rs1] < imm {
+			sim.registers[rd] = 1
+		} else {
+			sim.registers[rd] = 0
+		}
+		rs1S, rs2S = false, false
+	case "lui":
+		rd, imm = decodeU(operand)
+		sim.registers[rd] = imm << 12 // filling in the lowest 12 bits with zeros
+	case "auipc":
+		rd, imm = decodeU(operand)
+		offset = imm << 12 // filling in the lowest 12 bits with zeros
+		sim.registers[rd] = sim.pc + offset
+	case "lb":
+		rd, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		sim.registers[rd] = uint32(int8(sim.readMemory(addr))) // sign extends
+		readBytes, rdU = memoryBytes(mnemonic), false
+	case "lbu":
+		rd, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		sim.registers[rd] = uint32(sim.readMemory(addr)) // zero extends
+		readBytes, rdS = memoryBytes(mnemonic), false
+	case "lh":
+		rd, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1)}
+		sim.registers[rd] = uint32(int16(uint16(m[0]) | (uint16(m[1]) << 8))) // sign extends. little-endian
+		readBytes, rdU = memoryBytes(mnemonic), false
+	case "lhu":
+		rd, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1)}
+		sim.registers[rd] = uint32(m[0]) | (uint32(m[1]) << 8) // zero extends. little-endian
+		readBytes, rdS = memoryBytes(mnemonic), false
+	case "lw":
+		rd, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1), sim.readMemory(addr + 2), sim.readMemory(addr + 3)}
+		sim.registers[rd] = uint32(m[0]) | (uint32(m[1]) << 8) | (uint32(m[2]) << 16) | (uint32(m[3]) << 24) // little-endian
+		readBytes = memoryBytes(mnemonic)
+	case "sb", "sh", "sw":
+		rs2, rs1, offset = decodeOffset(operand)
+		addr = x[rs1] + offset
+		writeBytes = memoryBytes(mnemonic)
+		val := x[rs2]
+		for i := range uint32(writeBytes) {
+			sim.writeMemory(addr+i, byte(val>>(i*8))) // little-endian
+		}
+		sim.storeInstruction(addr, writeBytes)
+	case "jal":
+		rd, addr = decodeJ(operand, sim.symbols())
+		sim.registers[rd] = sim.pc + 4
+		target = &addr
+		jump = true
+	case "jalr":
+		rd, rs1, offset = decodeJalr(operand)
+		sim.registers[rd] = sim.pc + 4
+		addr = (x[rs1] + offset) &^ 1 // setting the least-significant bit of the result to zero
+		target = &addr
+		jump = true
+	case "beq":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = x[rs1] == x[rs2]
+	case "bne":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = x[rs1] != x[rs2]
+	case "blt":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = int32(x[rs1]) < int32(x[rs2])
+		rs1U, rs2U = false, false
+	case "bltu":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = x[rs1] < x[rs2]
+		rs1S, rs2S = false, false
+	case "bge":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = int32(x[rs1]) >= int32(x[rs2])
+		rs1U, rs2U = false, false
+	case "bgeu":
+		rs1, rs2, addr = decodeB(operand, sim.symbols())
+		target = &addr
+		jump = x[rs1] >= x[rs2]
+		rs1S, rs2S = false, false
+	case "mul":
+		rd, rs1, rs2 = decodeR(operand)
+		sim.registers[rd] = x[rs1] * x[rs2] // lower 32 bits. same for signed and unsigned
+	case "mulh":
 		rd, rs1, rs2 = decodeR(operand)
-		shamt = int(x[rs2] & 0b11111)       // lower 5 bits
-		sim.registers[rd] = x[rs1] << shamt // logical left shift
-	case "slli":
-		rd, rs1, shamt = decodeShift(operand)
-		sim.registers[rd] = x[rs1] << shamt // logical left shift
-	case "srl":
+		sim.registers[rd] = uint32(uint64(int64(int32(x[rs1]))*int64(int32(x[rs2]))) >> 32) // upper 32 bits. signed x signed
+		rdU, rs1U, rs2U = false, false, false
+	case "mulhsu":
 		rd, rs1, rs2 = decodeR(operand)
-		shamt = int(x[rs2] & 0b11111)       // lower 5 bits
-		sim.registers[rd] = x[rs1] >> shamt // logical right shift
-	case "srli":
-		rd, rs1, shamt = decodeShift(operand)
-		sim.registers[rd] = x[rs1] >> shamt // logical right shift
-	case "sra":
+		sim.registers[rd] = uint32(uint64(int64(int32(x[rs1]))*int64(x[rs2])) >> 32) // upper 32 bits. signed x unsigned
+		rdU, rs1U, rs2S = false, false, false
+	case "mulhu":
 		rd, rs1, rs2 = decodeR(operand)
-		shamt = int(x[rs2] & 0b11111)                      // lower 5 bits
-		sim.registers[rd] = uint32(int32(x[rs1]) >> shamt) // arithmetic right shift
-	case "srai":
-		rd, rs1, shamt = decodeShift(operand)
-		sim.registers[rd] = uint32(int32(x[rs1]) >> shamt) // arithmetic right shift
-	case "slt":
+		sim.registers[rd] = uint32((uint64(x[rs1]) * uint64(x[rs2])) >> 32) // upper 32 bits. unsigned x unsigned
+		rdS, rs1S, rs2S = false, false, false
+	case "div":
+		rd, rs1, rs2 = decodeR(operand)
+		switch {
+		case x[rs2] == 0:
+			sim.registers[rd] = math.MaxUint32 // division by zero. all bits set
+		case x[rs1] == 0x80000000 && x[rs2] == math.MaxUint32:
+			sim.registers[rd] = x[rs1] // overflow. -2^31 / -1 = -2^31
+		default:
+			sim.registers[rd] = uint32(int32(x[rs1]) / int32(x[rs2])) // rounding towards zero
+		}
+		rdU, rs1U, rs2U = false, false, false
+	case "divu":
+		rd, rs1, rs2 = decodeR(operand)
+		if x[rs2] == 0 {
+			sim.registers[rd] = math.MaxUint32 // division by zero. all bits set
+		} else {
+			sim.registers[rd] = x[rs1] / x[rs2]
+		}
+		rdS, rs1S, rs2S = false, false, false
+	case "rem":
+		rd, rs1, rs2 = decodeR(operand)
+		switch {
+		case x[rs2] == 0:
+			sim.registers[rd] = x[rs1] // division by zero. dividend
+		case x[rs1] == 0x80000000 && x[rs2] == math.MaxUint32:
+			sim.registers[rd] = 0 // overflow
+		default:
+			sim.registers[rd] = uint32(int32(x[rs1]) % int32(x[rs2])) // sign of the dividend
+		}
+		rdU, rs1U, rs2U = false, false, false
+	case "remu":
+		rd, rs1, rs2 = decodeR(operand)
+		if x[rs2] == 0 {
+			sim.registers[rd] = x[rs1] // division by zero. dividend
+		} else {
+			sim.registers[rd] = x[rs1] % x[rs2]
+		}
+		rdS, rs1S, rs2S = false, false, false
+	case "csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci":
+		var src uint32
+		if strings.HasSuffix(mnemonic, "i") {
+			rd, csr, src = decodeCsrImmediate(operand)
+			csrWrite = mnemonic == "csrrwi" || src != 0
+		} else {
+			rd, csr, rs1 = decodeCsr(operand)
+			src = x[rs1]
+			csrWrite = mnemonic == "csrrw" || rs1 != 0
+		}
+		csrRead = mnemonic[4] != 'w' || rd != 0 // csrrw/csrrwi with x0 shall not read
+		if csr < 0 || (csrWrite && csrReadOnly(csr)) {
+			exception, tval = causeIllegalInstruction, inst.Code // unimplemented or read-only
+			break
+		}
+		old := sim.readCsr(csr)
+		if csrWrite {
+			switch mnemonic[4] {
+			case 'w':
+				sim.writeCsr(csr, src)
+			case 's':
+				sim.writeCsr(csr, old|src) // set bits
+			case 'c':
+				sim.writeCsr(csr, old&^src) // clear bits
+			}
+		}
+		sim.registers[rd] = old
+	case "ecall":
+		if sim.trapHandlerInstalled() {
+			exception = causeEcallM
+			break
+		}
+		rs1, rs2 = a7, a0 // system call number and the first argument
+		rd, addr, readBytes, writeBytes = sim.systemCall()
+	case "ebreak":
+		if sim.trapHandlerInstalled() {
+			exception, tval = causeBreakpoint, sim.pc
+			break
+		}
+		pause = true // return control to the debugger
+	case "fence":
+		// single hart. memory accesses are already in program order
+	case "mret":
+		csr, csrRead = csrMapping["mepc"], true
+		addr = sim.readCsr(csr)
+		target = &addr
+		jump = true
+		mstatus := sim.readCsr(csrMapping["mstatus"])
+		mie := (mstatus & mstatusMPIE) >> 4 // MIE = MPIE
+		sim.writeCsr(csrMapping["mstatus"], (mstatus&^mstatusMIE)|mie|mstatusMPIE)
+	case "": // label only. the end of the program
+	default:
+		exception, tval = causeIllegalInstruction, inst.Code
+	}
+
+	if jump && *target&0b11 != 0 { // IALIGN=32
+		exception, tval = causeMisalignedFetch, *target
+	}
+
+	halt := false
+	if 0 <= exception {
+		sim.registers = x // not retired. no architectural effect
+		rd, readBytes, writeBytes = -1, 0, 0
+		if sim.trapHandlerInstalled() {
+			addr = sim.trap(uint32(exception), tval)
+			target = &addr
+			jump = true
+		} else { // nowhere to go
+			sim.fault = fmt.Sprintf("%s(pc=0x%08x mtval=0x%08x)", exceptionNames[exception], sim.pc, tval)
+			halt = true
+		}
+	}
+
+	if rd == 0 {
+		sim.registers[0] = 0 // restore hardwired value
+	}
+
+	if exception < 0 && (mnemonic == "jal" || mnemonic == "jalr") {
+		sim.trackCall(current, rd, rs1, *target)
+	}
+
+	switch {
+	case halt:
+	case jump:
+		sim.pc = *target
+	default:
+		sim.pc += 4
+	}
+
+	sim.cycle++ // single-cycle
+	if exception < 0 {
+		sim.instret++
+	}
+
+	effect := &Effect{
+		Current:  current,
+		Ref:      sim.instructionIndex(target),
+		Jump:     jump,
+		Rd:       rd,
+		Rs1:      rs1,
+		Rs2:      rs2,
+		RdS:      rdS,
+		RdU:      rdU,
+		Rs1S:     rs1S,
+		Rs1U:     rs1U,
+		Rs2S:     rs2S,
+		Rs2U:     rs2U,
+		MemRead:  addresses(addr, readBytes),
+		MemWrite: addresses(addr, writeBytes),
+		Csr:      csr,
+		CsrRead:  csrRead,
+		CsrWrite: csrWrite,
+		Trap:     0 <= exception,
+		Break:    pause,
+	}
+	if sim.undo != nil {
+		sim.pushUndo(x, effect)
+	}
+	return effect
+}
+
+// pushes if ra or t0 is written as the link register, and pops by jalr x0 through them.
+// a return to other than the call sites is a warning
+func (sim *Simulator) trackCall(current, rd, rs1 int, target uint32) {
+	const ra, t0 = 1, 5
+	push := rd == ra || rd == t0
+	pop := rd == 0 && (rs1 == ra || rs1 == t0 && 0 < len(sim.calls) && sim.calls[len(sim.calls)-1].Link == t0) // jr t0 is also a computed jump
+	if !push && !pop {
+		return
+	}
+	if sim.undo != nil {
+		sim.undo.Calls = slices.Clone(sim.calls)
+		if sim.undo.Calls == nil {
+			sim.undo.Calls = []Frame{} // nil is unchanged
+		}
+	}
+	if push {
+		sim.calls = append(sim.calls, Frame{sim.pc, target, sim.registers[2], rd})
+		return
+	}
+
+	for i := len(sim.calls) - 1; 0 <= i; i-- {
+		if sim.calls[i].CallSite+4 == target {
+			sim.calls = sim.calls[:i] // also the frames not returned
+			return
+		}
+	}
+	if 0 < len(sim.calls) {
+		sim.calls = sim.calls[:len(sim.calls)-1]
+	}
+
+	inst := sim.instructions[current]
+	mnemonic := inst.MnemonicRaw
+	if inst.Pseudo != "" {
+		mnemonic = strings.Fields(inst.Pseudo)[0]
+	}
+	fileName, lineNo := sim.source(inst.Line)
+	message := fmt.Sprintf("mismatched return(%s) to 0x%08x not after a call", mnemonic, target)
+	if expansion := sim.expansion(inst.Line); expansion != "" {
+		message += " " + expansion
+	}
+	for _, v := range sim.warnings {
+		if v.FileName == fileName && v.LineNo == lineNo && v.Message == message {
+			return // once
+		}
+	}
+	r := sim.newReporter()
+	logwarn(r, fileName, lineNo, "mismatched-return", spanMnemonic, "%s", message) // the same as the key
+	sim.warnings = append(sim.warnings, r.diagnostics...)
+}
+
+// x is the registers before the instruction
+func (sim *Simulator) pushUndo(x [32]uint32, effect *Effect) {
+	for i, v := range x {
+		if sim.registers[i] != v {
+			sim.undo.Registers = append(sim.undo.Registers, [2]uint32{uint32(i), v})
+		}
+	}
+	sim.undo.Effect = effect
+	sim.history = append(sim.history, sim.undo)
+	if sim.historyDepth < len(sim.history) {
+		sim.history = sim.history[len(sim.history)-sim.historyDepth:] // drops the oldest. reallocated by append
+	}
+	sim.undo = nil
+}
+
+// the last instruction. false if no history. the input already read is not returned
+func (sim *Simulator) stepBack() bool {
+	n := len(sim.history)
+	if n == 0 {
+		return false
+	}
+	u := sim.history[n-1]
+	sim.history = sim.history[:n-1]
+
+	for i := len(u.Memory) - 1; 0 <= i; i-- {
+		addr := u.Memory[i][0]
+		sim.writeMemory(addr, byte(u.Memory[i][1]))
+		if j := sim.listingIndex(addr &^ 0b11); 0 <= j && j < len(sim.program) && sim.readWord(addr&^0b11) == sim.program[j].Code {
+			sim.instructions[j] = sim.program[j] // as loaded. e.g. the pseudo-instruction
+		} else {
+			sim.storeInstruction(addr, 1)
+		}
+	}
+	for _, v := range u.Registers {
+		sim.registers[v[0]] = v[1]
+	}
+	sim.pc, sim.csrs, sim.cycle, sim.instret = u.Pc, u.Csrs, u.Cycle, u.Instret
+	sim.console.Truncate(u.Console)
+	sim.brk, sim.exitCode, sim.fault = u.Brk, u.ExitCode, u.Fault
+	if u.Calls != nil {
+		sim.calls = u.Calls
+	}
+	sim.warnings = sim.warnings[:u.Warnings]
+	return true
+}
+
+// executes from the memory. the label only row at the end has no instruction word
+func (sim *Simulator) fetch(current int) Instruction {
+	if sim.instructions[current].Mnemonic == "" {
+		return Instruction{}
+	}
+	code := sim.readWord(sim.pc)
+	if v, ok := sim.decoded[sim.pc]; ok && v.Code == code {
+		return v
+	}
+	inst := disassemble(code, sim.pc, nil)
+	sim.decoded[sim.pc] = inst
+	return inst
+}
+
+// self-modifying code. keeps the listing in sync with the memory
+func (sim *Simulator) storeInstruction(addr uint32, bytes int) {
+	for _, v := range addresses(addr, bytes) {
+		v &^= 0b11
+		if sim.end == nil || v < sim.entryPoint || *sim.end < v {
+			continue
+		}
+		i := sim.instructionIndex(&v)
+		inst := disassemble(sim.readWord(v), v, addressLabels(sim.labelMapping))
+		inst.Label = sim.instructions[i].Label
+		sim.instructions[i] = inst
+	}
+}
+
+func (sim *Simulator) systemCall() (rd int, addr uint32, readBytes, writeBytes int) {
+	call, ok := sim.environment.Calls[sim.registers[a7]]
+	if !ok {
+		sim.fault = fmt.Sprintf("unknown system call(a7=%d) in %s environment", sim.registers[a7], sim.environment.Name)
+		return -1, 0, 0, 0
+	}
+	return call(sim)
+}
+
+func sysPrintInt(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	fmt.Fprintf(&sim.console, "%d", int32(sim.registers[a0]))
+	return -1, 0, 0, 0
+}
+
+func sysPrintChar(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	sim.console.WriteByte(byte(sim.registers[a0]))
+	return -1, 0, 0, 0
+}
+
+func sysPrintString(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	const maxlen = 4096 // avoid unlimited. not terminated
+	addr = sim.registers[a0]
+	for readBytes < maxlen {
+		b := sim.readMemory(addr + uint32(readBytes))
+		readBytes++
+		if b == 0 { // null-terminated
+			break
+		}
+		sim.console.WriteByte(b)
+	}
+	return -1, addr, readBytes, 0
+}
+
+func sysReadInt(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	line := sim.readLine()
+	sim.console.WriteString(line + "\n") // echo back
+	i, _ := strconv.ParseInt(strings.TrimSpace(line), 0, 32)
+	sim.registers[a0] = uint32(int32(i))
+	return a0, 0, 0, 0
+}
+
+func sysSbrk(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	increment := sim.registers[a0]
+	sim.registers[a0] = sim.brk // previous program break
+	sim.brk += increment
+	return a0, 0, 0, 0
+}
+
+func sysExit0(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	code := int32(0)
+	sim.exitCode = &code
+	return -1, 0, 0, 0
+}
+
+func sysExit(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	code := int32(sim.registers[a0])
+	sim.exitCode = &code
+	return -1, 0, 0, 0
+}
+
+func sysRead(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	fd, count := sim.registers[a0], sim.registers[a2]
+	addr = sim.registers[a1]
+	if fd != 0 { // stdin only
+		sim.registers[a0] = -ebadf & math.MaxUint32
+		return a0, 0, 0, 0
+	}
+	buf := make([]byte, min(count, 4096)) // avoid unlimited
+	n := 0
+	if sim.stdin != nil && 0 < len(buf) {
+		n, _ = sim.stdin.Read(buf)
+	}
+	for i, b := range buf[:n] {
+		sim.writeMemory(addr+uint32(i), b)
+	}
+	sim.console.Write(buf[:n]) // echo back
+	sim.registers[a0] = uint32(n)
+	return a0, addr, 0, n
+}
+
+func sysWrite(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	fd, count := sim.registers[a0], sim.registers[a2]
+	addr = sim.registers[a1]
+	if fd != 1 && fd != 2 { // stdout and stderr
+		sim.registers[a0] = -ebadf & math.MaxUint32
+		return a0, 0, 0, 0
+	}
+	readBytes = int(min(count, 4096)) // avoid unlimited
+	for i := range uint32(readBytes) {
+		sim.console.WriteByte(sim.readMemory(addr + i))
+	}
+	sim.registers[a0] = uint32(readBytes)
+	return a0, addr, readBytes, 0
+}
+
+func sysBrk(sim *Simulator) (rd int, addr uint32, readBytes, writeBytes int) {
+	if heapBase <= sim.registers[a0] {
+		sim.brk = sim.registers[a0]
+	}
+	sim.registers[a0] = sim.brk // new program break. current one on failure
+	return a0, 0, 0, 0
+}
+
+func (sim *Simulator) readLine() string {
+	if sim.stdin == nil {
+		return "" // EOF
+	}
+	line, _ := sim.stdin.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+func decodeR(operand string) (rd, rs1, rs2 int) {
+	operands := strings.SplitN(operand, ",", 3)
+	rd = registerMapping[operands[0]]
+	rs1 = registerMapping[operands[1]]
+	rs2 = registerMapping[operands[2]]
+	return
+}
+
+func decodeI(operand string) (rd, rs1 int, imm uint32) {
+	operands := strings.SplitN(operand, ",", 3)
+	rd = registerMapping[operands[0]]
+	rs1 = registerMapping[operands[1]]
+	imm = parseIimmediate(operands[2])
+	return
+}
+
+func decodeB(operand string, symbols *Symbols) (rs1, rs2 int, addr uint32) {
+	operands := strings.SplitN(operand, ",", 3)
+	rs1 = registerMapping[operands[0]]
+	rs2 = registerMapping[operands[1]]
+	addr = labelAddress(operands[2], symbols)
+	return
+}
+
+// disassembled targets are addresses. numeric local labels (1b, 1f) are resolved for the line of the symbols
+func labelAddress(label string, symbols *Symbols) uint32 {
+	if addr, ok := symbols.lookup(label); ok {
+		return addr
+	}
+	addr, _ := strconv.ParseUint(label, 0, 32)
+	return uint32(addr)
+}
+
+func decodeU(operand string) (rd int, imm uint32) {
+	operands := strings.SplitN(operand, ",", 2)
+	rd = registerMapping[operands[0]]
+	imm = parseUimmediate(operands[1])
+	return
+}
+
+func decodeJ(operand string, symbols *Symbols) (rd int, addr uint32) {
+	operands := strings.SplitN(operand, ",", 2)
+	if len(operands) == 1 {
+		operands = []string{ra, operands[0]}
+	} else if operands[0] == "" {
+		operands = []string{ra, operands[1]}
+	}
+	rd = registerMapping[operands[0]]
+	addr = labelAddress(operands[1], symbols)
+	return
+}
+
+func decodeJalr(operand string) (rd, rs1 int, offset uint32) {
+	if !strings.Contains(operand, ",") {
+		operand = ra + "," + operand
+	} else if operand[0] == ',' {
+		operand = ra + operand
+	}
+	return decodeOffset(operand)
+}
+
+func decodeCsr(operand string) (rd, csr, rs1 int) {
+	operands := strings.SplitN(operand, ",", 3)
+	rd = registerMapping[operands[0]]
+	csr, _ = csrIndex(operands[1])
+	rs1 = registerMapping[operands[2]]
+	return
+}
+
+func decodeCsrImmediate(operand string) (rd, csr int, uimm uint32) {
+	operands := strings.SplitN(operand, ",", 3)
+	rd = registerMapping[operands[0]]
+	csr, _ = csrIndex(operands[1])
+	uimm = uint32(parseShamt(operands[2])) // zero-extended 5 bits
+	return
+}
+
+func decodeShift(operand string) (rd, rs1, shamt int) {
+	operands := strings.SplitN(operand, ",", 3)
+	rd = registerMapping[operands[0]]
+	rs1 = registerMapping[operands[1]]
+	shamt = parseShamt(operands[2])
+	return
+}
+
+func decodeOffset(operand string) (rdrs2, rs1 int, offset uint32) {
+	operands := strings.SplitN(operand, ",", 2)
+	rdrs2 = registerMapping[operands[0]]
+	b := strings.LastIndex(operands[1], "(")
+	e := strings.LastIndex(operands[1], ")")
+	if operands[1][0] == '(' {
+		offset = 0
+	} else {
+		offset = parseIimmediate(operands[1][:b])
+	}
+	rs1 = registerMapping[operands[1][b+1:e]]
+	return
+}
+
+// symbols are resolved on load
+func parseIimmediate(s string) uint32 {
+	i, _ := evaluate(s, nil)
+	return uint32(int32(i << 52 >> 52)) // sign extended
+}
+
+func parseUimmediate(s string) uint32 {
+	i, _ := evaluate(s, nil)
+	return uint32(i) & 0xfffff
+}
+
+func parseShamt(s string) int {
+	i, _ := evaluate(s, nil)
+	return int(i) & 0x1f // lower 5 bits
+}
+
+func csrIndex(s string) (int, bool) {
+	if i, ok := csrMapping[s]; ok {
+		return i, true
+	}
+	number, err := strconv.ParseUint(s, 0, 12)
+	if err != nil {
+		return -1, false
+	}
+	i := slices.Index(csrNumbers[:], uint32(number))
+	return i, 0 <= i
+}
+
+func csrReadOnly(i int) bool {
+	return csrNumbers[i]>>10 == 0b11 // csr[11:10]
+}
+
+const (
+	mstatusMIE  = 1 << 3
+	mstatusMPIE = 1 << 7
+	mstatusMPP  = 0b11 << 11
+
+	misaValue = 1<<30 | 1<<('M'-'A') | 1<<('I'-'A') // MXL=1(32 bits) and extensions
+)
+
+// exception codes. mcause
+const (
+	causeMisalignedFetch    = 0
+	causeIllegalInstruction = 2
+	causeBreakpoint         = 3
+	causeEcallM             = 11 // Environment call from M-mode
+)
+
+var exceptionNames = map[int]string{
+	causeMisalignedFetch:    "instruction address misaligned",
+	causeIllegalInstruction: "illegal instruction",
+	causeBreakpoint:         "breakpoint",
+	causeEcallM:             "environment call from M-mode",
+}
+
+// otherwise the host handles ECALL and EBREAK, and exceptions halt the program
+func (sim *Simulator) trapHandlerInstalled() bool {
+	return sim.csrs[csrMapping["mtvec"]] != 0
+}
+
+// machine mode only. returns the trap vector
+func (sim *Simulator) trap(cause, tval uint32) uint32 {
+	sim.csrs[csrMapping["mepc"]] = sim.pc
+	sim.csrs[csrMapping["mcause"]] = cause
+	sim.csrs[csrMapping["mtval"]] = tval
+
+	mstatus := sim.csrs[csrMapping["mstatus"]]
+	mpie := (mstatus & mstatusMIE) << 4 // MPIE = MIE
+	sim.csrs[csrMapping["mstatus"]] = (mstatus &^ (mstatusMIE | mstatusMPIE)) | mpie | mstatusMPP
+
+	mtvec := sim.csrs[csrMapping["mtvec"]]
+	base := mtvec &^ 0b11
+	if mtvec&0b11 == 1 && cause&(1<<31) != 0 { // Vectored. asynchronous interrupts only
+		base += 4 * (cause &^ (1 << 31))
+	}
+	return base
+}
+
+func (sim *Simulator) resetCsr() {
+	for i := range sim.csrs {
+		sim.csrs[i] = 0
+	}
+	sim.csrs[csrMapping["mstatus"]] = mstatusMPP // machine mode only
+	sim.cycle = 0
+	sim.instret = 0
+}
+
+func (sim *Simulator) readCsr(i int) uint32 {
+	switch csrNames[i] {
+	case "misa":
+		return misaValue
+	case "cycle", "time": // simulated time. one tick per cycle
+		return uint32(sim.cycle)
+	case "instret":
+		return uint32(sim.instret)
+	case "cycleh", "timeh":
+		return uint32(sim.cycle >> 32)
+	case "instreth":
+		return uint32(sim.instret >> 32)
+	}
+	return sim.csrs[i]
+}
+
+// WARL. writes are masked to legal values
+func (sim *Simulator) writeCsr(i int, v uint32) {
+	switch csrNames[i] {
+	case "mstatus":
+		v = v&(mstatusMIE|mstatusMPIE) | mstatusMPP
+	case "misa", "mip", "mhartid": // no writable bits
+		return
+	case "mie":
+		v &= 0x888 // MEIE, MTIE and MSIE
+	case "mtvec":
+		v &^= 0b10 // MODE 0:Direct 1:Vectored
+	case "mepc":
+		v &^= 0b11 // IALIGN=32
+	}
+	if csrReadOnly(i) {
+		return
+	}
+	sim.csrs[i] = v
+}
+
+// validated and normalized. returns an empty format if not encodable
+func encode(inst Instruction, pc uint32, symbols *Symbols) (code uint32, format string) {
+	e, ok := encodings[inst.Mnemonic]
+	if !ok {
+		return 0, ""
+	}
+	operand := inst.Operand
+
+	var rd, rs1, rs2 int
+	var imm uint32
+	switch e.Format {
+	case "R":
 		rd, rs1, rs2 = decodeR(operand)
-		if int32(x[rs1]) < int32(x[rs2]) {
-			sim.registers[rd] = 1
+	case "I":
+		switch inst.Mnemonic {
+		case "slli", "srli", "srai":
+			var shamt int
+			rd, rs1, shamt = decodeShift(operand)
+			imm = e.Funct7<<5 | uint32(shamt)
+		case "lb", "lh", "lw", "lbu", "lhu":
+			rd, rs1, imm = decodeOffset(operand)
+		case "jalr":
+			rd, rs1, imm = decodeJalr(operand)
+		case "fence":
+			imm = encodeFence(operand)
+		case "ecall":
+			imm = 0
+		case "ebreak":
+			imm = 1
+		case "mret":
+			imm = 0b0011000_00010
+		case "csrrw", "csrrs", "csrrc":
+			var csr int
+			rd, csr, rs1 = decodeCsr(operand)
+			imm = csrNumber(operand, csr)
+		case "csrrwi", "csrrsi", "csrrci":
+			var csr int
+			var uimm uint32
+			rd, csr, uimm = decodeCsrImmediate(operand)
+			rs1 = int(uimm) // rs1 field holds uimm
+			imm = csrNumber(operand, csr)
+		default:
+			rd, rs1, imm = decodeI(operand)
+		}
+		code = (imm&0xfff)<<20 | uint32(rs1)<<15 | e.Funct3<<12 | uint32(rd)<<7 | e.Opcode
+		return code, e.Format
+	case "S":
+		rs2, rs1, imm = decodeOffset(operand)
+		code = (imm>>5&0x7f)<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | e.Funct3<<12 | (imm&0x1f)<<7 | e.Opcode
+		return code, e.Format
+	case "B":
+		var addr uint32
+		rs1, rs2, addr = decodeB(operand, symbols)
+		offset := addr - pc
+		if int32(offset) < -4096 || 4094 < int32(offset) {
+			return 0, "" // the conditional branch range is plus-minus 4 KiB
+		}
+		code = (offset>>12&1)<<31 | (offset>>5&0x3f)<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | e.Funct3<<12 | (offset>>1&0xf)<<8 | (offset>>11&1)<<7 | e.Opcode
+		return code, e.Format
+	case "U":
+		rd, imm = decodeU(operand)
+		code = imm<<12 | uint32(rd)<<7 | e.Opcode
+		return code, e.Format
+	case "J":
+		var addr uint32
+		rd, addr = decodeJ(operand, symbols)
+		offset := addr - pc
+		if int32(offset) < -(1<<20) || (1<<20)-2 < int32(offset) {
+			return 0, "" // jumps can target a plus-minus 1 MiB range
+		}
+		code = (offset>>20&1)<<31 | (offset>>1&0x3ff)<<21 | (offset>>11&1)<<20 | (offset>>12&0xff)<<12 | uint32(rd)<<7 | e.Opcode
+		return code, e.Format
+	}
+	code = e.Funct7<<25 | uint32(rs2)<<20 | uint32(rs1)<<15 | e.Funct3<<12 | uint32(rd)<<7 | e.Opcode
+	return code, e.Format
+}
+
+func encodeFence(operand string) uint32 {
+	if operand == "" {
+		return 0b1111_1111 // fm=0 pred=iorw succ=iorw
+	}
+	operands := strings.SplitN(operand, ",", 2)
+	bits := func(set string) (b uint32) {
+		for i, c := range "iorw" {
+			if strings.ContainsRune(strings.ToLower(set), c) {
+				b |= 1 << (3 - i)
+			}
+		}
+		return
+	}
+	return bits(operands[0])<<4 | bits(operands[1])
+}
+
+// the csr operand may be an unimplemented number
+func csrNumber(operand string, csr int) uint32 {
+	if 0 <= csr {
+		return csrNumbers[csr]
+	}
+	number, _ := strconv.ParseUint(strings.SplitN(operand, ",", 3)[1], 0, 12)
+	return uint32(number)
+}
+
+// major opcodes
+const (
+	opLoad    = 0b0000011
+	opMiscMem = 0b0001111
+	opImm     = 0b0010011
+	opAuipc   = 0b0010111
+	opStore   = 0b0100011
+	opReg     = 0b0110011
+	opLui     = 0b0110111
+	opBranch  = 0b1100011
+	opJalr    = 0b1100111
+	opJal     = 0b1101111
+	opSystem  = 0b1110011
+)
+
+func decodingKey(opcode, funct3, funct7 uint32) uint32 {
+	switch opcode {
+	case opLui, opAuipc, opJal: // no funct3
+		return opcode
+	case opReg:
+		return opcode | funct3<<7 | funct7<<10
+	case opImm:
+		if funct3 == 0b001 || funct3 == 0b101 { // shifts. funct7 is imm[11:5]
+			return opcode | funct3<<7 | funct7<<10
+		}
+	}
+	return opcode | funct3<<7
+}
+
+// normalized like the source. an undecodable word is shown as .word
+func disassemble(code, pc uint32, labels map[uint32]string) Instruction {
+	inst := Instruction{MnemonicRaw: ".word", Mnemonic: ".word", Operand: fmt.Sprintf("0x%08x", code), Code: code}
+
+	opcode, funct3, funct7 := code&0x7f, code>>12&0b111, code>>25
+	rd, rs1, rs2 := code>>7&0x1f, code>>15&0x1f, code>>20&0x1f
+	imm := int32(code) >> 20 // I-type. sign-extended
+
+	mnemonic, ok := decodings[decodingKey(opcode, funct3, funct7)]
+	if opcode == opSystem && funct3 == 0 {
+		switch code {
+		case 0x00000073:
+			mnemonic, ok = "ecall", true
+		case 0x00100073:
+			mnemonic, ok = "ebreak", true
+		case 0x30200073:
+			mnemonic, ok = "mret", true
+		}
+	}
+	if !ok {
+		return inst
+	}
+
+	target := func(offset int32) string {
+		addr := pc + uint32(offset)
+		if label, ok := labels[addr]; ok {
+			return label
+		}
+		return fmt.Sprintf("0x%08x", addr)
+	}
+	csr := func(number uint32) string {
+		if i := slices.Index(csrNumbers[:], number); 0 <= i {
+			return csrNames[i]
+		}
+		return fmt.Sprintf("0x%03x", number)
+	}
+	fence := func(set uint32) string {
+		s := ""
+		for i, c := range "iorw" {
+			if set&(1<<(3-i)) != 0 {
+				s += string(c)
+			}
+		}
+		return s
+	}
+
+	var operand string
+	e := encodings[mnemonic]
+	switch e.Format {
+	case "R":
+		operand = fmt.Sprintf("x%d,x%d,x%d", rd, rs1, rs2)
+	case "I":
+		switch mnemonic {
+		case "slli", "srli", "srai":
+			operand = fmt.Sprintf("x%d,x%d,%d", rd, rs1, rs2) // shamt
+		case "lb", "lh", "lw", "lbu", "lhu", "jalr":
+			operand = fmt.Sprintf("x%d,%d(x%d)", rd, imm, rs1)
+		case "fence":
+			if code>>20&0xff != 0b1111_1111 {
+				operand = fence(code>>24&0xf) + "," + fence(code>>20&0xf)
+			}
+		case "ecall", "ebreak", "mret":
+		case "csrrw", "csrrs", "csrrc":
+			operand = fmt.Sprintf("x%d,%s,x%d", rd, csr(code>>20), rs1)
+		case "csrrwi", "csrrsi", "csrrci":
+			operand = fmt.Sprintf("x%d,%s,%d", rd, csr(code>>20), rs1) // uimm
+		default:
+			operand = fmt.Sprintf("x%d,x%d,%d", rd, rs1, imm)
+		}
+	case "S":
+		offset := int32(funct7<<25|rd<<20) >> 20
+		operand = fmt.Sprintf("x%d,%d(x%d)", rs2, offset, rs1)
+	case "B":
+		operand = fmt.Sprintf("x%d,x%d,%s", rs1, rs2, target(offsetB(code)))
+	case "U":
+		operand = fmt.Sprintf("x%d,0x%x", rd, code>>12)
+	case "J":
+		operand = fmt.Sprintf("x%d,%s", rd, target(offsetJ(code)))
+	}
+
+	inst.MnemonicRaw, inst.Mnemonic, inst.Operand, inst.Format = mnemonic, mnemonic, operand, e.Format
+	return inst
+}
+
+// sign-extended
+func offsetB(code uint32) int32 {
+	return int32((code>>31)<<31|(code>>7&1)<<30|(code>>25&0x3f)<<24|(code>>8&0xf)<<20) >> 19
+}
+
+func offsetJ(code uint32) int32 {
+	return int32((code>>31)<<31|(code>>12&0xff)<<23|(code>>20&1)<<22|(code>>21&0x3ff)<<12) >> 11
+}
+
+// for disassembly. the first in alphabetical order if several
+func addressLabels(labelMapping map[string]uint32) map[uint32]string {
+	labels := map[uint32]string{}
+	for _, k := range slices.Sorted(maps.Keys(labelMapping)) {
+		if _, ok := labels[labelMapping[k]]; !ok {
+			labels[labelMapping[k]] = k
+		}
+	}
+	return labels
+}
+
+// e.g. %hi(symbol) to its function and symbol
+func parseRelocation(s string) (name, symbol string, ok bool) {
+	b := strings.Index(s, "(")
+	if !strings.HasPrefix(s, "%") || b == -1 || !strings.HasSuffix(s, ")") {
+		return "", "", false
+	}
+	return s[1:b], strings.TrimSpace(s[b+1 : len(s)-1]), true
+}
+
+// all in the normalized operand
+func relocations(operand string) [][2]string {
+	r := [][2]string{}
+	for _, v := range splitUnquoted(operand) {
+		if e := strings.Index(v, ")"); e != -1 {
+			v = v[:e+1] // %lo(symbol)(rs1)
+		}
+		if name, symbol, ok := parseRelocation(v); ok {
+			r = append(r, [2]string{name, symbol})
+		}
+	}
+	return r
+}
+
+// relocations and expressions are replaced by the numbers. registers, csrs and fence sets are kept
+// sign-adjusted like GNU as. %hi(x) << 12 + %lo(x) == x
+func resolve(operand string, pc uint32, symbols *Symbols, pcrelHi map[uint32]uint32) string {
+	hi := func(v uint32) string { return fmt.Sprintf("0x%x", ((v+0x800)>>12)&0xfffff) }
+	lo := func(v uint32) string { return strconv.Itoa(int(int32(v<<20) >> 20)) }
+
+	operands := splitUnquoted(operand)
+	for i, v := range operands {
+		rest := ""
+		if b := strings.LastIndex(v, "("); b != -1 && strings.HasSuffix(v, ")") {
+			if _, ok := registerMapping[v[b+1:len(v)-1]]; ok {
+				v, rest = v[:b], v[b:] // offset(rs1)
+			}
+		}
+		if _, ok := registerMapping[v]; ok {
+			continue
+		}
+		if _, ok := csrMapping[v]; ok {
+			continue
+		}
+		name, symbol, ok := parseRelocation(v)
+		if !ok {
+			if x, err := evaluate(v, symbols); err == nil {
+				operands[i] = strconv.FormatInt(x, 10) + rest
+			}
+			continue
+		}
+		target, _ := evaluate(symbol, symbols)
+		addr := uint32(target)
+		switch name {
+		case "hi":
+			v = hi(addr)
+		case "lo":
+			v = lo(addr)
+		case "pcrel_hi":
+			v = hi(addr - pc)
+		case "pcrel_lo": // symbol is the label of the auipc
+			addr, _ = symbols.lookup(symbol)
+			v = lo(pcrelHi[addr] - addr)
+		}
+		operands[i] = v + rest
+	}
+	return strings.Join(operands, ",")
+}
+
+// binary operators from the lowest precedence. C-like
+var operatorPrecedence = [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/"}}
+
+// constant expression of integers, character literals and symbols. e.g. (end - start) / 4
+func evaluate(expr string, symbols *Symbols) (int64, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return 0, err
+	}
+	e := &expression{tokens: tokens, symbols: symbols}
+	v, err := e.binary(0)
+	if err == nil && len(e.tokens) != 0 {
+		err = fmt.Errorf("unexpected(%s)", e.tokens[0])
+	}
+	return v, err
+}
+
+func tokenize(expr string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '<' || c == '>':
+			if i+1 == len(expr) || expr[i+1] != c {
+				return nil, fmt.Errorf("unexpected(%c)", c)
+			}
+			tokens, i = append(tokens, expr[i:i+2]), i+2
+			continue
+		case strings.IndexByte("+-*/&|~()", c) != -1:
+			tokens, i = append(tokens, expr[i:i+1]), i+1
+			continue
+		case c == '\'':
+			e := i + 2
+			if e < len(expr) && expr[i+1] == '\\' {
+				e++
+			}
+			for e < len(expr) && expr[e] != '\'' {
+				e++
+			}
+			if len(expr) <= e {
+				return nil, errors.New("parse failed")
+			}
+			tokens, i = append(tokens, expr[i:e+1]), e+1
+			continue
+		}
+		e := i
+		for e < len(expr) && validateLabelChar(expr[e]) {
+			e++
+		}
+		if e == i {
+			return nil, fmt.Errorf("unexpected(%c)", c)
+		}
+		tokens, i = append(tokens, expr[i:e]), e
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("parse failed")
+	}
+	return tokens, nil
+}
+
+type expression struct {
+	tokens  []string
+	symbols *Symbols
+}
+
+func (e *expression) next() string {
+	if len(e.tokens) == 0 {
+		return ""
+	}
+	token := e.tokens[0]
+	e.tokens = e.tokens[1:]
+	return token
+}
+
+func (e *expression) binary(level int) (int64, error) {
+	if level == len(operatorPrecedence) {
+		return e.unary()
+	}
+	x, err := e.binary(level + 1)
+	for err == nil && len(e.tokens) != 0 && slices.Contains(operatorPrecedence[level], e.tokens[0]) {
+		operator := e.next()
+		var y int64
+		if y, err = e.binary(level + 1); err != nil {
+			break
+		}
+		switch operator {
+		case "|":
+			x |= y
+		case "&":
+			x &= y
+		case "<<":
+			x <<= y & 63
+		case ">>":
+			x >>= y & 63
+		case "+":
+			x += y
+		case "-":
+			x -= y
+		case "*":
+			x *= y
+		case "/":
+			if y == 0 {
+				return 0, errors.New("division by zero")
+			}
+			x /= y
+		}
+	}
+	return x, err
+}
+
+func (e *expression) unary() (int64, error) {
+	token := e.next()
+	switch token {
+	case "-":
+		x, err := e.unary()
+		return -x, err
+	case "+":
+		return e.unary()
+	case "~":
+		x, err := e.unary()
+		return ^x, err
+	case "(":
+		x, err := e.binary(0)
+		if err == nil && e.next() != ")" {
+			err = errors.New("parse failed")
+		}
+		return x, err
+	case "":
+		return 0, errors.New("parse failed")
+	}
+	return e.primary(token)
+}
+
+func (e *expression) primary(token string) (int64, error) {
+	switch {
+	case token[0] == '\'':
+		c, _, tail, err := strconv.UnquoteChar(token[1:len(token)-1], '\'')
+		if err != nil || tail != "" || math.MaxUint8 < c {
+			return 0, fmt.Errorf("invalid character(%s)", token)
+		}
+		return int64(c), nil
+	case '0' <= token[0] && token[0] <= '9':
+		i, err := strconv.ParseInt(token, 0, 64)
+		if err == nil {
+			return i, nil
+		}
+		if v, ok := e.symbols.lookup(token); ok { // numeric local label. e.g. 1b
+			return int64(int32(v)), nil
+		}
+		if isLocalLabel(token[:len(token)-1]+":") && strings.ContainsAny(token[len(token)-1:], "bf") {
+			return 0, fmt.Errorf("undefined symbol(%s)", token)
+		}
+		return 0, fmt.Errorf("invalid number(%s)", token)
+	case validateLabelFirstChar(token[0]):
+		if v, ok := e.symbols.lookup(token); ok {
+			return int64(int32(v)), nil // two's complement. e.g. .equ MASK, -16
+		}
+		return 0, fmt.Errorf("undefined symbol(%s)", token)
+	}
+	return 0, fmt.Errorf("unexpected(%s)", token)
+}
+
+func isDirective(mnemonic string) bool {
+	return strings.HasPrefix(mnemonic, ".")
+}
+
+// .text or .data. read-only data and bss are in the data section
+func sectionOf(directive, operand string) (string, bool) {
+	switch directive {
+	case ".text":
+		return ".text", true
+	case ".data", ".bss", ".rodata":
+		return ".data", true
+	case ".section":
+		name := splitUnquoted(operand)[0]
+		if name == ".text" || strings.HasPrefix(name, ".text.") {
+			return ".text", true
+		}
+		return ".data", true
+	}
+	return "", false
+}
+
+// validated or not. undefined symbols are zero
+func assembleData(directive, operand string, addr uint32, symbols *Symbols) []byte {
+	b := []byte{}
+	switch directive {
+	case ".word", ".half", ".byte":
+		for _, v := range splitUnquoted(operand) {
+			i, _ := evaluate(v, symbols)
+			x := uint32(i)
+			switch directive {
+			case ".word":
+				b = binary.LittleEndian.AppendUint32(b, x)
+			case ".half":
+				b = binary.LittleEndian.AppendUint16(b, uint16(x))
+			case ".byte":
+				b = append(b, byte(x))
+			}
+		}
+	case ".ascii", ".asciz", ".string":
+		for _, v := range splitUnquoted(operand) {
+			str, _ := unquoteString(v)
+			b = append(b, str...)
+			if directive != ".ascii" {
+				b = append(b, 0) // null-terminated
+			}
+		}
+	case ".space", ".zero":
+		n, _ := evaluate(operand, symbols)
+		b = make([]byte, min(max(n, 0), 1<<20-1))
+	case ".align": // power of 2
+		n, _ := evaluate(operand, symbols)
+		b = make([]byte, -addr&(1<<min(max(n, 0), 12)-1))
+	}
+	return b
+}
+
+// the operand determining the size. li, .space, .zero and .align
+func sizeOperand(mnemonic, operand string) string {
+	switch mnemonic {
+	case "li":
+		if _, imm, ok := strings.Cut(operand, ","); ok {
+			return strings.TrimSpace(imm)
+		}
+	case ".space", ".zero", ".align":
+		return strings.TrimSpace(operand)
+	}
+	return ""
+}
+
+// C-like escape sequences. \0 is also accepted
+func unquoteString(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", false
+	}
+	s = s[1 : len(s)-1]
+	b := []byte{}
+	for s != "" {
+		if strings.HasPrefix(s, "\\0") && (len(s) == 2 || s[2] < '0' || '7' < s[2]) {
+			b, s = append(b, 0), s[2:]
+			continue
+		}
+		c, multibyte, tail, err := strconv.UnquoteChar(s, '"')
+		if err != nil {
+			return "", false
+		}
+		if multibyte {
+			b = append(b, string(c)...)
 		} else {
-			sim.registers[rd] = 0
+			b = append(b, byte(c))
+		}
+		s = tail
+	}
+	return string(b), true
+}
+
+// the number of expanded instructions. 1 if not a pseudo-instruction
+func pseudoSize(mnemonic, operand string, symbols *Symbols) int {
+	switch mnemonic {
+	case "la", "call", "tail":
+		return 2
+	case "li":
+		operands := splitUnquoted(operand)
+		if imm, ok := parseLiImmediate(operands[len(operands)-1], symbols); ok {
+			return len(expandLi(operands[0], imm))
+		}
+	}
+	return 1
+}
+
+// validated and normalized. nil if not a pseudo-instruction
+func expandPseudo(mnemonic, operand string, pc uint32, symbols *Symbols) [][2]string {
+	if _, ok := pseudoOperands[mnemonic]; !ok {
+		return nil
+	}
+	a := splitUnquoted(operand)
+
+	// auipc and the following instruction. plus-minus 2 GiB
+	pcrel := func(label string) (hi, lo string) {
+		offset := labelAddress(label, symbols) - pc
+		l := int32(offset<<20) >> 20 // sign-extended lower 12 bits
+		return fmt.Sprintf("0x%x", (offset-uint32(l))>>12), strconv.Itoa(int(l))
+	}
+
+	switch mnemonic {
+	case "nop":
+		return [][2]string{{"addi", "x0,x0,0"}}
+	case "li":
+		imm, _ := parseLiImmediate(a[1], symbols)
+		return expandLi(a[0], imm)
+	case "la":
+		hi, lo := pcrel(a[1])
+		return [][2]string{{"auipc", a[0] + "," + hi}, {"addi", a[0] + "," + a[0] + "," + lo}}
+	case "mv":
+		return [][2]string{{"addi", a[0] + "," + a[1] + ",0"}}
+	case "not":
+		return [][2]string{{"xori", a[0] + "," + a[1] + ",-1"}}
+	case "neg":
+		return [][2]string{{"sub", a[0] + ",x0," + a[1]}}
+	case "seqz":
+		return [][2]string{{"sltiu", a[0] + "," + a[1] + ",1"}}
+	case "snez":
+		return [][2]string{{"sltu", a[0] + ",x0," + a[1]}}
+	case "sltz":
+		return [][2]string{{"slt", a[0] + "," + a[1] + ",x0"}}
+	case "sgtz":
+		return [][2]string{{"slt", a[0] + ",x0," + a[1]}}
+	case "j":
+		return [][2]string{{"jal", "x0," + a[0]}}
+	case "jr":
+		return [][2]string{{"jalr", "x0,0(" + a[0] + ")"}}
+	case "ret":
+		return [][2]string{{"jalr", "x0,0(" + ra + ")"}}
+	case "call":
+		hi, lo := pcrel(a[0])
+		return [][2]string{{"auipc", ra + "," + hi}, {"jalr", ra + "," + lo + "(" + ra + ")"}}
+	case "tail":
+		hi, lo := pcrel(a[0])
+		return [][2]string{{"auipc", "x6," + hi}, {"jalr", "x0," + lo + "(x6)"}}
+	case "beqz":
+		return [][2]string{{"beq", a[0] + ",x0," + a[1]}}
+	case "bnez":
+		return [][2]string{{"bne", a[0] + ",x0," + a[1]}}
+	case "blez":
+		return [][2]string{{"bge", "x0," + a[0] + "," + a[1]}}
+	case "bgez":
+		return [][2]string{{"bge", a[0] + ",x0," + a[1]}}
+	case "bltz":
+		return [][2]string{{"blt", a[0] + ",x0," + a[1]}}
+	case "bgtz":
+		return [][2]string{{"blt", "x0," + a[0] + "," + a[1]}}
+	case "bgt":
+		return [][2]string{{"blt", a[1] + "," + a[0] + "," + a[2]}}
+	case "ble":
+		return [][2]string{{"bge", a[1] + "," + a[0] + "," + a[2]}}
+	case "bgtu":
+		return [][2]string{{"bltu", a[1] + "," + a[0] + "," + a[2]}}
+	case "bleu":
+		return [][2]string{{"bgeu", a[1] + "," + a[0] + "," + a[2]}}
+	}
+	return nil
+}
+
+// lui for the upper 20 bits and addi for the sign-extended lower 12 bits
+func expandLi(rd string, imm uint32) [][2]string {
+	lo := int32(imm<<20) >> 20
+	hi := (imm - uint32(lo)) >> 12
+	switch {
+	case hi == 0:
+		return [][2]string{{"addi", rd + ",x0," + strconv.Itoa(int(lo))}}
+	case lo == 0:
+		return [][2]string{{"lui", rd + "," + fmt.Sprintf("0x%x", hi)}}
+	}
+	return [][2]string{{"lui", rd + "," + fmt.Sprintf("0x%x", hi)}, {"addi", rd + "," + rd + "," + strconv.Itoa(int(lo))}}
+}
+
+// signed or unsigned 32 bits
+func parseLiImmediate(s string, symbols *Symbols) (uint32, bool) {
+	i, err := evaluate(s, symbols)
+	if err != nil || i < math.MinInt32 || math.MaxUint32 < i {
+		return 0, false
+	}
+	return uint32(i), true
+}
+
+func memoryBytes(mnemonic string) int {
+	// single byte addressable
+	switch mnemonic[1] {
+	case 'w': // word(32 bits)
+		return 4 // 4 bytes
+	case 'h': // halfword(16 bits)
+		return 2 // 2 bytes
+	case 'b': // byte(8 bits)
+		return 1 // 1 byte
+	}
+	return 0 // unused. resolved missing return
+}
+
+func addresses(addr uint32, bytes int) []uint32 {
+	if bytes <= 0 {
+		return nil
+	}
+	addrs := []uint32{}
+	for i := range uint32(bytes) {
+		addrs = append(addrs, addr+i)
+	}
+	return addrs
+}
+
+// the final state of a headless run
+type RunResult struct {
+	Status    string       `json:"status"`   // ended, exited, timeout, limit or fault
+	Executed  uint64       `json:"executed"` // the number of instructions
+	Pc        uint32       `json:"pc"`
+	ExitCode  *int32       `json:"exitCode,omitempty"`
+	Fault     string       `json:"fault,omitempty"`
+	Console   string       `json:"console"`
+	Registers [32]uint32   `json:"registers"`
+	Memory    []MemoryDump `json:"memory"` // the rows read or written by the program
+}
+
+type MemoryDump struct {
+	Address uint32 `json:"address"`
+	Bytes   string `json:"bytes"` // 16 bytes in hex
+}
+
+// headless. the exit status is 1 on validation failure, 2 on timeout and 3 on fault
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	jsonOutput := flags.Bool("json", false, "print the result in JSON")
+	timeout, steps := limitFlags(flags)
+	environment := environmentFlag(flags)
+	data := dataFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: run [-json] [-timeout duration] [-steps n] [-syscalls rars|linux] [-data address] filename")
+		return 2
+	}
+
+	sim := NewSimulator(flags.Arg(0), entryPoint, nil, stderr)
+	sim.environment, sim.dataBase = environment, *data
+	sim.stdin = bufio.NewReader(stdin)
+	sim.timeout, sim.maxSteps = *timeout, *steps
+	sim.historyDepth = 0 // no STEP BACK
+	sim.init()
+	if sim.view.Failed {
+		return 1
+	}
+	result := sim.run()
+
+	if *jsonOutput {
+		b, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Fprintf(stdout, "%s\n", b)
+	} else {
+		writeRunResult(stdout, result)
+	}
+	switch result.Status {
+	case "timeout", "limit":
+		return 2
+	case "fault":
+		return 3
+	}
+	return 0
+}
+
+// without the web UI. until the end of the program, a fault or the time limit. ebreak does not stop
+func (sim *Simulator) run() *RunResult {
+	touched := map[uint32]struct{}{} // the base addresses of the rows
+	each := func(effect *Effect) {
+		for _, v := range slices.Concat(effect.MemRead, effect.MemWrite) {
+			touched[v&^0xf] = struct{}{}
 		}
-		rsU = false
-	case "sltu":
-		rd, rs1, rs2 = decodeR(operand)
-		if x[rs1] < x[rs2] {
-			sim.registers[rd] = 1
-		} else {
-			sim.registers[rd] = 0
+	}
+	executed, stop := uint64(0), "break"
+	for stop == "break" { // does not stop by ebreak
+		if sim.maxSteps != 0 && sim.maxSteps <= executed {
+			stop = "limit"
+			break
 		}
-		rsS = false
-	case "slti":
-		rd, rs1, imm = decodeI(operand)
-		if int32(x[rs1]) < int32(imm) {
-			sim.registers[rd] = 1
-		} else {
-			sim.registers[rd] = 0
+		rest := uint64(0) // no limit
+		if sim.maxSteps != 0 {
+			rest = sim.maxSteps - executed
 		}
-		rsU = false
-	case "sltiu":
-		rd, rs1, imm = decodeI(operand)
-		if x[rs1] < imm {
-			sim.registers[rd] = 1
-		} else {
-			sim.registers[rd] = 0
+		var n uint64
+		_, n, stop = sim.runN(rest, nil, each)
+		executed += n
+	}
+
+	result := &RunResult{Status: "ended", Executed: executed, Pc: sim.pc, ExitCode: sim.exitCode, Fault: sim.fault, Console: sim.console.String(), Registers: sim.registers}
+	switch {
+	case sim.fault != "":
+		result.Status = "fault"
+	case sim.exitCode != nil:
+		result.Status = "exited"
+	case stop == "timeout" || stop == "limit":
+		result.Status = stop
+	}
+	for _, base := range slices.Sorted(maps.Keys(touched)) {
+		row := make([]byte, 16)
+		for i := range row {
+			row[i] = sim.readMemory(base + uint32(i))
 		}
-		rsS = false
-	case "lui":
-		rd, imm = decodeU(operand)
-		sim.registers[rd] = imm << 12 // filling in the lowest 12 bits with zeros
-	case "auipc":
-		rd, imm = decodeU(operand)
-		offset = imm << 12 // filling in the lowest 12 bits with zeros
-		sim.registers[rd] = sim.pc + offset
-	case "lb":
-		rd, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		sim.registers[rd] = uint32(int8(sim.readMemory(addr))) // sign extends
-		readBytes, rdU = memoryBytes(mnemonic), false
-	case "lbu":
-		rd, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		sim.registers[rd] = uint32(sim.readMemory(addr)) // zero extends
-		readBytes, rdS = memoryBytes(mnemonic), false
-	case "lh":
-		rd, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1)}
-		sim.registers[rd] = uint32(int16(uint16(m[0]) | (uint16(m[1]) << 8))) // sign extends. little-endian
-		readBytes, rdU = memoryBytes(mnemonic), false
-	case "lhu":
-		rd, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1)}
-		sim.registers[rd] = uint32(m[0]) | (uint32(m[1]) << 8) // zero extends. little-endian
-		readBytes, rdS = memoryBytes(mnemonic), false
-	case "lw":
-		rd, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		m := [...]byte{sim.readMemory(addr), sim.readMemory(addr + 1), sim.readMemory(addr + 2), sim.readMemory(addr + 3)}
-		sim.registers[rd] = uint32(m[0]) | (uint32(m[1]) << 8) | (uint32(m[2]) << 16) | (uint32(m[3]) << 24) // little-endian
-		readBytes = memoryBytes(mnemonic)
-	case "sb", "sh", "sw":
-		rs2, rs1, offset = decodeOffset(operand)
-		addr = x[rs1] + offset
-		writeBytes = memoryBytes(mnemonic)
-		val := x[rs2]
-		for i := range uint32(writeBytes) {
-			sim.writeMemory(addr+i, byte(val>>(i*8))) // little-endian
+		result.Memory = append(result.Memory, MemoryDump{base, fmt.Sprintf("% x", row)})
+	}
+	return result
+}
+
+// -timeout and -steps. the defaults are timeoutSec and maxSteps
+func limitFlags(flags *flag.FlagSet) (*time.Duration, *uint64) {
+	timeout := flags.Duration("timeout", timeoutSec*time.Second, "force suspend. zero for no timeout")
+	steps := flags.Uint64("steps", maxSteps, "the maximum number of instructions. zero for no limit")
+	return timeout, steps
+}
+
+// -syscalls. the default is systemCalls
+func environmentFlag(flags *flag.FlagSet) *Environment {
+	environment := *environments[systemCalls] // a copy updated by Parse
+	flags.Func("syscalls", "ECALL environment. rars or linux (default "+systemCalls+")", func(s string) error {
+		if environments[s] == nil {
+			return fmt.Errorf("unknown environment(%s)", s)
 		}
-	case "jal":
-		rd, addr = decodeJ(operand, sim.labelMapping)
-		sim.registers[rd] = sim.pc + 4
-		target = &addr
-		jump = true
-	case "jalr":
-		rd, rs1, offset = decodeJalr(operand)
-		sim.registers[rd] = sim.pc + 4
-		addr = x[rs1] + offset
-		target = &addr
-		jump = true
-	case "beq":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = x[rs1] == x[rs2]
-	case "bne":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = x[rs1] != x[rs2]
-	case "blt":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = int32(x[rs1]) < int32(x[rs2])
-		rsU = false
-	case "bltu":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = x[rs1] < x[rs2]
-		rsS = false
-	case "bge":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = int32(x[rs1]) >= int32(x[rs2])
-		rsU = false
-	case "bgeu":
-		rs1, rs2, addr = decodeB(operand, sim.labelMapping)
-		target = &addr
-		jump = x[rs1] >= x[rs2]
-		rsS = false
+		environment = *environments[s]
+		return nil
+	})
+	return &environment
+}
+
+// -data. the default is dataBase
+func dataFlag(flags *flag.FlagSet) *uint32 {
+	data := uint32(dataBase)
+	flags.Func("data", fmt.Sprintf("the first address of the .data section (default 0x%x)", dataBase), func(s string) error {
+		v, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return err
+		}
+		if v&3 != 0 {
+			return fmt.Errorf("not aligned on a four byte boundary(%s)", s)
+		}
+		data = uint32(v)
+		return nil
+	})
+	return &data
+}
+
+func writeRunResult(w io.Writer, result *RunResult) {
+	status := result.Status
+	if result.ExitCode != nil {
+		status += fmt.Sprintf("(%d)", *result.ExitCode)
+	}
+	if result.Fault != "" {
+		status += " " + result.Fault
+	}
+	fmt.Fprintf(w, "status: %s\nexecuted: %d\npc: 0x%08x\n", status, result.Executed, result.Pc)
+	if result.Console != "" {
+		fmt.Fprintf(w, "console:\n%s\n", strings.TrimSuffix(result.Console, "\n"))
+	}
+	fmt.Fprintln(w, "registers:")
+	for i, v := range result.Registers {
+		fmt.Fprintf(w, "%-4s %-5s 0x%08x %d\n", fmt.Sprintf("x%d", i), abiNames[i], v, int32(v))
 	}
+	fmt.Fprintln(w, "memory:")
+	for _, v := range result.Memory {
+		fmt.Fprintf(w, "0x%08x %s\n", v.Address, v.Bytes)
+	}
+}
 
-	if rd == 0 {
-		sim.registers[0] = 0 // restore hardwired value
+// gofmt-like. rewritten in place unless -l or -d. the exit status is 1 if -l or -d finds differences
+func fmtCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	list := flags.Bool("l", false, "list files whose formatting differs")
+	diff := flags.Bool("d", false, "display diffs instead of rewriting files")
+	registers := flags.String("regs", "", "register naming. abi or x. unchanged if empty")
+	mnemonicCase := flags.String("case", "lower", "mnemonic case. lower or upper")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*registers != "" && *registers != "abi" && *registers != "x") || (*mnemonicCase != "lower" && *mnemonicCase != "upper") {
+		fmt.Fprintln(stderr, "invalid flag(-regs abi|x -case lower|upper)")
+		return 2
 	}
 
-	if jump {
-		sim.pc = *target
-	} else {
-		sim.pc += 4
+	status := 0
+	for _, fileName := range flags.Args() {
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 2
+			continue
+		}
+		formatted := formatSource(string(b), *registers, *mnemonicCase)
+		if formatted == string(b) {
+			continue
+		}
+		if *list {
+			fmt.Fprintln(stdout, fileName)
+		}
+		if *diff {
+			fmt.Fprint(stdout, unifiedDiff(fileName, string(b), formatted))
+		}
+		if *list || *diff {
+			status = max(status, 1)
+			continue
+		}
+		if err := os.WriteFile(fileName, []byte(formatted), 0o644); err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 2
+		}
 	}
+	return status
+}
 
-	return &Effect{
-		Current:  current,
-		Ref:      sim.instructionIndex(target),
-		Jump:     jump,
-		Rd:       rd,
-		Rs1:      rs1,
-		Rs2:      rs2,
-		RdS:      rdS,
-		RdU:      rdU,
-		RsS:      rsS,
-		RsU:      rsU,
-		MemRead:  addresses(addr, readBytes),
-		MemWrite: addresses(addr, writeBytes),
+// labels, mnemonics, operands and trailing comments are aligned in columns. directives and comments are kept
+func formatSource(src, registers, mnemonicCase string) string {
+	type line struct {
+		label, mnemonic, operand, comment string
+		indented, directive               bool
+	}
+
+	lines := []line{}
+	indent, width := 4, 8 // of the mnemonic and the operand columns
+	for _, v := range strings.Split(strings.TrimSuffix(strings.ReplaceAll(src, "\r\n", "\n"), "\n"), "\n") {
+		fields := splitLine(v)
+		l := line{label: fields[0], mnemonic: fields[1], operand: fields[2], indented: strings.TrimLeft(v, " \t") != v}
+		trimed := strings.TrimSpace(v)
+		if c := indexUnquoted(trimed, "#;"); c != -1 {
+			l.comment = strings.TrimSpace(trimed[c:])
+		}
+		l.directive = isDirective(l.mnemonic)
+		if !l.directive && l.mnemonic != "" {
+			if mnemonicCase == "upper" {
+				l.mnemonic = strings.ToUpper(l.mnemonic)
+			} else {
+				l.mnemonic = strings.ToLower(l.mnemonic)
+			}
+			l.operand = formatOperands(l.operand, registers)
+		}
+		if l.label != "" && l.mnemonic != "" {
+			indent = max(indent, (len(l.label)+1+3)/4*4)
+		}
+		width = max(width, len(l.mnemonic)+1)
+		lines = append(lines, l)
+	}
+
+	codes := make([]string, len(lines))
+	column := 32 // of the trailing comments
+	for i, v := range lines {
+		switch {
+		case v.mnemonic == "" && v.label == "":
+			if v.indented && v.comment != "" {
+				codes[i] = strings.Repeat(" ", indent)
+			}
+			continue
+		case v.mnemonic == "":
+			codes[i] = v.label
+		case v.directive && !v.indented && v.label == "": // e.g. .text
+			codes[i] = strings.TrimSpace(v.mnemonic + " " + v.operand)
+		default:
+			codes[i] = fmt.Sprintf("%-*s%-*s%s", indent, v.label, width, v.mnemonic, v.operand)
+		}
+		codes[i] = strings.TrimRight(codes[i], " ")
+		if v.comment != "" {
+			column = max(column, (len(codes[i])+1+3)/4*4)
+		}
+	}
+
+	var b strings.Builder
+	for i, v := range lines {
+		switch {
+		case v.comment == "":
+			b.WriteString(codes[i])
+		case v.mnemonic == "" && v.label == "": // the whole line
+			b.WriteString(codes[i] + v.comment)
+		default:
+			b.WriteString(fmt.Sprintf("%-*s%s", column, codes[i], v.comment))
+		}
+		b.WriteString("\n")
 	}
+	return b.String()
 }
 
-func decodeR(operand string) (rd, rs1, rs2 int) {
-	operands := strings.SplitN(operand, ",", 3)
-	rd = registerMapping[operands[0]]
-	rs1 = registerMapping[operands[1]]
-	rs2 = registerMapping[operands[2]]
-	return
+// separated by ", ". registers are renamed by names: abi, x or empty to keep
+func formatOperands(operand, registers string) string {
+	if operand == "" {
+		return ""
+	}
+	operands := splitUnquoted(operand)
+	for i, v := range operands {
+		if registers == "" {
+			continue
+		}
+		renamed := ""
+		last := 0
+		for _, span := range identifiers(v) {
+			n, ok := registerMapping[v[span[0]:span[1]]]
+			if !ok {
+				continue
+			}
+			name := abiNames[n]
+			if registers == "x" {
+				name = fmt.Sprintf("x%d", n)
+			}
+			renamed += v[last:span[0]] + name
+			last = span[1]
+		}
+		operands[i] = renamed + v[last:]
+	}
+	return strings.Join(operands, ", ")
 }
 
-func decodeI(operand string) (rd, rs1 int, imm uint32) {
-	operands := strings.SplitN(operand, ",", 3)
-	rd = registerMapping[operands[0]]
-	rs1 = registerMapping[operands[1]]
-	imm = parseIimmediate(operands[2])
-	return
+// the spans of the symbols and the registers. not in literals, and not after % or \. e.g. %hi and \param
+func identifiers(operand string) [][2]int {
+	spans := [][2]int{}
+	for j := 0; j < len(operand); j++ {
+		c := operand[j]
+		if c == '"' || c == '\'' { // skip the literal
+			for j++; j < len(operand) && operand[j] != c; j++ {
+				if operand[j] == '\\' {
+					j++
+				}
+			}
+			continue
+		}
+		if !validateLabelFirstChar(c) || (0 < j && (validateLabelChar(operand[j-1]) || operand[j-1] == '%' || operand[j-1] == '\\')) {
+			continue
+		}
+		k := j + 1
+		for k < len(operand) && validateLabelChar(operand[k]) {
+			k++
+		}
+		spans = append(spans, [2]int{j, k})
+		j = k - 1
+	}
+	return spans
 }
 
-func decodeB(operand string, labelMapping map[string]uint32) (rs1, rs2 int, addr uint32) {
-	operands := strings.SplitN(operand, ",", 3)
-	rs1 = registerMapping[operands[0]]
-	rs2 = registerMapping[operands[1]]
-	label := operands[2]
-	addr = labelMapping[label]
-	return
+// line-based. three lines of context
+func unifiedDiff(fileName, a, b string) string {
+	x, y := strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")
+	if x[len(x)-1] == "" {
+		x = x[:len(x)-1]
+	}
+	if y[len(y)-1] == "" {
+		y = y[:len(y)-1]
+	}
+
+	// the longest common subsequence from the ends
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; 0 <= i; i-- {
+		for j := len(y) - 1; 0 <= j; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	edits := []string{} // prefixed by ' ', '-' or '+'
+	for i, j := 0, 0; i < len(x) || j < len(y); {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, " "+x[i])
+			i, j = i+1, j+1
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, "-"+x[i])
+			i++
+		default:
+			edits = append(edits, "+"+y[j])
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fileName, fileName)
+	for start := 0; start < len(edits); {
+		if edits[start][0] == ' ' {
+			start++
+			continue
+		}
+		// the hunk until the unchanged lines more than twice the context
+		end, unchanged := start, 0
+		for i := start; i < len(edits) && unchanged <= context*2; i++ {
+			if edits[i][0] == ' ' {
+				unchanged++
+			} else {
+				end, unchanged = i+1, 0
+			}
+		}
+		from, to := max(0, start-context), min(len(edits), end+context)
+		oldStart, newStart := 0, 0
+		for _, v := range edits[:from] {
+			if v[0] != '+' {
+				oldStart++
+			}
+			if v[0] != '-' {
+				newStart++
+			}
+		}
+		oldLen, newLen := 0, 0
+		for _, v := range edits[from:to] {
+			if v[0] != '+' {
+				oldLen++
+			}
+			if v[0] != '-' {
+				newLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart+1, oldLen, newStart+1, newLen)
+		for _, v := range edits[from:to] {
+			out.WriteString(v)
+			if !strings.HasSuffix(v, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// Language Server Protocol over stdio. full text synchronization
+type LanguageServer struct {
+	r         *bufio.Reader
+	w         io.Writer
+	documents map[string]string   // the text being edited by the file path
+	published map[string][]string // the uris with diagnostics by the document
+}
+
+// a label or a constant in the document. zero-based
+type Occurrence struct {
+	Name       string
+	Line       int
+	Start, End int
+	Definition bool
+}
+
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+type TextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"` // references only
+}
+
+// JSON-RPC error codes
+const (
+	parseError     = -32700
+	invalidParams  = -32602
+	methodNotFound = -32601
+)
+
+func NewLanguageServer(r io.Reader, w io.Writer) *LanguageServer {
+	return &LanguageServer{
+		r:         bufio.NewReader(r),
+		w:         w,
+		documents: map[string]string{},
+		published: map[string][]string{},
+	}
+}
+
+// until exit or EOF
+func (ls *LanguageServer) serve() error {
+	for {
+		body, err := ls.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			ls.respond(json.RawMessage("null"), nil, &ResponseError{parseError, err.Error()})
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, err := ls.handle(msg.Method, msg.Params)
+		if msg.ID != nil { // otherwise notification
+			ls.respond(msg.ID, result, err)
+		}
+	}
+}
+
+func (ls *LanguageServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := ls.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("no Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(ls.r, body)
+	return body, err
 }
 
-func decodeU(operand string) (rd int, imm uint32) {
-	operands := strings.SplitN(operand, ",", 2)
-	rd = registerMapping[operands[0]]
-	imm = parseUimmediate(operands[1])
-	return
+func (ls *LanguageServer) write(msg any) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	fmt.Fprintf(ls.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
 }
 
-func decodeJ(operand string, labelMapping map[string]uint32) (rd int, addr uint32) {
-	operands := strings.SplitN(operand, ",", 2)
-	if len(operands) == 1 {
-		operands = []string{ra, operands[0]}
-	} else if operands[0] == "" {
-		operands = []string{ra, operands[1]}
+func (ls *LanguageServer) respond(id json.RawMessage, result any, err error) {
+	msg := map[string]any{"jsonrpc": "2.0", "id": id}
+	if e, ok := err.(*ResponseError); ok {
+		msg["error"] = e
+	} else if err != nil {
+		msg["error"] = &ResponseError{invalidParams, err.Error()}
+	} else {
+		msg["result"] = result
 	}
-	rd = registerMapping[operands[0]]
-	label := operands[1]
-	addr = labelMapping[label]
-	return
+	ls.write(msg)
 }
 
-func decodeJalr(operand string) (rd, rs1 int, offset uint32) {
-	if !strings.Contains(operand, ",") {
-		operand = ra + "," + operand
-	} else if operand[0] == ',' {
-		operand = ra + operand
+func (ls *LanguageServer) notify(method string, params any) {
+	ls.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (ls *LanguageServer) handle(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   1, // full
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]any{},
+			},
+			"serverInfo": map[string]string{"name": "rvsim"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration", "textDocument/didSave":
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		fileName := uriPath(p.TextDocument.URI)
+		switch {
+		case method == "textDocument/didOpen":
+			ls.documents[fileName] = p.TextDocument.Text
+		case method == "textDocument/didClose":
+			delete(ls.documents, fileName)
+			ls.publish(p.TextDocument.URI, nil)
+			return nil, nil
+		case len(p.ContentChanges) != 0:
+			ls.documents[fileName] = p.ContentChanges[len(p.ContentChanges)-1].Text
+		}
+		ls.publish(p.TextDocument.URI, ls.diagnose(fileName))
+		return nil, nil
+	case "textDocument/definition", "textDocument/references":
+		var p TextDocumentPosition
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		occurrences := findOccurrences(ls.documents[uriPath(p.TextDocument.URI)])
+		name := ""
+		for _, v := range occurrences {
+			if v.Line == p.Position.Line && v.Start <= p.Position.Character && p.Position.Character <= v.End {
+				name = v.Name
+			}
+		}
+		locations := []Location{}
+		for _, v := range occurrences {
+			if v.Name != name || name == "" {
+				continue
+			}
+			if method == "textDocument/definition" && !v.Definition {
+				continue
+			}
+			if method == "textDocument/references" && v.Definition && !p.Context.IncludeDeclaration {
+				continue
+			}
+			locations = append(locations, Location{p.TextDocument.URI, Range{Position{v.Line, v.Start}, Position{v.Line, v.End}}})
+		}
+		return locations, nil
+	case "textDocument/hover":
+		var p TextDocumentPosition
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		lines := strings.Split(ls.documents[uriPath(p.TextDocument.URI)], "\n")
+		if len(lines) <= p.Position.Line {
+			return nil, nil
+		}
+		start, end := mnemonicSpan(lines[p.Position.Line])
+		if p.Position.Character < start || end < p.Position.Character {
+			return nil, nil
+		}
+		help, ok := instructionHelp[strings.ToLower(lines[p.Position.Line][start:end])]
+		if !ok {
+			return nil, nil
+		}
+		value := fmt.Sprintf("**%s**\n\n`%s`", help[0], help[1])
+		if help[2] != "" {
+			value += "\n\n" + help[2]
+		}
+		return map[string]any{
+			"contents": map[string]string{"kind": "markdown", "value": value},
+			"range":    Range{Position{p.Position.Line, start}, Position{p.Position.Line, end}},
+		}, nil
+	case "textDocument/completion":
+		var p TextDocumentPosition
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		lines := strings.Split(ls.documents[uriPath(p.TextDocument.URI)], "\n")
+		line := ""
+		if p.Position.Line < len(lines) {
+			line = lines[p.Position.Line][:min(p.Position.Character, len(lines[p.Position.Line]))]
+		}
+		const keyword, variable = 14, 6 // CompletionItemKind
+		items := []map[string]any{}
+		if _, end := mnemonicSpan(line); end == 0 || end == len(line) { // the mnemonic being typed
+			for _, v := range slices.Sorted(maps.Keys(instructionHelp)) {
+				items = append(items, map[string]any{"label": v, "kind": keyword, "detail": instructionHelp[v][0]})
+			}
+			return items, nil
+		}
+		for _, v := range slices.Sorted(maps.Keys(registerMapping)) {
+			items = append(items, map[string]any{"label": v, "kind": variable, "detail": fmt.Sprintf("x%d", registerMapping[v])})
+		}
+		return items, nil
 	}
-	return decodeOffset(operand)
+	if strings.HasPrefix(method, "$/") {
+		return nil, nil
+	}
+	return nil, &ResponseError{methodNotFound, fmt.Sprintf("method not found(%s)", method)}
 }
 
-func decodeShift(operand string) (rd, rs1, shamt int) {
-	operands := strings.SplitN(operand, ",", 3)
-	rd = registerMapping[operands[0]]
-	rs1 = registerMapping[operands[1]]
-	shamt = parseShamt(operands[2])
-	return
+// the same checks as RELOAD. the documents being edited take precedence over the files
+func (ls *LanguageServer) diagnose(fileName string) Diagnostics {
+	sim := NewSimulator(fileName, entryPoint, nil, nil)
+	sim.overlay = ls.documents
+	sim.init()
+	return sim.diagnostics
 }
 
-func decodeOffset(operand string) (rdrs2, rs1 int, offset uint32) {
-	operands := strings.SplitN(operand, ",", 2)
-	rdrs2 = registerMapping[operands[0]]
-	b := strings.Index(operands[1], "(")
-	e := strings.Index(operands[1], ")")
-	if operands[1][0] == '(' {
-		offset = 0
-	} else {
-		offset = parseIimmediate(operands[1][:b])
+// grouped by the file. the included files also
+func (ls *LanguageServer) publish(uri string, diagnostics Diagnostics) {
+	grouped := map[string][]map[string]any{uri: {}}
+	for _, v := range diagnostics {
+		fileUri := pathURI(v.FileName)
+		if uriPath(uri) == v.FileName {
+			fileUri = uri // as given by the client
+		}
+		line := max(0, v.LineNo-1)
+		start, end := v.Column-1, v.EndColumn-1
+		if v.Column == 0 { // the whole line
+			start, end = 0, len(ls.line(v.FileName, v.LineNo))
+		}
+		severity := 1
+		if v.Severity == SeverityWarning {
+			severity = 2
+		}
+		grouped[fileUri] = append(grouped[fileUri], map[string]any{
+			"range":    Range{Position{line, start}, Position{line, end}},
+			"severity": severity,
+			"code":     v.Code,
+			"source":   "rvsim",
+			"message":  v.Message,
+		})
+	}
+	for _, v := range ls.published[uri] { // cleared
+		if _, ok := grouped[v]; !ok {
+			grouped[v] = []map[string]any{}
+		}
+	}
+	ls.published[uri] = slices.Collect(maps.Keys(grouped))
+	for _, v := range slices.Sorted(maps.Keys(grouped)) {
+		ls.notify("textDocument/publishDiagnostics", map[string]any{"uri": v, "diagnostics": grouped[v]})
 	}
-	rs1 = registerMapping[operands[1][b+1:e]]
-	return
 }
 
-func parseIimmediate(s string) uint32 {
-	i, _ := strconv.ParseInt(s, 0, 12)
-	return uint32(int32(i)) // sign extended
+// one-based
+func (ls *LanguageServer) line(fileName string, lineNo int) string {
+	text, ok := ls.documents[fileName]
+	if !ok {
+		b, _ := os.ReadFile(fileName)
+		text = string(b)
+	}
+	lines := strings.Split(text, "\n")
+	if lineNo < 1 || len(lines) < lineNo {
+		return ""
+	}
+	return strings.TrimSuffix(lines[lineNo-1], "\r")
 }
 
-func parseUimmediate(s string) uint32 {
-	i, _ := strconv.ParseUint(s, 0, 20)
-	return uint32(i)
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.Clean(filepath.FromSlash(u.Path))
 }
 
-func parseShamt(s string) int {
-	i, _ := strconv.ParseUint(s, 0, 5)
-	return int(i) // lower 5 bits
+func pathURI(fileName string) string {
+	if abs, err := filepath.Abs(fileName); err == nil {
+		fileName = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(fileName)}).String()
 }
 
-func memoryBytes(mnemonic string) int {
-	// single byte addressable
-	switch mnemonic[1] {
-	case 'w': // word(32 bits)
-		return 4 // 4 bytes
-	case 'h': // halfword(16 bits)
-		return 2 // 2 bytes
-	case 'b': // byte(8 bits)
-		return 1 // 1 byte
+// zero-based. end is exclusive, and zero if no mnemonic
+func mnemonicSpan(line string) (start, end int) {
+	fields := splitLine(line)
+	if fields[1] == "" {
+		return 0, 0
 	}
-	return 0 // unused. resolved missing return
+	offset := 0
+	if fields[0] != "" {
+		offset = strings.Index(line, fields[0]) + len(fields[0])
+	}
+	start = offset + strings.Index(line[offset:], fields[1])
+	return start, start + len(fields[1])
 }
 
-func addresses(addr uint32, bytes int) []uint32 {
-	if bytes <= 0 {
-		return nil
+// labels and constants defined in the document, and their references in the operands. numeric local labels are not
+func findOccurrences(text string) []Occurrence {
+	occurrences := []Occurrence{}
+	for i, line := range strings.Split(text, "\n") {
+		fields := splitLine(line)
+		if fields[0] != "" && !isLocalLabel(fields[0]) {
+			start := strings.Index(line, fields[0])
+			occurrences = append(occurrences, Occurrence{strings.TrimSuffix(fields[0], ":"), i, start, start + len(fields[0]) - 1, true})
+		}
+		if fields[2] == "" {
+			continue
+		}
+		_, end := mnemonicSpan(line)
+		offset := end + strings.Index(line[end:], fields[2])
+		directive := normalizeMnemonic(fields[1])
+		for _, span := range identifiers(fields[2]) {
+			name := fields[2][span[0]:span[1]]
+			if _, ok := registerMapping[name]; !ok {
+				definition := span[0] == 0 && (directive == ".equ" || directive == ".set")
+				occurrences = append(occurrences, Occurrence{name, i, offset + span[0], offset + span[1], definition})
+			}
+		}
 	}
-	addrs := []uint32{}
-	for i := range uint32(bytes) {
-		addrs = append(addrs, addr+i)
+
+	defined := map[string]bool{}
+	for _, v := range occurrences {
+		defined[v.Name] = defined[v.Name] || v.Definition
 	}
-	return addrs
+	return slices.DeleteFunc(occurrences, func(v Occurrence) bool { return !defined[v.Name] })
 }
 
 const simulatorHTML = `
@@ -1504,17 +5762,29 @@ td {
 <table cellspacing=0 style='float:left;border-left:2px solid;border-right:2px solid'>
 <thead>
 <tr>{{range .InstructionWidth}}<th style='color:transparent;font-weight:bold'>{{.}}</th>{{end}}</tr>
-<tr><th style='color:black'>Address</th><th style='color:black'>Label</th><th colspan=2 style='color:black'>Instruction</th></tr>
-<tr><td colspam=4>&nbsp;</td></tr>
+<tr><th style='color:black'>Address</th><th style='color:black'>Code</th><th style='color:black'>Label</th><th colspan=2 style='color:black'>Instruction</th><th style='color:black'>Pseudo</th></tr>
+<tr><td colspam=5>&nbsp;</td></tr>
 </thead>
 <tbody>
 {{- range .Codes}}
 <tr>
+{{- if not .Address}}
+<th></th>
+{{- else if eq .Address $.Breakpoint}}
+<th style='text-align:center;background-color:#ff8080'><button form=breakpoints name=break value='{{slice .Address 2}}' title='hit{{if .Condition}} if {{.Condition}}{{end}}. click to clear' style='all:unset;cursor:pointer;color:{{or .RefColor "inherit"}}'>{{.Address}}</button>&nbsp;<button form=breakpoints name=to value='{{slice .Address 2}}' title='run to here'{{if $.Disabled.Run}} disabled{{end}} style='all:unset;cursor:pointer'>&#x25B8;</button></th>
+{{- else if .Breakpoint}}
+<th style='text-align:center;background-color:#ffd0d0'><button form=breakpoints name=break value='{{slice .Address 2}}' title='{{if .Condition}}if {{.Condition}}. {{end}}click to clear' style='all:unset;cursor:pointer;color:{{or .RefColor "inherit"}}'>{{.Address}}</button>&nbsp;<button form=breakpoints name=to value='{{slice .Address 2}}' title='run to here'{{if $.Disabled.Run}} disabled{{end}} style='all:unset;cursor:pointer'>&#x25B8;</button></th>
+{{- else}}
+<th style='text-align:center'><button form=breakpoints name=break value='{{slice .Address 2}}' title='click to set a breakpoint' style='all:unset;cursor:pointer;color:{{or .RefColor "inherit"}}'>{{.Address}}</button>&nbsp;<button form=breakpoints name=to value='{{slice .Address 2}}' title='run to here'{{if $.Disabled.Run}} disabled{{end}} style='all:unset;cursor:pointer'>&#x25B8;</button></th>
+{{- end}}
+{{- if .CodeColor}}
+<td style='text-align:center;color:{{.CodeColor}}' title='{{.Fields}}'>{{.Code}}</td>
+{{- else}}
+<td style='text-align:center' title='{{.Fields}}'>{{.Code}}</td>
+{{- end}}
 {{- if .RefColor}}
-<th style='text-align:center;color:{{.RefColor}}'>{{.Address}}</th>
 <td style='color:{{.RefColor}}'>{{.Label}}</td>
 {{- else}}
-<th style='text-align:center'>{{.Address}}</th>
 <td>{{.Label}}</td>
 {{- end}}
 {{- if .Current}}
@@ -1524,10 +5794,11 @@ td {
 <td style='color:#003262;'>{{.Mnemonic}}</td>
 <td style='color:#003262;'>{{.Operand}}</td>
 {{- end}}
+<td style='color:gray'>{{.Pseudo}}</td>
 </tr>
 {{- end}}
 </tbody>
-<tfooter><tr><td colspam=4>&nbsp;</td></tr></tfooter>
+<tfooter><tr><td colspam=5>&nbsp;</td></tr></tfooter>
 </table>
 <table cellspacing=0 style='float:left;border-right:2px solid'>
 <thead>
@@ -1568,6 +5839,31 @@ td {
 </tbody>
 <tfooter><tr><td colspam=8>&nbsp;</td></tr></tfooter>
 </table>
+<table cellspacing=0 style='float:left;border-right:2px solid'>
+<thead>
+<tr>{{range .CsrWidth}}<th style='color:transparent;font-weight:bold'>{{.}}</th>{{end}}</tr>
+<tr><th colspan=2 style='color:black'>CSR</th><th style='color:black'>Hex</th></tr>
+<tr><td colspam=3>&nbsp;</td></tr>
+</thead>
+<tbody>
+{{- range .Csrs}}
+{{- if .Even}}
+<tr>
+{{- else}}
+<tr style='background-color:whitesmoke'>
+{{- end}}
+<th style='color:#011e41;text-align:left'>{{.Name}}</th>
+<th>{{.Number}}</th>
+{{- if .Color}}
+<td style='text-align:center;font-weight:bold;color:{{.Color}}'>{{.Hex}}</td>
+{{- else}}
+<td style='text-align:center'>{{.Hex}}</td>
+{{- end}}
+</tr>
+{{- end}}
+</tbody>
+<tfooter><tr><td colspam=3>&nbsp;</td></tr></tfooter>
+</table>
 <table cellspacing=0 style='border-right:2px solid'>
 <thead>
 <tr>{{range .MemoryWidth}}<th style='color:transparent;font-weight:normal'>{{.}}</th>{{end}}</tr>
@@ -1591,18 +5887,473 @@ td {
 <tfooter><tr><td colspam=17>&nbsp;</td></tr></tfooter>
 </table>
 <br>
+<form method=POST id=breakpoints></form>
 <form method=POST>
 <input type=submit name='button' value='RUN'{{if .Disabled.Run}} disabled {{end}}>&nbsp;
 <input type=submit name='button' value='STEP'{{if .Disabled.Step}} disabled {{end}}{{if .Step}} autofocus {{end}}>&nbsp;
+<input type=submit name='button' value='STEP10'{{if .Disabled.Step}} disabled {{end}}>&nbsp;
+<input type=submit name='button' value='STEP100'{{if .Disabled.Step}} disabled {{end}}>&nbsp;
+<input type=submit name='button' value='STEP OVER'{{if .Disabled.Step}} disabled {{end}}>&nbsp;
+<input type=submit name='button' value='STEP OUT'{{if .Disabled.Step}} disabled {{end}}>&nbsp;
+<input type=submit name='button' value='STEP BACK'{{if not .Undoable}} disabled {{end}}>&nbsp;
+<input type=submit name='button' value='REVERSE RUN'{{if not .Undoable}} disabled {{end}}>&nbsp;
 <input type=submit name='button' value='STOP'{{if .Disabled.Stop}} disabled {{end}}>&nbsp;
 <input type=submit name='button' value='RELOAD'{{if .Disabled.Reload}} disabled {{end}}>
 </form>
+<form method=POST style='margin-top:0.5em'>
+breakpoint <input name=at size=12 placeholder='address or label' required> if <input name=if size=28 placeholder='a0 == 0 &amp;&amp; t1 &gt; 5'>&nbsp;
+<input type=submit value='SET'>
+</form>
+<form method=POST style='margin-top:0.5em'>
+watchpoint <input name=watch size=20 placeholder='a0 or mem[0x0..0x4]' required> on <select name=on><option value=rw>read/write</option><option value=w>write</option><option value=r>read</option></select>&nbsp;
+<input type=submit value='ADD'>
+</form>
+<form method=POST style='margin-top:0.5em'>
+steps <input name=steps size=10 value='{{.MaxSteps}}' required> timeout <input name=timeout size=6 value='{{.TimeLimit}}' required>&nbsp;
+<input type=submit value='SET'>
+</form>
+{{- range $i, $v := .Watchpoints}}
+<form method=POST style='margin:0'>{{$v}}&nbsp;<button name=unwatch value='{{$i}}'>DELETE</button></form>
+{{- end}}
+{{- if .InputError}}
+<p style='color:red'>{{.InputError}}</p>
+{{- end}}
 {{- if .Failed}}
-<p style='color:red'>failed. for more information, stderr</p>
+<p style='color:red'>failed. for more information, diagnostics or stderr</p>
+{{- end}}
+{{- range .Diagnostics}}
+<pre style='margin:0 0 1em 0;color:{{.Color}}'>{{.Position}}: {{.Severity}}: {{.Message}} [{{.Code}}]
+{{- if .Text}}
+    {{.Text}}
+    {{.Marker}}
+{{- end}}</pre>
 {{- end}}
 {{- if .Timeout}}
-<p style='color:red'>timeout. if continue, RUN again</p>
+<p style='color:red'>timeout after {{.Executed}} instructions. if continue, RUN again</p>
+{{- else if .Limit}}
+<p style='color:red'>instruction limit. {{.Executed}} instructions executed. if continue, RUN again</p>
+{{- else if .Executed}}
+<p style='color:blue'>{{.Executed}} instructions executed</p>
+{{- end}}
+{{- if .Trap}}
+<p style='color:blue'>trap. {{.Trap}}</p>
+{{- end}}
+{{- if .Break}}
+<p style='color:blue'>ebreak. if continue, RUN or STEP</p>
+{{- end}}
+{{- if .Breakpoint}}
+<p style='color:blue'>breakpoint({{.Breakpoint}}). if continue, RUN or STEP</p>
+{{- end}}
+{{- if .Watch}}
+<p style='color:blue'>{{.Watch}}. if continue, RUN or STEP</p>
+{{- end}}
+{{- if .Exited}}
+<p style='color:blue'>exit({{.ExitCode}})</p>
+{{- end}}
+{{- if .Fault}}
+<p style='color:red'>{{.Fault}}</p>
+{{- end}}
+<table cellspacing=0 style='border-left:2px solid;border-right:2px solid'>
+<thead><tr><th style='color:black;text-align:left'>Console</th></tr></thead>
+<tbody><tr><td><pre style='margin:0;min-width:60em;min-height:4em'>{{.Console}}</pre></td></tr></tbody>
+</table>
+{{- if .Backtrace}}
+<br>
+<table cellspacing=0 style='border-left:2px solid;border-right:2px solid'>
+<thead>
+<tr><th colspan=5 style='color:black;text-align:left'>Backtrace</th></tr>
+<tr><th style='color:black'>#</th><th style='color:black'>Function</th><th style='color:black'>Call site</th><th style='color:black'>Caller</th><th style='color:black'>sp at entry</th></tr>
+</thead>
+<tbody>
+{{- range .Backtrace}}
+<tr><td>#{{.Depth}}</td><td>{{.Function}}</td><td>{{.CallSite}}</td><td>{{.Caller}}</td><td>{{.Sp}}</td></tr>
+{{- end}}
+</tbody>
+</table>
 {{- end}}
 </body>
 </html>
 `
+
+// a comment in the source. e.g. # expect: a0 == 42
+type Expectation struct {
+	FileName  string
+	LineNo    int
+	Condition string
+}
+
+// a result of an expectation
+type TestCase struct {
+	Expectation
+	Passed  bool
+	Message string // why failed
+}
+
+// runs each file and checks the expectations. the exit status is 1 if any fails
+func testCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "tap", "output format. tap or junit")
+	timeout, steps := limitFlags(flags)
+	environment := environmentFlag(flags)
+	data := dataFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "tap" && *format != "junit") {
+		fmt.Fprintln(stderr, "usage: test [-format tap|junit] [-timeout duration] [-steps n] [-syscalls rars|linux] [-data address] filename ...")
+		return 2
+	}
+
+	suites := [][]TestCase{}
+	for _, fileName := range flags.Args() {
+		sim := NewSimulator(fileName, entryPoint, nil, stderr)
+		sim.environment, sim.dataBase = environment, *data
+		sim.stdin = bufio.NewReader(stdin)
+		sim.timeout, sim.maxSteps = *timeout, *steps
+		sim.historyDepth = 0 // no STEP BACK
+		suites = append(suites, testFile(sim))
+	}
+	if *format == "junit" {
+		writeJUnit(stdout, flags.Args(), suites)
+	} else {
+		writeTAP(stdout, suites)
+	}
+	for _, v := range slices.Concat(suites...) {
+		if !v.Passed {
+			return 1
+		}
+	}
+	return 0
+}
+
+// failed all if the program does not run to the end
+func testFile(sim *Simulator) []TestCase {
+	expectations, err := readExpectations(sim.fileName)
+	if err != nil {
+		return []TestCase{{Expectation{FileName: sim.fileName}, false, err.Error()}}
+	}
+
+	sim.init()
+	failure := ""
+	if sim.view.Failed {
+		failure = "invalid program"
+	} else if result := sim.run(); result.Status == "timeout" || result.Status == "limit" {
+		failure = fmt.Sprintf("%s after %d instructions", result.Status, result.Executed)
+	} else if result.Status == "fault" {
+		failure = result.Status + " " + result.Fault
+	}
+
+	cases := []TestCase{}
+	for _, v := range expectations {
+		c := TestCase{Expectation: v, Message: failure}
+		if failure == "" {
+			passed, detail, err := sim.condition(v.Condition)
+			c.Passed = passed && err == nil
+			if err != nil {
+				c.Message = err.Error()
+			} else if !passed {
+				c.Message = "got " + detail
+			}
+		}
+		cases = append(cases, c)
+	}
+	if failure != "" && len(cases) == 0 {
+		cases = append(cases, TestCase{Expectation{FileName: sim.fileName}, false, failure})
+	}
+	return cases
+}
+
+// in the file. not in the included files
+func readExpectations(fileName string) ([]Expectation, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	expectations := []Expectation{}
+	for i, line := range strings.Split(string(b), "\n") {
+		c := indexUnquoted(line, "#;")
+		if c == -1 {
+			continue
+		}
+		if condition, ok := strings.CutPrefix(strings.TrimSpace(line[c+1:]), "expect:"); ok {
+			expectations = append(expectations, Expectation{fileName, i + 1, strings.TrimSpace(condition)})
+		}
+	}
+	return expectations, nil
+}
+
+func writeTAP(w io.Writer, suites [][]TestCase) {
+	cases := slices.Concat(suites...)
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(cases))
+	for i, v := range cases {
+		result := "ok"
+		if !v.Passed {
+			result = "not ok"
+		}
+		fmt.Fprintf(w, "%s %d - %s:%d %s\n", result, i+1, v.FileName, v.LineNo, v.Condition)
+		if !v.Passed {
+			fmt.Fprintf(w, "  ---\n  message: %s\n  ...\n", strconv.Quote(v.Message))
+		}
+	}
+}
+
+func writeJUnit(w io.Writer, fileNames []string, suites [][]TestCase) {
+	type failure struct {
+		Message string `xml:"message,attr"`
+	}
+	type testcase struct {
+		Name      string   `xml:"name,attr"`
+		Classname string   `xml:"classname,attr"`
+		Failure   *failure `xml:"failure,omitempty"`
+	}
+	type testsuite struct {
+		Name      string     `xml:"name,attr"`
+		Tests     int        `xml:"tests,attr"`
+		Failures  int        `xml:"failures,attr"`
+		Testcases []testcase `xml:"testcase"`
+	}
+	type testsuites struct {
+		XMLName xml.Name    `xml:"testsuites"`
+		Suites  []testsuite `xml:"testsuite"`
+	}
+
+	root := testsuites{}
+	for i, cases := range suites {
+		suite := testsuite{Name: fileNames[i], Tests: len(cases), Testcases: []testcase{}}
+		for _, v := range cases {
+			c := testcase{Name: fmt.Sprintf("%d: %s", v.LineNo, v.Condition), Classname: fileNames[i]}
+			if !v.Passed {
+				c.Failure = &failure{v.Message}
+				suite.Failures++
+			}
+			suite.Testcases = append(suite.Testcases, c)
+		}
+		root.Suites = append(root.Suites, suite)
+	}
+	b, _ := xml.MarshalIndent(root, "", "  ")
+	fmt.Fprintf(w, "%s%s\n", xml.Header, b)
+}
+
+// comparisons joined by && and ||. the detail is the actual values of the first failed comparison
+func (sim *Simulator) condition(expr string) (bool, string, error) {
+	detail := ""
+	for _, or := range splitOperator(expr, "||") {
+		passed := true
+		for _, and := range splitOperator(or, "&&") {
+			ok, d, err := sim.compare(and)
+			if err != nil {
+				return false, "", err
+			}
+			if !ok {
+				passed = false
+				if detail == "" {
+					detail = d
+				}
+				break
+			}
+		}
+		if passed {
+			return true, "", nil
+		}
+	}
+	return false, detail, nil
+}
+
+// ==, !=, <, <=, > or >=. signed 32 bit integers, or bytes by == and !=
+func (sim *Simulator) compare(expr string) (bool, string, error) {
+	i, op := comparisonOperator(expr)
+	if i == -1 {
+		return false, "", fmt.Errorf("invalid condition(%s) comparison operator not found", expr)
+	}
+	left, right := strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+len(op):])
+	a, aBytes, err := sim.conditionValue(left)
+	if err != nil {
+		return false, "", err
+	}
+	b, bBytes, err := sim.conditionValue(right)
+	if err != nil {
+		return false, "", err
+	}
+
+	details := []string{}
+	if d := describeValue(left, a, aBytes); d != "" {
+		details = append(details, d)
+	}
+	if d := describeValue(right, b, bBytes); d != "" {
+		details = append(details, d)
+	}
+	detail := strings.Join(details, ", ")
+
+	if aBytes != nil && bBytes != nil {
+		switch op {
+		case "==":
+			return bytes.Equal(aBytes, bBytes), detail, nil
+		case "!=":
+			return !bytes.Equal(aBytes, bBytes), detail, nil
+		}
+		return false, "", fmt.Errorf("invalid condition(%s) bytes by == or !=", expr)
+	}
+	for _, v := range []*[]byte{&aBytes, &bBytes} { // little-endian
+		if *v == nil {
+			continue
+		}
+		if 4 < len(*v) {
+			return false, "", fmt.Errorf("invalid condition(%s) more than 4 bytes as an integer", expr)
+		}
+		n := int64(int32(binary.LittleEndian.Uint32(append(slices.Clone(*v), 0, 0, 0, 0))))
+		if v == &aBytes {
+			a = n
+		} else {
+			b = n
+		}
+	}
+	a, b = int64(int32(a)), int64(int32(b)) // e.g. 0xffffffff == -1
+	switch op {
+	case "==":
+		return a == b, detail, nil
+	case "!=":
+		return a != b, detail, nil
+	case "<":
+		return a < b, detail, nil
+	case "<=":
+		return a <= b, detail, nil
+	case ">":
+		return a > b, detail, nil
+	}
+	return a >= b, detail, nil
+}
+
+var errNotExited = errors.New("invalid condition(exitcode) not exited")
+
+// registers, pc, exitcode, console, mem[a..b] (b is exclusive), mem[a], strings and constant expressions of the labels
+func (sim *Simulator) conditionValue(s string) (int64, []byte, error) {
+	if n, ok := registerMapping[s]; ok {
+		return int64(sim.registers[n]), nil, nil
+	}
+	switch s {
+	case "pc":
+		return int64(sim.pc), nil, nil
+	case "exitcode":
+		if sim.exitCode == nil {
+			return 0, nil, errNotExited
+		}
+		return int64(*sim.exitCode), nil, nil
+	case "console":
+		return 0, []byte(sim.console.String()), nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		unquoted, ok := unquoteString(s)
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid string(%s)", s)
+		}
+		return 0, []byte(unquoted), nil
+	}
+	if start, size, ok, err := sim.memoryRange(s); err != nil {
+		return 0, nil, err
+	} else if ok {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = sim.readMemory(start + uint32(i))
+		}
+		return 0, b, nil
+	}
+	n, err := evaluate(s, sim.symbols())
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid value(%s) %v", s, err)
+	}
+	return n, nil, nil
+}
+
+// empty for literals
+func describeValue(s string, n int64, b []byte) string {
+	if _, err := evaluate(s, nil); err == nil || strings.HasPrefix(s, `"`) {
+		return ""
+	}
+	if b != nil {
+		return fmt.Sprintf("%s = %s", s, strconv.Quote(string(b)))
+	}
+	return fmt.Sprintf("%s = %d (0x%08x)", s, int32(n), uint32(n))
+}
+
+// mem[a..b] (b is exclusive) or mem[a]. false if not
+func (sim *Simulator) memoryRange(s string) (start, size uint32, ok bool, err error) {
+	r, ok := strings.CutPrefix(s, "mem[")
+	if !ok || !strings.HasSuffix(r, "]") {
+		return 0, 0, false, nil
+	}
+	from, to, found := strings.Cut(strings.TrimSuffix(r, "]"), "..")
+	first, err := evaluate(from, sim.symbols())
+	if err != nil {
+		return 0, 0, true, fmt.Errorf("invalid address(%s) %v", from, err)
+	}
+	end := first + 1
+	if found {
+		if end, err = evaluate(to, sim.symbols()); err != nil {
+			return 0, 0, true, fmt.Errorf("invalid address(%s) %v", to, err)
+		}
+	}
+	if end <= first || 4096 < end-first {
+		return 0, 0, true, fmt.Errorf("invalid range(%s) 1 to 4096 bytes", s)
+	}
+	return uint32(first), uint32(end - first), true, nil
+}
+
+// the first comparison operator. << and >> are not
+func comparisonOperator(expr string) (int, string) {
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+			continue
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '"' || c == '\'':
+			quote = c
+			continue
+		}
+		two := expr[i:min(i+2, len(expr))]
+		switch {
+		case two == "==" || two == "!=" || two == "<=" || two == ">=":
+			if two[1] == '=' && (two[0] == '<' || two[0] == '>') && 0 < i && expr[i-1] == two[0] {
+				continue // e.g. 1 <<= is not
+			}
+			return i, two
+		case two == "<<" || two == ">>":
+			i++
+		case c == '<' || c == '>':
+			return i, string(c)
+		}
+	}
+	return -1, ""
+}
+
+// not in the quotes
+func splitOperator(s, op string) []string {
+	parts := []string{}
+	var quote byte
+	last := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(s[i:], op):
+			parts = append(parts, s[last:i])
+			last = i + len(op)
+			i += len(op) - 1
+		}
+	}
+	return append(parts, s[last:])
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type StringRecorder struct {
@@ -30,6 +42,15 @@ func newRequest(body string) *http.Request {
 	return httptest.NewRequest("POST", "/", strings.NewReader(body))
 }
 
+// the label is defined at the offset from the instruction. padded with nops
+func linesWithLabel(mnemonic, operand, label string, offset int) [][3]string {
+	lines := [][3]string{{"", mnemonic, operand}}
+	for i := 4; i < offset; i += 4 {
+		lines = append(lines, [...]string{"", "addi", "x0, x0, 0"})
+	}
+	return append(lines, [...]string{label + ":", "", ""})
+}
+
 func TestInstructionRegister(t *testing.T) {
 	handler, sim := newTestSimulatorHandler()
 
@@ -37,6 +58,8 @@ func TestInstructionRegister(t *testing.T) {
 	for i := range x {
 		x[i] = uint32(i*100 + i)
 	}
+	x[26] = 0xffffffff
+	x[27] = 0x80000000
 	x[28] = 3
 	x[29] = 0x0100
 	x[30] = 0xfffffff0
@@ -119,6 +142,29 @@ func TestInstructionRegister(t *testing.T) {
 		{"lw   ", "x7, 0xb0(x29)", 0x8486},
 		{"lw   ", "x7, 0x8000(x29)", 0},
 		{"lw   ", "x7, (x30)", 0},
+		{"mul   ", "x7, x5, x6  ", x[5] * x[6]},
+		{"mul   ", "x7, x30, x31", 0xfffdfff0},
+		{"mulh  ", "x7, x5, x6  ", 0},
+		{"mulh  ", "x7, x30, x31", 0x00000005},
+		{"mulh  ", "x7, x31, x5 ", 0xffffff42},
+		{"mulhsu", "x7, x30, x31", 0xfffffff5},
+		{"mulhsu", "x7, x31, x30", 0xa0002006},
+		{"mulhu ", "x7, x30, x31", 0xa0001ff6},
+		{"div   ", "x7, x6, x5  ", 1},
+		{"div   ", "x7, x31, x30", 0x05fffdff},
+		{"div   ", "x7, x31, x5 ", 0xffcf55bd},
+		{"div   ", "x7, x31, x0 ", 0xffffffff}, // division by zero
+		{"div   ", "x7, x27, x26", 0x80000000}, // overflow
+		{"divu  ", "x7, x31, x5 ", 0x00511bf1},
+		{"divu  ", "x7, x31, x0 ", 0xffffffff}, // division by zero
+		{"divu  ", "x7, x27, x26", 0},
+		{"rem   ", "x7, x6, x5  ", x[6] - x[5]},
+		{"rem   ", "x7, x31, x5 ", 0xfffffe2c},
+		{"rem   ", "x7, x31, x0 ", x[31]}, // division by zero
+		{"rem   ", "x7, x27, x26", 0},     // overflow
+		{"remu  ", "x7, x31, x5 ", 0x198},
+		{"remu  ", "x7, x31, x0 ", x[31]}, // division by zero
+		{"remu  ", "x7, x27, x26", x[27]},
 	}
 
 	for _, v := range cases {
@@ -242,11 +288,10 @@ func TestInstructionJump(t *testing.T) {
 			rd = 1 // x1
 		}
 
-		sim.load([][3]string{[...]string{"", v.mnemonic, v.operand}})
+		sim.load(linesWithLabel(v.mnemonic, v.operand, "l1", 0x80))
 		sim.reset()
 		sim.view.Disabled.Step = false
 		sim.registers = x
-		sim.labelMapping = labelMap
 
 		beforePc := sim.pc
 
@@ -267,68 +312,1465 @@ func TestInstructionJump(t *testing.T) {
 	}
 }
 
-func TestInstructionBranch(t *testing.T) {
-	handler, sim := newTestSimulatorHandler()
+func TestInstructionBranch(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	var x [32]uint32
+	for i := range x {
+		x[i] = uint32(i*100 + i)
+	}
+	x[5] = x[6]
+	x[8] = 0xfffffff8
+	labelMap := map[string]uint32{}
+	labelMap["l1"] = sim.entryPoint + 0x40
+
+	base := sim.entryPoint
+	cases := []struct {
+		mnemonic string
+		operand  string
+		want     uint32
+	}{
+		{"beq ", "x5, x6, l1", labelMap["l1"]},
+		{"beq ", "x5, x7, l1", base + 4},
+		{"bne ", "x5, x6, l1", base + 4},
+		{"bne ", "x5, x7, l1", labelMap["l1"]},
+		{"blt ", "x5, x4, l1", base + 4},
+		{"blt ", "x5, x6, l1", base + 4},
+		{"blt ", "x5, x7, l1", labelMap["l1"]},
+		{"blt ", "x8, x9, l1", labelMap["l1"]},
+		{"bltu", "x5, x4, l1", base + 4},
+		{"bltu", "x5, x6, l1", base + 4},
+		{"bltu", "x5, x7, l1", labelMap["l1"]},
+		{"bltu", "x8, x9, l1", base + 4},
+		{"bge ", "x5, x4, l1", labelMap["l1"]},
+		{"bge ", "x5, x6, l1", labelMap["l1"]},
+		{"bge ", "x5, x7, l1", base + 4},
+		{"bge ", "x8, x9, l1", base + 4},
+		{"bgeu", "x5, x4, l1", labelMap["l1"]},
+		{"bgeu", "x5, x6, l1", labelMap["l1"]},
+		{"bgeu", "x5, x7, l1", base + 4},
+		{"bgeu", "x8, x9, l1", labelMap["l1"]},
+	}
+
+	for _, v := range cases {
+		mnemonic := strings.TrimSpace(v.mnemonic)
+
+		sim.load(linesWithLabel(mnemonic, v.operand, "l1", 0x40))
+		sim.reset()
+		sim.view.Disabled.Step = false
+		sim.registers = x
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("button=STEP"))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s Code = %d", mnemonic, v.operand, w.Code)
+		}
+		if sim.pc != v.want {
+			t.Errorf("%s %s pc = %x, want %x", mnemonic, v.operand, sim.pc, v.want)
+		}
+		if sim.registers != x {
+			t.Errorf("%s %s registers = %x, want %x", mnemonic, v.operand, sim.registers, x)
+		}
+	}
+}
+
+func TestInstructionSystem(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	cases := []struct {
+		environment string
+		lines       [][3]string
+		stdin       string
+		console     string
+		want        map[int]uint32
+		exitCode    int32
+	}{
+		{"rars", [][3]string{
+			{"", "addi", "a0, x0, -12"},
+			{"", "addi", "a7, x0, 1"}, // print_int
+			{"", "ecall", ""},
+			{"", "addi", "a0, x0, 10"},
+			{"", "addi", "a7, x0, 11"}, // print_char
+			{"", "ecall", ""},
+			{"", "addi", "a7, x0, 10"}, // exit
+			{"", "ecall", ""},
+			{"", "addi", "a1, x0, 1"}, // unreachable
+		}, "", "-12\n", map[int]uint32{a0: 10, a1: 0}, 0},
+		{"rars", [][3]string{
+			{"", "addi", "a7, x0, 5"}, // read_int
+			{"", "ecall", ""},
+			{"", "addi", "t0, a0, 1"},
+			{"", "addi", "a0, x0, 16"},
+			{"", "addi", "a7, x0, 9"}, // sbrk
+			{"", "ecall", ""},
+			{"", "addi", "a0, x0, 16"},
+			{"", "ecall", ""},
+			{"", "addi", "a0, x0, 3"},
+			{"", "addi", "a7, x0, 17"}, // exit2
+			{"", "ecall", ""},
+		}, "41\n", "41\n", map[int]uint32{5: 42, a0: 3}, 3},
+		{"rars", [][3]string{
+			{"", "addi", "t0, x0, 0x48"}, // H
+			{"", "sb", "t0, 0x10(x0)"},
+			{"", "addi", "t0, x0, 0x69"}, // i
+			{"", "sb", "t0, 0x11(x0)"},
+			{"", "addi", "a0, x0, 0x10"},
+			{"", "addi", "a7, x0, 4"}, // print_string
+			{"", "ecall", ""},
+		}, "", "Hi", map[int]uint32{a0: 0x10}, -1},
+		{"linux", [][3]string{
+			{"", "addi", "a0, x0, 0"},
+			{"", "addi", "a1, x0, 0x20"},
+			{"", "addi", "a2, x0, 3"},
+			{"", "addi", "a7, x0, 63"}, // read
+			{"", "ecall", ""},
+			{"", "addi", "a2, a0, 0"},
+			{"", "addi", "a0, x0, 1"},
+			{"", "addi", "a7, x0, 64"}, // write
+			{"", "ecall", ""},
+			{"", "addi", "a0, x0, 0"},
+			{"", "addi", "a7, x0, 214"}, // brk
+			{"", "ecall", ""},
+			{"", "addi", "a0, x0, 7"},
+			{"", "addi", "a7, x0, 93"}, // exit
+			{"", "ecall", ""},
+		}, "RISC-V", "RISRIS", map[int]uint32{a0: 7, a1: 0x20, a2: 3}, 7},
+		{"linux", [][3]string{
+			{"", "addi", "a0, x0, 5"},
+			{"", "addi", "a7, x0, 64"}, // write
+			{"", "ecall", ""},
+		}, "", "", map[int]uint32{a0: 0xfffffff7}, -1}, // EBADF
+	}
+
+	for _, v := range cases {
+		sim.environment = environments[v.environment]
+		sim.stdin = bufio.NewReader(strings.NewReader(v.stdin))
+		sim.load(v.lines)
+		sim.reset()
+		sim.view.Disabled.Run = false
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("button=RUN"))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s Code = %d", v.environment, w.Code)
+		}
+		if sim.fault != "" {
+			t.Errorf("%s fault = %s", v.environment, sim.fault)
+		}
+		if got := sim.console.String(); got != v.console {
+			t.Errorf("%s console = %q, want %q", v.environment, got, v.console)
+		}
+		for rd, want := range v.want {
+			if sim.registers[rd] != want {
+				t.Errorf("%s x%d = %x, want %x", v.environment, rd, sim.registers[rd], want)
+			}
+		}
+		if v.exitCode < 0 {
+			if sim.exitCode != nil {
+				t.Errorf("%s exit(%d)", v.environment, *sim.exitCode)
+			}
+		} else if sim.exitCode == nil || *sim.exitCode != v.exitCode {
+			t.Errorf("%s exitCode = %v, want %d", v.environment, sim.exitCode, v.exitCode)
+		}
+	}
+
+	sim.environment = environments["rars"]
+	sim.load([][3]string{{"", "addi", "a7, x0, 999"}, {"", "ecall", ""}, {"", "ebreak", ""}})
+	sim.reset()
+	sim.view.Disabled.Run = false
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.fault == "" || sim.effectivePc() {
+		t.Errorf("unknown system call fault = %q", sim.fault)
+	}
+
+	sim.stdin = handler.newSimulator().stdin // EOF. not the server's stdin
+	sim.load([][3]string{{"", "addi", "a0, x0, 1"}, {"", "addi", "a7, x0, 5"}, {"", "ecall", ""}})
+	sim.reset()
+	sim.view.Disabled.Run = false
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.stdin != nil || sim.registers[a0] != 0 {
+		t.Errorf("read_int a0 = %d", sim.registers[a0])
+	}
+
+	sim.load([][3]string{{"", "ebreak", ""}, {"", "addi", "a0, x0, 1"}})
+	sim.reset()
+	sim.view.Disabled.Run = false
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.pc != sim.entryPoint+4 || !sim.view.Break || sim.registers[a0] != 0 {
+		t.Errorf("ebreak pc = %x break = %v", sim.pc, sim.view.Break)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.view.Break || sim.registers[a0] != 1 {
+		t.Errorf("ebreak continue break = %v a0 = %d", sim.view.Break, sim.registers[a0])
+	}
+}
+
+func TestInstructionCsr(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	mscratch := csrMapping["mscratch"]
+	cases := []struct {
+		mnemonic string
+		operand  string
+		csr      int
+		before   uint32
+		want     uint32
+		rd       uint32
+	}{
+		{"csrrw ", "x7, mscratch, x5", mscratch, 0xf0f0, 0x12345678, 0xf0f0},
+		{"csrrw ", "x0, 0x340, x5   ", mscratch, 0xf0f0, 0x12345678, 0},
+		{"csrrs ", "x7, mscratch, x6", mscratch, 0xf0f0, 0xf0ff, 0xf0f0},
+		{"csrrs ", "x7, mscratch, x0", mscratch, 0xf0f0, 0xf0f0, 0xf0f0},
+		{"csrrc ", "x7, mscratch, x6", mscratch, 0xf0f0, 0xf000, 0xf0f0},
+		{"csrrwi", "x7, mscratch, 31", mscratch, 0xf0f0, 31, 0xf0f0},
+		{"csrrsi", "x7, mscratch, 1 ", mscratch, 0xf0f0, 0xf0f1, 0xf0f0},
+		{"csrrci", "x7, mscratch, 16", mscratch, 0xf0f0, 0xf0e0, 0xf0f0},
+		{"csrrw ", "x7, mtvec, x5   ", csrMapping["mtvec"], 0, 0x12345678 &^ 2, 0},
+		{"csrrw ", "x7, mepc, x5    ", csrMapping["mepc"], 0, 0x12345678, 0},
+		{"csrrw ", "x7, misa, x5    ", csrMapping["misa"], misaValue, misaValue, misaValue},
+		{"csrrw ", "x7, mstatus, x6 ", csrMapping["mstatus"], mstatusMPP, mstatusMPP | mstatusMPIE | mstatusMIE, mstatusMPP},
+		{"csrrs ", "x7, mhartid, x0 ", csrMapping["mhartid"], 0, 0, 0},
+		{"csrrs ", "x7, cycle, x0   ", csrMapping["cycle"], 0, 1, 0},
+		{"csrrs ", "x7, instret, x0 ", csrMapping["instret"], 0, 1, 0},
+	}
+
+	for _, v := range cases {
+		mnemonic := strings.TrimSpace(v.mnemonic)
+		operand := strings.TrimSpace(v.operand)
+
+		sim.load([][3]string{[...]string{"", mnemonic, operand}})
+		sim.reset()
+		sim.view.Disabled.Step = false
+		sim.registers[5] = 0x12345678
+		sim.registers[6] = 0x00ff
+		if !csrReadOnly(v.csr) && csrNames[v.csr] != "misa" {
+			sim.csrs[v.csr] = v.before
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("button=STEP"))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s Code = %d", mnemonic, operand, w.Code)
+		}
+		if got := sim.readCsr(v.csr); got != v.want {
+			t.Errorf("%s %s %s = %x, want %x", mnemonic, operand, csrNames[v.csr], got, v.want)
+		}
+		if sim.registers[7] != v.rd {
+			t.Errorf("%s %s x7 = %x, want %x", mnemonic, operand, sim.registers[7], v.rd)
+		}
+		if sim.last.Csr != v.csr {
+			t.Errorf("%s %s effect csr = %d, want %d", mnemonic, operand, sim.last.Csr, v.csr)
+		}
+	}
+}
+
+func TestTrap(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	handlerLines := [][3]string{
+		{"handler:", "csrrs", "t0, mepc, x0"},
+		{"", "addi", "t0, t0, 4"}, // skip the trapped instruction
+		{"", "csrrw", "x0, mepc, t0"},
+		{"", "mret", ""},
+	}
+	cases := []struct {
+		name  string
+		lines [][3]string
+		cause uint32
+		tval  uint32
+	}{
+		{"ecall", [][3]string{{"", "ecall", ""}}, causeEcallM, 0},
+		{"ebreak", [][3]string{{"", "ebreak", ""}}, causeBreakpoint, 0x1010},
+		{"illegal", [][3]string{{"", "csrrw", "x5, cycle, x6"}}, causeIllegalInstruction, 0xc00312f3},
+		{"unimplemented", [][3]string{{"", "csrrs", "x5, 0x7c0, x0"}}, causeIllegalInstruction, 0x7c0022f3},
+		{"misaligned", [][3]string{{"", "jalr", "x5, 2(t1)"}}, causeMisalignedFetch, 0x1016},
+	}
+
+	for _, v := range cases {
+		lines := [][3]string{
+			{"", "addi", "t0, x0, 0x400"},
+			{"", "slli", "t0, t0, 2"},
+			{"", "addi", "t0, t0, 0x18"}, // handler
+			{"", "csrrw", "x0, mtvec, t0"},
+		}
+		lines = append(lines, v.lines...)
+		lines = append(lines, [...]string{"", "jal", "x0, end"})
+		lines = append(lines, handlerLines...)
+		lines = append(lines, [...]string{"end:", "", ""})
+
+		sim.load(lines)
+		sim.reset()
+		sim.registers[6] = 0x1010 + 4
+		sim.view.Disabled.Step = false
+
+		for range 5 {
+			handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STEP"))
+		}
+		if !sim.last.Trap || sim.pc != 0x1018 {
+			t.Fatalf("%s trap = %v pc = %x", v.name, sim.last.Trap, sim.pc)
+		}
+		if got := sim.readCsr(csrMapping["mcause"]); got != v.cause {
+			t.Errorf("%s mcause = %d, want %d", v.name, got, v.cause)
+		}
+		if got := sim.readCsr(csrMapping["mepc"]); got != 0x1010 {
+			t.Errorf("%s mepc = %x", v.name, got)
+		}
+		if got := sim.readCsr(csrMapping["mtval"]); got != v.tval {
+			t.Errorf("%s mtval = %x, want %x", v.name, got, v.tval)
+		}
+		if sim.registers[5] != 0x1018 {
+			t.Errorf("%s x5 = %x, not retired", v.name, sim.registers[5])
+		}
+
+		sim.view.Disabled.Run = false
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+		if sim.pc != 0x1028+4 || sim.fault != "" {
+			t.Errorf("%s mret pc = %x fault = %s", v.name, sim.pc, sim.fault)
+		}
+	}
+
+	// no trap handler
+	sim.load([][3]string{{"", "jalr", "x5, 2(x0)"}})
+	sim.reset()
+	sim.view.Disabled.Step = false
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STEP"))
+	if sim.fault == "" || sim.pc != sim.entryPoint || sim.effectivePc() {
+		t.Errorf("fault = %q pc = %x", sim.fault, sim.pc)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	labelMapping := map[string]uint32{"l1": entryPoint + 8, "l2": entryPoint - 16, "far": entryPoint + 4096}
+
+	cases := []struct {
+		mnemonic string
+		operand  string
+		want     uint32
+		format   string
+	}{
+		{"add", "x7,x28,x29", 0x01de03b3, "R"},
+		{"sub", "x7,x28,x29", 0x41de03b3, "R"},
+		{"mul", "x10,x10,x11", 0x02b50533, "R"},
+		{"remu", "x10,x10,x11", 0x02b57533, "R"},
+		{"addi", "x5,x0,2047", 0x7ff00293, "I"},
+		{"addi", "x5,x5,-1", 0xfff28293, "I"},
+		{"srai", "x7,x31,2", 0x402fd393, "I"},
+		{"slli", "x28,x28,8", 0x008e1e13, "I"},
+		{"lw", "x10,4(x2)", 0x00412503, "I"},
+		{"lbu", "x10,(x11)", 0x0005c503, "I"},
+		{"jalr", "x0,(x1)", 0x00008067, "I"},
+		{"jalr", "-4(x5)", 0xffc280e7, "I"},
+		{"sw", "x10,(x0)", 0x00a02023, "S"},
+		{"sh", "x7,-2(x8)", 0xfe741f23, "S"},
+		{"beq", "x29,x0,l1", 0x000e8463, "B"},
+		{"bne", "x11,x0,l2", 0xfe0598e3, "B"},
+		{"bgeu", "x10,x11,far", 0, ""}, // out of range
+		{"lui", "x6,0x87", 0x00087337, "U"},
+		{"auipc", "x5,0xfffff", 0xfffff297, "U"},
+		{"jal", "l1", 0x008000ef, "J"},
+		{"jal", "x0,l2", 0xff1ff06f, "J"},
+		{"jal", "x0,far", 0x0000106f, "J"},
+		{"fence", "", 0x0ff0000f, "I"},
+		{"fence", "r,w", 0x0210000f, "I"},
+		{"ecall", "", 0x00000073, "I"},
+		{"ebreak", "", 0x00100073, "I"},
+		{"mret", "", 0x30200073, "I"},
+		{"csrrs", "x5,mepc,x0", 0x341022f3, "I"},
+		{"csrrwi", "x0,0x7c0,31", 0x7c0fd073, "I"},
+		{"", "", 0, ""},
+	}
+
+	for _, v := range cases {
+		inst := Instruction{Mnemonic: v.mnemonic, Operand: v.operand}
+		code, format := encode(inst, entryPoint, &Symbols{values: labelMapping})
+		if code != v.want || format != v.format {
+			t.Errorf("%s %s = %08x %s, want %08x %s", v.mnemonic, v.operand, code, format, v.want, v.format)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	labels := map[uint32]string{entryPoint + 8: "l1"}
+
+	cases := []struct {
+		code     uint32
+		mnemonic string
+		operand  string
+	}{
+		{0x01de03b3, "add", "x7,x28,x29"},
+		{0x41de03b3, "sub", "x7,x28,x29"},
+		{0x02b57533, "remu", "x10,x10,x11"},
+		{0xfff28293, "addi", "x5,x5,-1"},
+		{0x402fd393, "srai", "x7,x31,2"},
+		{0x00412503, "lw", "x10,4(x2)"},
+		{0x00008067, "jalr", "x0,0(x1)"},
+		{0xfe741f23, "sh", "x7,-2(x8)"},
+		{0x000e8463, "beq", "x29,x0,l1"},
+		{0xfe0598e3, "bne", "x11,x0,0x00000ff0"},
+		{0xfffff297, "auipc", "x5,0xfffff"},
+		{0x008000ef, "jal", "x1,l1"},
+		{0x0000106f, "jal", "x0,0x00002000"},
+		{0x0ff0000f, "fence", ""},
+		{0x0210000f, "fence", "r,w"},
+		{0x00000073, "ecall", ""},
+		{0x00100073, "ebreak", ""},
+		{0x30200073, "mret", ""},
+		{0x341022f3, "csrrs", "x5,mepc,x0"},
+		{0x7c0fd073, "csrrwi", "x0,0x7c0,31"},
+		{0x00000000, ".word", "0x00000000"},
+		{0x0000100f, ".word", "0x0000100f"}, // fence.i
+		{0x02b5f5b3, "remu", "x11,x11,x11"},
+		{0x42b5f5b3, ".word", "0x42b5f5b3"},
+		{0x00200073, ".word", "0x00200073"},
+	}
+
+	for _, v := range cases {
+		inst := disassemble(v.code, entryPoint, labels)
+		if inst.Mnemonic != v.mnemonic || inst.Operand != v.operand || inst.Code != v.code {
+			t.Errorf("%08x = %s %s, want %s %s", v.code, inst.Mnemonic, inst.Operand, v.mnemonic, v.operand)
+		}
+		if inst.Format == "" {
+			continue
+		}
+		code, _ := encode(inst, entryPoint, &Symbols{values: map[string]uint32{"l1": entryPoint + 8}})
+		if code != v.code {
+			t.Errorf("%s %s = %08x, want %08x", inst.Mnemonic, inst.Operand, code, v.code)
+		}
+	}
+}
+
+func TestSelfModifyingCode(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"", "lui", "x6, 0x1"},      // entry point
+		{"", "lw", "x5, 12(x6)"},    // the encoding of the 4th
+		{"", "sw", "x5, 16(x6)"},    // overwrites the 5th
+		{"", "addi", "x7, x7, 1"},   // 4th
+		{"", "addi", "x7, x0, 100"}, // 5th
+		{"end:", "", ""},
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("button=STEP"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Code = %d", w.Code)
+		}
+	}
+	if sim.registers[5] != 0x00138393 {
+		t.Errorf("x5 = %08x, want the encoding", sim.registers[5])
+	}
+	if inst := sim.instructions[4]; inst.Mnemonic != "addi" || inst.Operand != "x7,x7,1" {
+		t.Errorf("listing = %s %s", inst.Mnemonic, inst.Operand)
+	}
+	if sim.view.Codes[4].CodeColor != ColorWrite || sim.view.Codes[4].Operand != "x7, x7, 1" {
+		t.Errorf("view = %q %q", sim.view.Codes[4].CodeColor, sim.view.Codes[4].Operand)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("button=RUN"))
+	if sim.registers[7] != 2 {
+		t.Errorf("x7 = %d, want 2", sim.registers[7])
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STOP"))
+	if inst := sim.instructions[4]; inst.Operand != "x7,x0,100" || sim.readWord(sim.entryPoint+16) != inst.Code {
+		t.Errorf("not restored %s %08x", inst.Operand, sim.readWord(sim.entryPoint+16))
+	}
+}
+
+func TestValidateLabelRange(t *testing.T) {
+	_, sim := newTestSimulatorHandler()
+
+	cases := []struct {
+		mnemonic string
+		operand  string
+		offset   int
+		want     bool
+	}{
+		{"beq", "x0, x0, l1", 4092, true},
+		{"beq", "x0, x0, l1", 4096, false},
+		{"jal", "x0, l1", 1<<20 - 4, true},
+		{"jal", "x0, l1", 1 << 20, false},
+	}
+
+	for _, v := range cases {
+		valid := sim.validate(linesWithLabel(v.mnemonic, v.operand, "l1", v.offset)).valid()
+		if valid != v.want {
+			t.Errorf("%s %s +%d %v", v.mnemonic, v.operand, v.offset, valid)
+		}
+	}
+}
+
+// minimal ELF32 executable. segments are flagged executable in order of text, data
+func writeElf(t *testing.T, entry uint32, segments []Segment, bss uint32, symbols map[string]elf.Sym32) string {
+	t.Helper()
+
+	const ehsize, phentsize, shentsize = 52, 32, 40
+	offset := uint32(ehsize + phentsize*len(segments))
+	progs := []elf.Prog32{}
+	body := bytes.Buffer{}
+	for i, v := range segments {
+		flags := elf.PF_R | elf.PF_W
+		memsz := uint32(len(v.Bytes))
+		if i == 0 {
+			flags = elf.PF_R | elf.PF_X
+		} else {
+			memsz += bss
+		}
+		progs = append(progs, elf.Prog32{Type: uint32(elf.PT_LOAD), Off: offset + uint32(body.Len()), Vaddr: v.Address, Paddr: v.Address, Filesz: uint32(len(v.Bytes)), Memsz: memsz, Flags: uint32(flags), Align: 4})
+		body.Write(v.Bytes)
+	}
+
+	strtab := []byte{0}
+	syms := []elf.Sym32{{}}
+	for _, k := range slices.Sorted(maps.Keys(symbols)) {
+		sym := symbols[k]
+		sym.Name = uint32(len(strtab))
+		sym.Shndx = 1 // defined
+		strtab = append(strtab, append([]byte(k), 0)...)
+		syms = append(syms, sym)
+	}
+	symtab := bytes.Buffer{}
+	binary.Write(&symtab, binary.LittleEndian, syms)
+	strOff := offset + uint32(body.Len())
+	body.Write(strtab)
+	symOff := offset + uint32(body.Len())
+	body.Write(symtab.Bytes())
+	shoff := offset + uint32(body.Len())
+
+	sections := []elf.Section32{
+		{},
+		{Type: uint32(elf.SHT_SYMTAB), Off: symOff, Size: uint32(symtab.Len()), Link: 2, Info: 1, Entsize: 16},
+		{Type: uint32(elf.SHT_STRTAB), Off: strOff, Size: uint32(len(strtab))},
+	}
+
+	header := elf.Header32{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_RISCV), Version: uint32(elf.EV_CURRENT), Entry: entry,
+		Phoff: ehsize, Shoff: shoff, Ehsize: ehsize, Phentsize: phentsize, Phnum: uint16(len(progs)),
+		Shentsize: shentsize, Shnum: uint16(len(sections)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	file := bytes.Buffer{}
+	binary.Write(&file, binary.LittleEndian, header)
+	binary.Write(&file, binary.LittleEndian, progs)
+	file.Write(body.Bytes())
+	binary.Write(&file, binary.LittleEndian, sections)
+
+	fileName := filepath.Join(t.TempDir(), "a.out")
+	if err := os.WriteFile(fileName, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadElf(t *testing.T) {
+	const text, data = 0x10000, 0x11000
+	lines := [][3]string{
+		{"", "lui", "x5, 0x11"},
+		{"", "lw", "x6, 0(x5)"},
+		{"", "addi", "x6, x6, 1"},
+		{"", "sw", "x6, 4(x5)"},
+		{"", "jal", "x1, done"},
+		{"", "addi", "x7, x0, 7"},
+	}
+	labelMapping := map[string]uint32{"done": text + 28}
+	code := make([]byte, 8, 8+len(lines)*4) // literal pool before the entry
+	binary.LittleEndian.PutUint32(code, 0x12345678)
+	for i, v := range lines {
+		pc := uint32(text + 8 + i*4)
+		c, _ := encode(Instruction{Mnemonic: v[1], Operand: normalizeOperand(v[2])}, pc, &Symbols{values: labelMapping})
+		code = binary.LittleEndian.AppendUint32(code, c)
+	}
+	fileName := writeElf(t, text+8, []Segment{{text, code}, {data, []byte{41, 0, 0, 0}}}, 4, map[string]elf.Sym32{
+		"_start": {Value: text + 8, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+		"done":   {Value: text + 28, Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_NOTYPE)},
+		"value":  {Value: data, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT)},
+		"$x":     {Value: text + 8, Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_NOTYPE)},
+		"a.c":    {Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FILE)},
+	})
+
+	handler := NewSimulatorHandler(fileName, entryPoint)
+	sim := NewSimulator(fileName, handler.entryPoint, handler.singlePage, &StringRecorder{[]string{}})
+	handler.sims[handler.sharedId] = sim
+	sim.init()
+	sim.view.setStatus(ready)
+
+	if sim.view.Failed || sim.pc != text+8 || sim.registers[2] != stackTop {
+		t.Fatalf("failed = %v pc = %x sp = %x", sim.view.Failed, sim.pc, sim.registers[2])
+	}
+	if len(sim.labelMapping) != 3 || sim.labelMapping["_start"] != text+8 || sim.labelMapping["value"] != data {
+		t.Errorf("labelMapping = %v", sim.labelMapping)
+	}
+	if sim.instructions[0].Mnemonic != ".word" || sim.instructions[2].Label != "_start:" || sim.instructions[6].Operand != "x1,done" {
+		t.Errorf("listing = %v", sim.instructions[:8])
+	}
+	if sim.view.Codes[2].Address != "0x00010008" || sim.view.Codes[2].Label != "_start:" {
+		t.Errorf("view = %v", sim.view.Codes[2])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("button=RUN"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Code = %d", w.Code)
+	}
+	if sim.readWord(data+4) != 42 || sim.registers[7] != 7 || sim.registers[1] != text+28 {
+		t.Errorf("bss = %d x7 = %d x1 = %x", sim.readWord(data+4), sim.registers[7], sim.registers[1])
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STOP"))
+	if sim.pc != text+8 || sim.readWord(data+4) != 0 || sim.readWord(data) != 41 {
+		t.Errorf("not reset pc = %x", sim.pc)
+	}
+}
+
+func TestLoadElfInvalid(t *testing.T) {
+	fileName := writeElf(t, 0, []Segment{{0x10002, []byte{0x13, 0, 0, 0}}}, 0, nil)
+
+	w := &StringRecorder{[]string{}}
+	sim := NewSimulator(fileName, entryPoint, nil, w)
+	sim.init()
+	if !sim.view.Failed || sim.end != nil || len(w.messages) != 1 {
+		t.Errorf("failed = %v messages = %v", sim.view.Failed, w.messages)
+	}
+
+	const vaddr, memsz = 52 + 8, 52 + 20 // the first program header
+	for _, v := range []struct {
+		offset int
+		value  uint32
+	}{
+		{memsz, 1},          // less than p_filesz
+		{memsz, 0xfffffff0}, // too large
+		{vaddr, 0xfffffffe}, // beyond the address space
+	} {
+		fileName := writeElf(t, 0x10000, []Segment{{0x10000, []byte{0x13, 0, 0, 0}}}, 0, nil)
+		b, _ := os.ReadFile(fileName)
+		binary.LittleEndian.PutUint32(b[v.offset:], v.value)
+		os.WriteFile(fileName, b, 0644)
+
+		w := &StringRecorder{[]string{}}
+		sim := NewSimulator(fileName, entryPoint, nil, w)
+		sim.init()
+		if !sim.view.Failed || len(w.messages) != 1 || !strings.Contains(w.messages[0], "p_memsz") {
+			t.Errorf("%d failed = %v messages = %v", v.offset, sim.view.Failed, w.messages)
+		}
+	}
+
+	for _, entry := range []uint32{0x0, 0x10002, 0x10008, 0x10040} { // outside, not aligned, after the last and in the padding
+		fileName := writeElf(t, entry, []Segment{{0x10000, []byte{0x13, 0, 0, 0, 0x13, 0, 0, 0}}}, 0, nil)
+		sim := NewSimulator(fileName, entryPoint, nil, nil)
+		sim.init()
+		if !sim.view.Failed || len(sim.diagnostics) != 1 || sim.diagnostics[0].Code != "invalid-entry" || sim.end != nil {
+			t.Errorf("0x%x %+v", entry, sim.diagnostics)
+		}
+	}
+}
+
+func TestPseudoInstruction(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"main:", "li", "x5, 0x12345678"},
+		{"", "li", "x6, -2048"},
+		{"", "li", "x7, 0x1000"},
+		{"", "la", "x8, data"},
+		{"", "call", "func"},
+		{"", "bgtu", "x5, x6, skip"},
+		{"", "li", "x9, 1"},
+		{"", "li", "x11, ' '"},
+		{"", "addi", "x12, x0, ' '"},
+		{"", "li", "x13, ','"},
+		{"skip:", "j", "end"},
+		{"func:", "mv", "x10, x5"},
+		{"", "ret", ""},
+		{"data:", "nop", ""},
+		{"end:", "", ""},
+	}
+	if !sim.validate(lines).valid() {
+		t.Fatal("invalid")
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	if sim.labelMapping["func"] != sim.entryPoint+14*4 || sim.labelMapping["end"] != sim.entryPoint+17*4 {
+		t.Errorf("labelMapping = %v", sim.labelMapping)
+	}
+	listing := []struct {
+		mnemonic string
+		operand  string
+		pseudo   string
+	}{
+		{"lui", "x5,0x12345", "li x5, 0x12345678"},
+		{"addi", "x5,x5,1656", ""},
+		{"addi", "x6,x0,-2048", "li x6, -2048"},
+		{"lui", "x7,0x1", "li x7, 0x1000"},
+		{"auipc", "x8,0x0", "la x8, data"},
+		{"addi", "x8,x8,48", ""},
+		{"auipc", "x1,0x0", "call func"},
+		{"jalr", "x1,32(x1)", ""},
+		{"bltu", "x6,x5,skip", "bgtu x5, x6, skip"},
+		{"addi", "x9,x0,1", "li x9, 1"},
+		{"addi", "x11,x0,32", "li x11, ' '"},
+		{"addi", "x12,x0,' '", ""},
+		{"addi", "x13,x0,44", "li x13, ','"},
+	}
+	for i, v := range listing {
+		inst := sim.instructions[i]
+		if inst.Mnemonic != v.mnemonic || inst.Operand != v.operand || inst.Pseudo != v.pseudo || inst.Format == "" {
+			t.Errorf("%d %s %s %q", i, inst.Mnemonic, inst.Operand, inst.Pseudo)
+		}
+	}
+	if sim.view.Codes[0].Pseudo != "li x5, 0x12345678" || sim.view.Codes[0].Label != "main:" || sim.view.Codes[1].Label != "" {
+		t.Errorf("view = %v", sim.view.Codes[:2])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("button=RUN"))
+	if w.Code != http.StatusOK || sim.fault != "" {
+		t.Fatalf("Code = %d fault = %q", w.Code, sim.fault)
+	}
+	want := [32]uint32{}
+	want[1] = sim.entryPoint + 8*4
+	want[5] = 0x12345678
+	want[6] = 0xfffff800
+	want[7] = 0x1000
+	want[8] = sim.labelMapping["data"]
+	want[9] = 1
+	want[10] = 0x12345678
+	want[11] = ' '
+	want[12] = ' '
+	want[13] = ','
+	if sim.registers != want {
+		t.Errorf("registers = %x, want %x", sim.registers, want)
+	}
+}
+
+func TestDataDirective(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"", ".globl", "main"},
+		{"", ".data", ""},
+		{"msg:", ".asciz", `"Hi\n", "\0"`},
+		{"", ".align", "2"},
+		{"table:", ".word", "0x12345678, -1, main"},
+		{"half:", ".half", "-2, 0xffff"},
+		{"", ".byte", "'A', 255"},
+		{"buf:", ".space", "3"},
+		{"", ".section", ".text"},
+		{"main:", "la", "x5, table"},
+		{"", "lw", "x6, 0(x5)"},
+		{"", "lw", "x7, 8(x5)"},
+		{"", "lb", "x8, 0(x5)"},
+		{"", ".section", `.rodata, "a"`},
+		{"str:", ".ascii", `"ok"`},
+	}
+
+	rec := &StringRecorder{[]string{}}
+	sim.validationError = rec
+	if !sim.validate(lines).valid() {
+		t.Fatalf("invalid %v", rec.messages)
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	want := map[string]uint32{"msg": dataBase, "table": dataBase + 8, "half": dataBase + 20, "buf": dataBase + 26, "main": sim.entryPoint, "str": dataBase + 29}
+	for k, v := range want {
+		if sim.labelMapping[k] != v {
+			t.Errorf("%s = %x, want %x", k, sim.labelMapping[k], v)
+		}
+	}
+	data := []byte{'H', 'i', '\n', 0, 0, 0, 0, 0, 0x78, 0x56, 0x34, 0x12, 0xff, 0xff, 0xff, 0xff, 0x00, 0x10, 0, 0, 0xfe, 0xff, 0xff, 0xff, 'A', 255, 0, 0, 0, 'o', 'k'}
+	for i, v := range data {
+		if got := sim.readMemory(dataBase + uint32(i)); got != v {
+			t.Errorf("memory[%x] = %02x, want %02x", dataBase+i, got, v)
+		}
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.registers[5] != dataBase+8 || sim.registers[6] != 0x12345678 || sim.registers[7] != sim.entryPoint || sim.registers[8] != 0x78 {
+		t.Errorf("registers = %x", sim.registers[5:9])
+	}
+}
+
+func TestRelocation(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"", ".data", ""},
+		{"", ".space", "0x900"},
+		{"msg:", ".word", "0x12345678"},
+		{"", ".text", ""},
+		{"main:", "lui", "x5, %hi(msg)"},
+		{"", "lw", "x6, %lo(msg)(x5)"},
+		{"", "sw", "x6, %lo(msg)(x5)"},
+		{"", "addi", "x5, x5, %lo(msg)"},
+		{"l1:", "auipc", "x7, %pcrel_hi(msg)"},
+		{"", "lw", "x8, %pcrel_lo(l1)(x7)"},
+		{"", "addi", "x7, x7, %pcrel_lo(l1)"},
+	}
+
+	rec := &StringRecorder{[]string{}}
+	sim.validationError = rec
+	if !sim.validate(lines).valid() {
+		t.Fatalf("invalid %v", rec.messages)
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	listing := []struct {
+		operand string
+		code    uint32
+	}{
+		{"x5,%hi(msg)", 0x000112b7},
+		{"x6,%lo(msg)(x5)", 0x9002a303},
+		{"x6,%lo(msg)(x5)", 0x9062a023},
+		{"x5,x5,%lo(msg)", 0x90028293},
+		{"x7,%pcrel_hi(msg)", 0x00010397},
+	}
+	for i, v := range listing {
+		if inst := sim.instructions[i]; inst.Operand != v.operand || inst.Code != v.code {
+			t.Errorf("%d %s %08x, want %08x", i, inst.Operand, inst.Code, v.code)
+		}
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	msg := uint32(dataBase + 0x900)
+	if sim.registers[5] != msg || sim.registers[6] != 0x12345678 || sim.registers[7] != msg || sim.registers[8] != 0x12345678 {
+		t.Errorf("registers = %x", sim.registers[5:9])
+	}
+
+	invalid := []struct {
+		mnemonic string
+		operand  string
+	}{
+		{"lui", "x5, %lo(main)"},
+		{"lui", "x5, %pcrel_hi(main)"},
+		{"auipc", "x5, %hi(main)"},
+		{"addi", "x5, x5, %hi(main)"},
+		{"lw", "x5, %pcrel_hi(main)(x5)"},
+		{"lui", "x5, %hi(none)"},
+		{"addi", "x5, x5, %pcrel_lo(main)"},
+		{"slli", "x5, x5, %lo(main)"},
+	}
+	for _, v := range invalid {
+		lines := [][3]string{{"main:", "nop", ""}, {"", v.mnemonic, v.operand}}
+		if sim.validate(lines).valid() {
+			t.Errorf("%s %s valid", v.mnemonic, v.operand)
+		}
+	}
+}
+
+func TestExpression(t *testing.T) {
+	symbols := &Symbols{values: map[string]uint32{"start": 0x1000, "end": 0x1010, "N": 3}}
+	cases := []struct {
+		expr string
+		want int64
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"-0x800", -2048, true},
+		{"1 + 2 * 3", 7, true},
+		{"(1 + 2) * 3", 9, true},
+		{"1 << 4 | 1", 17, true},
+		{"0xff & ~0xf", 0xf0, true},
+		{"-16 >> 2", -4, true},
+		{"7 / 2 - 'A'", -62, true},
+		{"'\\n'", 10, true},
+		{"(end - start) / 4", 4, true},
+		{"N*N", 9, true},
+		{"none", 0, false},
+		{"1 / 0", 0, false},
+		{"(1 + 2", 0, false},
+		{"1 +", 0, false},
+		{"1 < 2", 0, false},
+		{"", 0, false},
+	}
+	for _, v := range cases {
+		got, err := evaluate(v.expr, symbols)
+		if (err == nil) != v.ok || (v.ok && got != v.want) {
+			t.Errorf("%q = %d %v, want %d", v.expr, got, err, v.want)
+		}
+	}
+}
+
+func TestConstantExpression(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"", ".equ", "SIZE, 4 * 4"},
+		{"", ".set", "MASK, ~(SIZE - 1)"},
+		{"", ".data", ""},
+		{"start:", ".space", "SIZE"},
+		{"end:", ".word", "end - start, 'A' + 1"},
+		{"", ".text", ""},
+		{"main:", "li", "x5, SIZE << 16"},
+		{"", "addi", "x6, x0, MASK"},
+		{"", "slli", "x7, x6, SIZE / 8"},
+		{"", "la", "x8, start"},
+		{"", "lw", "x9, end - start(x8)"},
+		{"", "andi", "x10, x9, (end - start) & 0xf0"},
+	}
+
+	rec := &StringRecorder{[]string{}}
+	sim.validationError = rec
+	if !sim.validate(lines).valid() {
+		t.Fatalf("invalid %v", rec.messages)
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	if sim.labelMapping["end"] != dataBase+16 {
+		t.Errorf("labelMapping = %v", sim.labelMapping)
+	}
+	if _, ok := sim.labelMapping["SIZE"]; ok {
+		t.Error("constant as a label")
+	}
+	if sim.instructions[0].Operand != "x5,0x100" || sim.instructions[1].Operand != "x6,x0,MASK" {
+		t.Errorf("listing = %v", sim.instructions[:2])
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	want := []uint32{0x100000, 0xfffffff0, 0xffffffc0, dataBase, 16, 16}
+	if !slices.Equal(sim.registers[5:11], want) {
+		t.Errorf("registers = %x, want %x", sim.registers[5:11], want)
+	}
+
+	invalid := []struct {
+		lines   [][3]string
+		message string
+	}{
+		{[][3]string{{"", "addi", "x5, x0, 1 << 11"}}, "invalid immediate(1 << 11 = 2048) 12 bit signed integer"},
+		{[][3]string{{"", "lui", "x5, -1"}}, "invalid immediate(-1) 20 bit unsigned integer"},
+		{[][3]string{{"", "slli", "x5, x5, 4 * 8"}}, "invalid shamt(4 * 8 = 32) 0 <= shamt <= 31"},
+		{[][3]string{{"", "lw", "x5, 0x400 * 2(x6)"}}, "invalid offset(0x400 * 2 = 2048) 12 bit signed integer"},
+		{[][3]string{{"", "csrrwi", "x5, mstatus, 1 + 31"}}, "invalid uimm(1 + 31 = 32) 0 <= uimm <= 31"},
+		{[][3]string{{"", "addi", "x5, x0, none"}}, "invalid immediate(none) undefined symbol(none)"},
+		{[][3]string{{"", "li", "x5, N"}, {"", ".equ", "N, 1"}}, "invalid immediate(N) symbol defined later"},
+		{[][3]string{{"", ".equ", "N, 1"}, {"", ".set", "N, 2"}}, "symbol duplicated(N)"},
+		{[][3]string{{"", ".equ", "N"}}, "parse failed"},
+		{[][3]string{{"", ".data", ""}, {"", ".byte", "0x80 << 1"}}, "invalid value(0x80 << 1 = 256) 8 bit integer"},
+	}
+	for _, v := range invalid {
+		rec := &StringRecorder{[]string{}}
+		sim.validationError = rec
+		if sim.validate(v.lines).valid() || len(rec.messages) != 1 || !strings.HasSuffix(strings.TrimSpace(rec.messages[0]), v.message) {
+			t.Errorf("%v %v", v.lines, rec.messages)
+		}
+	}
+}
+
+func TestValidateDirective(t *testing.T) {
+	_, sim := newTestSimulatorHandler()
+
+	cases := []struct {
+		lines [][3]string
+		want  int
+	}{
+		{[][3]string{{"", ".globl", "main"}, {"", ".type", "main, @function"}}, 0},
+		{[][3]string{{"", ".data", ""}, {"l1:", ".word", "1, -2147483648, 0xffffffff, l1"}}, 0},
+		{[][3]string{{"", ".data", ""}, {"", ".word", "0x100000000, l2"}}, 2},
+		{[][3]string{{"", ".data", ""}, {"", ".half", "-32768, 65535, 65536"}}, 1},
+		{[][3]string{{"", ".data", ""}, {"", ".byte", "-128, 255, 256, 'a', '\\n', 'ab'"}}, 2},
+		{[][3]string{{"", ".data", ""}, {"", ".byte", ""}}, 1},
+		{[][3]string{{"", ".data", ""}, {"", ".string", `"a\tb", "\0"`}, {"", ".ascii", `"abc`}}, 1},
+		{[][3]string{{"", ".bss", ""}, {"", ".space", "16"}, {"", ".zero", "0x100000"}}, 1},
+		{[][3]string{{"", ".data", ""}, {"", ".align", "12"}, {"", ".align", "13"}}, 1},
+		{[][3]string{{"", ".align", "2"}, {"", ".align", "3"}}, 1},
+		{[][3]string{{"", ".word", "1"}}, 1},
+		{[][3]string{{"", ".data", ""}, {"", "addi", "x0, x0, 0"}}, 1},
+		{[][3]string{{"", ".section", ""}}, 1},
+	}
+
+	for _, v := range cases {
+		rec := &StringRecorder{[]string{}}
+		sim.validationError = rec
+
+		valid := sim.validate(v.lines).valid()
+		if valid != (v.want == 0) || len(rec.messages) != v.want {
+			t.Errorf("%v valid=%v %v", v.lines, valid, rec.messages)
+		}
+	}
+
+	rec := &StringRecorder{[]string{}}
+	sim = NewSimulator("", dataBase-4, nil, rec)
+	lines := [][3]string{{"", "addi", "x0, x0, 0"}, {"", "addi", "x0, x0, 0"}, {"", ".data", ""}, {"", ".word", "1"}}
+	if sim.validate(lines).valid() || len(rec.messages) != 1 {
+		t.Errorf("text overlaps data %v", rec.messages)
+	}
+}
+
+func TestMacro(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.s": `.include "lib/macros.s"
+main:
+	push x5
+	countdown x6, 3
+	countdown x7, 2
+	pop x8
+`,
+		"lib/macros.s": `# stack
+.macro push reg
+	addi sp, sp, -4
+	sw \reg, 0(sp)
+.endm
+.macro pop reg
+	lw \reg, 0(sp)
+	addi sp, sp, 4
+.endm
+.include "loop.s"
+`,
+		"lib/loop.s": `.macro countdown reg, n
+	li \reg, \n
+loop\@:
+	addi \reg, \reg, -1
+	bnez \reg, loop\@
+.endm
+`,
+	}
+	for k, v := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, k)), 0o755)
+		if err := os.WriteFile(filepath.Join(dir, k), []byte(v), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileName := filepath.Join(dir, "main.s")
+	w := &StringRecorder{[]string{}}
+	handler := NewSimulatorHandler(fileName, entryPoint)
+	sim := NewSimulator(fileName, handler.entryPoint, handler.singlePage, w)
+	handler.sims[handler.sharedId] = sim
+	sim.init()
+	sim.view.setStatus(ready)
+	if sim.view.Failed {
+		t.Fatalf("failed %v", w.messages)
+	}
+	if sim.labelMapping["main"] != sim.entryPoint || sim.labelMapping["loop1"] != sim.entryPoint+12 || sim.labelMapping["loop2"] != sim.entryPoint+24 {
+		t.Errorf("labelMapping = %v", sim.labelMapping)
+	}
+	if inst := sim.instructions[1]; inst.Mnemonic != "sw" || inst.Operand != "x5,0(sp)" {
+		t.Errorf("listing = %v", inst)
+	}
+
+	sim.registers[5] = 42
+	sim.registers[2] = 0x8000
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.registers[6] != 0 || sim.registers[7] != 0 || sim.registers[8] != 42 || sim.registers[2] != 0x8000 {
+		t.Errorf("registers = %v", sim.registers[:9])
+	}
+
+	// the original file and line
+	cases := []struct {
+		source string
+		want   []string
+	}{
+		{".include \"none.s\"", []string{"main.s:1 open "}},
+		{".include \"main.s\"", []string{"main.s:1 recursive include("}},
+		{".macro m a\naddi \\a, x0, 1\n.endm\nm x55", []string{"main.s:2 invalid rd(x55) in macro(m) invoked at "}},
+		{".macro m a\nnop\n.endm\nm", []string{"main.s:4 macro(m) expects 1 arguments"}},
+		{".macro m\nnop\n.endm\n.macro M\n.endm", []string{"main.s:4 macro duplicated(M)"}},
+		{".macro m\nm\n.endm\nm", []string{"main.s:2 macro(m) nested too deep in macro(m) invoked at "}},
+		{".macro m\nnop", []string{"main.s:1 missing .endm(m)"}},
+		{".endm", []string{"main.s:1 unexpected .endm"}},
+		{".include \"lib/bad.s\"\naddi x5, x0, 4096", []string{"bad.s:2 invalid rd(x66)", "main.s:2 invalid immediate(4096)"}},
+	}
+	os.WriteFile(filepath.Join(dir, "lib/bad.s"), []byte("\naddi x66, x0, 0\n"), 0o644)
+	for _, v := range cases {
+		os.WriteFile(fileName, []byte(v.source), 0o644)
+		w := &StringRecorder{[]string{}}
+		sim := NewSimulator(fileName, entryPoint, nil, w)
+		sim.init()
+		if !sim.view.Failed || len(w.messages) != len(v.want) {
+			t.Errorf("%q %v", v.source, w.messages)
+			continue
+		}
+		for i, want := range v.want {
+			if !strings.Contains(w.messages[i], string(filepath.Separator)+want) {
+				t.Errorf("%q %s, want %s", v.source, w.messages[i], want)
+			}
+		}
+	}
+
+	// at the body line with the invocation. the columns are of the body line
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "sub/m.inc"), []byte(".macro addz rd\n\tnop\n\n\taddi \\rd, x0, 0\n.endm\n.macro twice rd\n\taddz \\rd\n.endm\n"), 0o644)
+	os.WriteFile(fileName, []byte(".include \"sub/m.inc\"\nmain:\n\taddz x55\n\ttwice x66\n"), 0o644)
+	sim = NewSimulator(fileName, entryPoint, nil, nil)
+	sim.init()
+	include := filepath.Join(dir, "sub", "m.inc")
+	want := []string{
+		"invalid rd(x55) in macro(addz) invoked at " + fileName + ":3",
+		"invalid rd(x66) in macro(addz) invoked at " + include + ":7, expanded from " + fileName + ":4",
+	}
+	if len(sim.diagnostics) != len(want) {
+		t.Fatalf("%+v", sim.diagnostics)
+	}
+	for i, v := range sim.diagnostics {
+		if v.FileName != include || v.LineNo != 4 || v.Column != 7 || v.Message != want[i] {
+			t.Errorf("%+v, want %s", v, want[i])
+		}
+	}
+}
+
+func TestLocalLabel(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"", "li", "x5, 3"},
+		{"1:", "addi", "x5, x5, -1"},
+		{"", "addi", "x6, x6, 1"},
+		{"", "bnez", "x5, 1b"},
+		{"", "j", "1f"},
+		{"", "addi", "x6, x0, -1"},
+		{"1:", "li", "x7, 2"},
+		{"1:", "addi", "x7, x7, -1"},
+		{"", "beq", "x7, x0, 2f"},
+		{"", "jal", "x0, 1b"},
+		{"2:", "la", "x8, 1f"},
+		{"", "lw", "x9, 0(x8)"},
+		{"", ".data", ""},
+		{"1:", ".word", "1b - 2b"},
+	}
+
+	rec := &StringRecorder{[]string{}}
+	sim.validationError = rec
+	if !sim.validate(lines).valid() {
+		t.Fatalf("invalid %v", rec.messages)
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	if len(sim.labelMapping) != 0 {
+		t.Errorf("labelMapping = %v", sim.labelMapping)
+	}
+	if sim.instructions[1].Label != "1:" || sim.instructions[3].Operand != "x5,x0,1b" || sim.instructions[4].Operand != "x0,1f" {
+		t.Errorf("listing = %v", sim.instructions[:5])
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.registers[5] != 0 || sim.registers[6] != 3 || sim.registers[7] != 0 || sim.registers[8] != dataBase || sim.registers[9] != dataBase-(sim.entryPoint+40) {
+		t.Errorf("registers = %v", sim.registers[5:10])
+	}
+
+	invalid := []struct {
+		lines   [][3]string
+		message string
+	}{
+		{[][3]string{{"1:", "j", "1f"}}, "label not found(1f:)"},
+		{[][3]string{{"", "j", "1b"}, {"1:", "nop", ""}}, "label not found(1b:)"},
+		{[][3]string{{"", "addi", "x5, x0, 2f"}}, "invalid immediate(2f) undefined symbol(2f)"},
+		{[][3]string{{"1x:", "nop", ""}}, "invalid label(1x:)"},
+	}
+	for _, v := range invalid {
+		rec := &StringRecorder{[]string{}}
+		sim.validationError = rec
+		if sim.validate(v.lines).valid() || len(rec.messages) != 1 || !strings.HasSuffix(strings.TrimSpace(rec.messages[0]), v.message) {
+			t.Errorf("%v %v", v.lines, rec.messages)
+		}
+	}
+
+	locals := LocalLabels{}
+	for i := range 1000 {
+		locals.define("1", i*2, uint32(i*8))
+	}
+	for _, v := range []struct {
+		name  string
+		index int
+		addr  uint32
+		ok    bool
+	}{
+		{"1b", 0, 0, true}, {"1f", 0, 8, true}, {"1b", 5, 16, true}, {"1f", 5, 24, true},
+		{"1b", 1998, 7992, true}, {"1f", 1998, 0, false}, {"1b", -1, 0, false}, {"2b", 5, 0, false},
+	} {
+		if addr, ok := locals.resolve(v.name, v.index); addr != v.addr || ok != v.ok {
+			t.Errorf("%s at %d = 0x%x %v", v.name, v.index, addr, ok)
+		}
+	}
+}
+
+func TestDiagnostic(t *testing.T) {
+	sim := NewSimulator("main.s", entryPoint, nil, nil) // no sink
+
+	cases := []struct {
+		lines [][3]string
+		want  Diagnostic
+	}{
+		{[][3]string{{"", "addi", "x5, x55, 1"}}, Diagnostic{"main.s", 1, 10, 13, SeverityError, "invalid-rs1", "invalid rs1(x55)"}},
+		{[][3]string{{"", "addi", "x5, x0, 1<<12"}}, Diagnostic{"main.s", 1, 14, 19, SeverityError, "invalid-immediate", "invalid immediate(1<<12 = 4096) 12 bit signed integer"}},
+		{[][3]string{{"", "nop", ""}, {"", "jal", "x0, end"}}, Diagnostic{"main.s", 2, 9, 12, SeverityError, "label-not-found", "label not found(end:)"}},
+		{[][3]string{{"", "ecall", "x1"}}, Diagnostic{"main.s", 1, 7, 9, SeverityError, "parse-failed", "parse failed(x1)"}},
+		{[][3]string{{"", "foo", "x1"}}, Diagnostic{"main.s", 1, 1, 4, SeverityError, "unknown-instruction", "unknown instruction(foo)"}},
+		{[][3]string{{"", "beq", "x5, x6, x6"}}, Diagnostic{"main.s", 1, 13, 15, SeverityError, "label-not-found", "label not found(x6:)"}},
+		{[][3]string{{"", "bgt", "x5, x55, l"}, {"l:", "", ""}}, Diagnostic{"main.s", 1, 9, 12, SeverityError, "invalid-rs1", "invalid rs1(x55)"}},
+		{[][3]string{{"", "jalr", "(x55)"}}, Diagnostic{"main.s", 1, 6, 11, SeverityError, "invalid-rs1", "invalid rs1(x55)"}},
+		{[][3]string{{"", ".data", ""}, {"", "nop", ""}}, Diagnostic{"main.s", 2, 1, 4, SeverityError, "misplaced-instruction", "instruction(nop) in .data section"}},
+	}
+	for _, v := range cases {
+		diagnostics := sim.validate(v.lines)
+		if diagnostics.valid() || len(diagnostics) != 1 || diagnostics[0] != v.want {
+			t.Errorf("%v %+v, want %+v", v.lines, diagnostics, v.want)
+		}
+	}
+
+	// next to the source line
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "main.s")
+	os.WriteFile(fileName, []byte("nop\n\taddi x5, x55, 1\n"), 0o644)
+	rec := &StringRecorder{[]string{}}
+	sim = NewSimulator(fileName, entryPoint, nil, rec)
+	sim.init()
+	want := DiagnosticRow{fileName + ":2:11", SeverityError, "invalid-rs1", "invalid rs1(x55)", "\taddi x5, x55, 1", "\t         ^~~", ColorWrite}
+	if !sim.view.Failed || len(sim.view.Diagnostics) != 1 || sim.view.Diagnostics[0] != want {
+		t.Errorf("%+v, want %+v", sim.view.Diagnostics, want)
+	}
+	if len(rec.messages) != 1 { // also to the sink
+		t.Errorf("messages = %v", rec.messages)
+	}
+}
+
+func TestLint(t *testing.T) {
+	lines := [][3]string{
+		{"main:", "addi", "x0, x5, 1"}, // 1 ineffective write
+		{"", "nop", ""},
+		{"", "call", "f"},
+		{"", "jal", "g"},
+		{"", "beq", "x5, x6, far"}, // 5 beyond the end
+		{"", "jalr", "x0, 0(t3)"},  // 6 never written
+		{"", "j", "main"},
+		{"", "addi", "x5, x5, 1"}, // 8 unreachable
+		{"", "addi", "x5, x5, 1"},
+		{"unused:", "addi", "x5, x5, 1"}, // 10 unused label
+		{"f:", "addi", "sp, sp, -4"},
+		{"", "sw", "s0, 0(sp)"},
+		{"", "addi", "s0, sp, 4"},
+		{"", "lw", "s0, 0(sp)"},
+		{"", "addi", "sp, sp, 4"},
+		{"", "ret", ""},
+		{"g:", "li", "s1, 1"}, // 17 not restored
+		{"", "ret", ""},
+		{"end:", "", ""},
+		{"", ".equ", "far, end+8"},
+	}
+	want := [][2]string{{"1", "ineffective-write"}, {"5", "target-out-of-range"}, {"6", "unwritten-register"}, {"8", "unreachable-instruction"}, {"17", "callee-saved-register-clobbered"}, {"10", "unused-label"}}
+
+	sim := NewSimulator("main.s", entryPoint, nil, nil)
+	if !sim.validate(lines).valid() {
+		t.Fatal("invalid")
+	}
+	sim.load(lines)
+	diagnostics := sim.lint(lines)
+	if !diagnostics.valid() || len(diagnostics) != len(want) {
+		t.Fatalf("%+v", diagnostics)
+	}
+	for i, v := range diagnostics {
+		if strconv.Itoa(v.LineNo) != want[i][0] || v.Code != want[i][1] || v.Severity != SeverityWarning {
+			t.Errorf("%+v, want %v", v, want[i])
+		}
+	}
+
+	// jal x0, end to the label after the last instruction
+	sim = NewSimulator("examples/ex01.asm", entryPoint, nil, nil)
+	sim.init()
+	if sim.view.Failed || len(sim.view.Diagnostics) != 0 {
+		t.Errorf("failed = %v %+v", sim.view.Failed, sim.view.Diagnostics)
+	}
+
+	// not blocking RUN
+	fileName := filepath.Join(t.TempDir(), "main.s")
+	os.WriteFile(fileName, []byte("addi x0, x0, 1\n"), 0o644)
+	sim = NewSimulator(fileName, entryPoint, nil, nil)
+	sim.init()
+	sim.view.setStatus(ready)
+	if sim.view.Failed || len(sim.view.Diagnostics) != 1 || sim.view.Diagnostics[0].Color != ColorRead {
+		t.Errorf("failed = %v %+v", sim.view.Failed, sim.view.Diagnostics)
+	}
+}
+
+func TestLanguageServer(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "main.s") // not saved
+	uri := pathURI(fileName)
+	text := "main:\n    addi x55, x0, 1\n    j    loop\nloop:  addi a0, a0, -1\n    bnez a0, loop\n"
+
+	in := &bytes.Buffer{}
+	requests := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":%q,"text":%q}}}`, uri, text),
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":2,"method":"textDocument/definition","params":{"textDocument":{"uri":%q},"position":{"line":4,"character":14}}}`, uri),
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":3,"method":"textDocument/references","params":{"textDocument":{"uri":%q},"position":{"line":3,"character":1},"context":{"includeDeclaration":true}}}`, uri),
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":4,"method":"textDocument/hover","params":{"textDocument":{"uri":%q},"position":{"line":1,"character":5}}}`, uri),
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":5,"method":"textDocument/completion","params":{"textDocument":{"uri":%q},"position":{"line":1,"character":9}}}`, uri),
+		`{"jsonrpc":"2.0","id":6,"method":"unknown","params":{}}`,
+		`{"jsonrpc":"2.0","id":7,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	}
+	for _, v := range requests {
+		fmt.Fprintf(in, "Content-Length: %d\r\n\r\n%s", len(v), v)
+	}
+	out := &bytes.Buffer{}
+	if err := NewLanguageServer(in, out).serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	type message struct {
+		ID     int             `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Result json.RawMessage `json:"result"`
+		Error  *ResponseError  `json:"error"`
+	}
+	messages := []message{}
+	ls := NewLanguageServer(out, nil)
+	for {
+		body, err := ls.read()
+		if err != nil {
+			break
+		}
+		var m message
+		json.Unmarshal(body, &m)
+		messages = append(messages, m)
+	}
+	if len(messages) != 8 {
+		t.Fatalf("messages = %d", len(messages))
+	}
+
+	var diagnostics struct {
+		URI         string `json:"uri"`
+		Diagnostics []struct {
+			Range    Range  `json:"range"`
+			Severity int    `json:"severity"`
+			Code     string `json:"code"`
+		} `json:"diagnostics"`
+	}
+	json.Unmarshal(messages[1].Params, &diagnostics)
+	if messages[1].Method != "textDocument/publishDiagnostics" || diagnostics.URI != uri || len(diagnostics.Diagnostics) != 1 {
+		t.Fatalf("%s %s", messages[1].Method, messages[1].Params)
+	}
+	if v := diagnostics.Diagnostics[0]; v.Range != (Range{Position{1, 9}, Position{1, 12}}) || v.Severity != 1 || v.Code != "invalid-rd" {
+		t.Errorf("%+v", v)
+	}
+
+	var definition, references []Location
+	json.Unmarshal(messages[2].Result, &definition)
+	json.Unmarshal(messages[3].Result, &references)
+	if len(definition) != 1 || definition[0].Range != (Range{Position{3, 0}, Position{3, 4}}) {
+		t.Errorf("definition = %+v", definition)
+	}
+	if len(references) != 3 {
+		t.Errorf("references = %+v", references)
+	}
 
-	var x [32]uint32
-	for i := range x {
-		x[i] = uint32(i*100 + i)
+	var hover struct {
+		Contents struct {
+			Value string `json:"value"`
+		} `json:"contents"`
+		Range Range `json:"range"`
+	}
+	json.Unmarshal(messages[4].Result, &hover)
+	if !strings.Contains(hover.Contents.Value, instructionHelp["addi"][1]) || hover.Range != (Range{Position{1, 4}, Position{1, 8}}) {
+		t.Errorf("hover = %+v", hover)
 	}
-	x[5] = x[6]
-	x[8] = 0xfffffff8
-	labelMap := map[string]uint32{}
-	labelMap["l1"] = sim.entryPoint + 0x40
 
-	base := sim.entryPoint
-	cases := []struct {
-		mnemonic string
-		operand  string
-		want     uint32
-	}{
-		{"beq ", "x5, x6, l1", labelMap["l1"]},
-		{"beq ", "x5, x7, l1", base + 4},
-		{"bne ", "x5, x6, l1", base + 4},
-		{"bne ", "x5, x7, l1", labelMap["l1"]},
-		{"blt ", "x5, x4, l1", base + 4},
-		{"blt ", "x5, x6, l1", base + 4},
-		{"blt ", "x5, x7, l1", labelMap["l1"]},
-		{"blt ", "x8, x9, l1", labelMap["l1"]},
-		{"bltu", "x5, x4, l1", base + 4},
-		{"bltu", "x5, x6, l1", base + 4},
-		{"bltu", "x5, x7, l1", labelMap["l1"]},
-		{"bltu", "x8, x9, l1", base + 4},
-		{"bge ", "x5, x4, l1", labelMap["l1"]},
-		{"bge ", "x5, x6, l1", labelMap["l1"]},
-		{"bge ", "x5, x7, l1", base + 4},
-		{"bge ", "x8, x9, l1", base + 4},
-		{"bgeu", "x5, x4, l1", labelMap["l1"]},
-		{"bgeu", "x5, x6, l1", labelMap["l1"]},
-		{"bgeu", "x5, x7, l1", base + 4},
-		{"bgeu", "x8, x9, l1", labelMap["l1"]},
+	var items []struct {
+		Label string `json:"label"`
+	}
+	json.Unmarshal(messages[5].Result, &items)
+	if len(items) != len(registerMapping) {
+		t.Errorf("completion = %d", len(items))
 	}
 
-	for _, v := range cases {
-		mnemonic := strings.TrimSpace(v.mnemonic)
+	if messages[6].Error == nil || messages[6].Error.Code != methodNotFound || messages[7].ID != 7 || messages[7].Error != nil {
+		t.Errorf("%+v %+v", messages[6], messages[7])
+	}
+}
 
-		sim.load([][3]string{[...]string{"", mnemonic, v.operand}})
-		sim.reset()
-		sim.view.Disabled.Step = false
-		sim.registers = x
-		sim.labelMapping = labelMap
+func TestLanguageServerMissingFile(t *testing.T) {
+	uri := pathURI(filepath.Join(t.TempDir(), "main.s")) // neither opened nor saved
+	request := fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":%q},"contentChanges":[]}}`, uri)
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	fmt.Fprintf(in, "Content-Length: %d\r\n\r\n%s", len(request), request)
+	if err := NewLanguageServer(in, out).serve(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "textDocument/publishDiagnostics") || !strings.Contains(out.String(), `"code":"invalid-file"`) {
+		t.Errorf("%s", out)
+	}
+}
 
-		w := httptest.NewRecorder()
-		handler.ServeHTTP(w, newRequest("button=STEP"))
+func TestTestCommand(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	if status := testCommand([]string{"examples/ex01.asm"}, strings.NewReader(""), stdout, io.Discard); status != 0 {
+		t.Errorf("status = %d %s", status, stdout)
+	}
+	if stdout.String() != "TAP version 13\n1..1\nok 1 - examples/ex01.asm:33 mem[0x0..0x6] == \"RISC-V\"\n" {
+		t.Errorf("%q", stdout)
+	}
 
-		if w.Code != http.StatusOK {
-			t.Fatalf("%s %s Code = %d", mnemonic, v.operand, w.Code)
-		}
-		if sim.pc != v.want {
-			t.Errorf("%s %s pc = %x, want %x", mnemonic, v.operand, sim.pc, v.want)
-		}
-		if sim.registers != x {
-			t.Errorf("%s %s registers = %x, want %x", mnemonic, v.operand, sim.registers, x)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "main.s")
+	os.WriteFile(fileName, []byte(`    li a0, -1          # expect: a0 == 0xffffffff && a0 < 0
+    li t1, 6           # expect: t1 > 5 || a0 == 0
+    la t2, msg         # expect: t2 == msg
+    sb a0, 0x104(x0)   # expect: mem[0x104] == 255
+    sh t1, 0x108(x0)   # expect: mem[0x108..0x10a] == "\x06\0"
+    li a7, 17          # expect: a0 == 42
+    ecall              # expect: exitcode == -1
+.data
+msg: .string "hi"      # expect: mem[msg..msg+2] == "ho"
+# expect: a0 >> 1
+`), 0o644)
+
+	stdout.Reset()
+	if status := testCommand([]string{fileName}, strings.NewReader(""), stdout, io.Discard); status != 1 {
+		t.Errorf("status = %d", status)
+	}
+	failed := []string{}
+	for _, v := range strings.Split(stdout.String(), "\n") {
+		if message, ok := strings.CutPrefix(v, "  message: "); ok {
+			failed = append(failed, message)
+		} else if strings.HasPrefix(v, "not ok") {
+			failed = append(failed, v[strings.LastIndex(v, " ")+1:])
 		}
 	}
+	if want := []string{"42", `"got a0 = -1 (0xffffffff)"`, `"ho"`, `"got mem[msg..msg+2] = \"hi\""`, "1", `"invalid condition(a0 >> 1) comparison operator not found"`}; !slices.Equal(failed, want) {
+		t.Errorf("%q", failed)
+	}
+
+	stdout.Reset()
+	testCommand([]string{"-format", "junit", fileName}, strings.NewReader(""), stdout, io.Discard)
+	var suites struct {
+		Suites []struct {
+			Tests    int `xml:"tests,attr"`
+			Failures int `xml:"failures,attr"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(stdout.Bytes(), &suites); err != nil || len(suites.Suites) != 1 || suites.Suites[0].Tests != 9 || suites.Suites[0].Failures != 3 {
+		t.Errorf("%v %+v", err, suites)
+	}
+
+	invalid := filepath.Join(dir, "bad.s")
+	os.WriteFile(invalid, []byte("    addi a0, a0\n"), 0o644)
+	stdout.Reset()
+	if status := testCommand([]string{invalid}, strings.NewReader(""), stdout, io.Discard); status != 1 || !strings.Contains(stdout.String(), "1..1\nnot ok 1 - "+invalid+":0") {
+		t.Errorf("status = %d %s", status, stdout)
+	}
 }
 
 func TestValidateInstruction(t *testing.T) {
@@ -348,6 +1790,9 @@ func TestValidateInstruction(t *testing.T) {
 		{[]string{"add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu"}, "x2", 1},
 		{[]string{"add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu"}, "x2, x3", 1},
 		{[]string{"add", "sub", "and", "or", "xor", "sll", "srl", "sra", "slt", "sltu"}, "x2, x3, x4, x5", 1},
+		{[]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}, "x2, x3, x4", 0},
+		{[]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}, "x32, x33, 4", 3},
+		{[]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}, "x2, x3", 1},
 		{[]string{"addi", "andi", "ori", "xori"}, "x2, x3, 4", 0},
 		{[]string{"addi", "andi", "ori", "xori"}, "x32, x33, x4", 3},
 		{[]string{"addi", "andi", "ori", "xori"}, "x32, x3, 4", 1},
@@ -442,7 +1887,49 @@ func TestValidateInstruction(t *testing.T) {
 		{[]string{"lbu", "lb", "lhu", "lh", "lw"}, "x2, -2048(x3)", 0},
 		{[]string{"lbu", "lb", "lhu", "lh", "lw"}, "x2, -2049(x3)", 1},
 		{[]string{"lbu", "lb", "lhu", "lh", "lw"}, "x2	 ,	 2047  (	x3	 )", 0},
-		{[]string{"ecall", "ebreak", "fence", "csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci", "fence.i", "123"}, "", 1},
+		{[]string{"ecall", "ebreak", "fence"}, "", 0},
+		{[]string{"ecall", "ebreak", "mret"}, "", 0},
+		{[]string{"ecall", "ebreak", "mret"}, "x1", 1},
+		{[]string{"fence"}, "iorw, iorw", 0},
+		{[]string{"fence"}, "r, w", 0},
+		{[]string{"fence"}, "rw", 1},
+		{[]string{"fence"}, "rx, w", 1},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, mscratch, x6", 0},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, 0x340, x6", 0},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, 0x7c0, x6", 0}, // unimplemented. illegal instruction at runtime
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, 0x1000, x6", 1},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, MSCRATCH, x6", 1},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x55, mscratch, x66", 2},
+		{[]string{"csrrw", "csrrs", "csrrc"}, "x5, cycle, x6", 0}, // read-only. illegal instruction at runtime
+		{[]string{"csrrs", "csrrc"}, "x5, cycle, x0", 0},
+		{[]string{"csrrwi", "csrrsi", "csrrci"}, "x5, mtvec, 31", 0},
+		{[]string{"csrrwi", "csrrsi", "csrrci"}, "x5, mtvec, 32", 1},
+		{[]string{"csrrwi", "csrrsi", "csrrci"}, "x5, mtvec, x6", 1},
+		{[]string{"csrrwi", "csrrsi", "csrrci"}, "x5, instret, 1", 0}, // read-only. illegal instruction at runtime
+		{[]string{"csrrsi", "csrrci"}, "x5, instret, 0", 0},
+		{[]string{"csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci", "fence.i", "123"}, "", 1},
+		{[]string{"nop", "ret"}, "", 0},
+		{[]string{"nop", "ret"}, "x1", 1},
+		{[]string{"li"}, "x5, 0x12345678", 0},
+		{[]string{"li"}, "x5, -2147483648", 0},
+		{[]string{"li"}, "x5, 0xffffffff", 0},
+		{[]string{"li"}, "x5, 0x100000000", 1},
+		{[]string{"li"}, "x55, l2", 2},
+		{[]string{"li", "la"}, "x5", 1},
+		{[]string{"la"}, "x5, l1", 0},
+		{[]string{"la"}, "x55, l2", 2},
+		{[]string{"j", "call", "tail"}, "l1", 0},
+		{[]string{"j", "call", "tail"}, "l2", 1},
+		{[]string{"j", "call", "tail"}, "x1, l1", 1},
+		{[]string{"jr"}, "x5", 0},
+		{[]string{"jr"}, "x55", 1},
+		{[]string{"mv", "not", "neg", "seqz", "snez", "sltz", "sgtz"}, "x5, x6", 0},
+		{[]string{"mv", "not", "neg", "seqz", "snez", "sltz", "sgtz"}, "x5, x66", 1},
+		{[]string{"mv", "not", "neg", "seqz", "snez", "sltz", "sgtz"}, "x5", 1},
+		{[]string{"beqz", "bnez", "blez", "bgez", "bltz", "bgtz"}, "x5, l1", 0},
+		{[]string{"beqz", "bnez", "blez", "bgez", "bltz", "bgtz"}, "x5, l2", 1},
+		{[]string{"bgt", "ble", "bgtu", "bleu"}, "x5, x6, l1", 0},
+		{[]string{"bgt", "ble", "bgtu", "bleu"}, "x5, x66, l2", 2},
 	}
 
 	for _, v := range cases {
@@ -450,7 +1937,7 @@ func TestValidateInstruction(t *testing.T) {
 			rec := &StringRecorder{[]string{}}
 			sim.validationError = rec
 
-			valid := sim.validate([][3]string{[...]string{"l1:", mnemonic, v.operand}})
+			valid := sim.validate([][3]string{[...]string{"l1:", mnemonic, v.operand}}).valid()
 			if valid != (v.want == 0) || len(rec.messages) != v.want {
 				t.Errorf("%s %s valid=%v(%d)", mnemonic, v.operand, valid, len(rec.messages))
 			}
@@ -464,7 +1951,10 @@ func TestSplitLine(t *testing.T) {
 		definedLabel, mnemonic, operand string
 	}{
 		{``, "", "", ""},
-		{`.text`, "", "", ""},
+		{`.text`, "", ".text", ""},
+		{`.globl main`, "", ".globl", "main"},
+		{`msg: .asciz "a:b # c" # comment`, "msg:", ".asciz", `"a:b # c"`},
+		{`.byte ';', '\'' ; comment`, "", ".byte", `';', '\''`},
 		{`.l1:`, ".l1:", "", ""},
 		{`addi x5,x5,1`, "", "addi", "x5,x5,1"},
 		{`addi x5, x5, 1`, "", "addi", "x5, x5, 1"},
@@ -517,7 +2007,7 @@ func TestValidateDefinedLabel(t *testing.T) {
 	}
 
 	for _, v := range cases {
-		valid := sim.validate([][3]string{[...]string{v.definedLabel, "", ""}})
+		valid := sim.validate([][3]string{[...]string{v.definedLabel, "", ""}}).valid()
 		if valid != v.want {
 			t.Errorf("%s %v", v.definedLabel, valid)
 		}
@@ -532,7 +2022,7 @@ func TestValidateDefinedLabelDuplicated(t *testing.T) {
 		[...]string{"l1:", "addi", "x5, x5, 1"},
 	}
 
-	if sim.validate(lines) != false {
+	if sim.validate(lines).valid() != false {
 		t.Errorf("was through. [%s]", lines[0][0])
 	}
 }
@@ -562,6 +2052,140 @@ func TestFormat(t *testing.T) {
 	}
 }
 
+func TestFormatSource(t *testing.T) {
+	src := ".text\n  ADDI a0,zero,1 # one\nloop:\taddi  a0 , a0, -1\n\tbnez a0,loop   ; two\n    # three\nmsg: .asciz \"a,  b\"  # four\n"
+	cases := []struct {
+		registers    string
+		mnemonicCase string
+		want         string
+	}{
+		{"", "lower", ".text\n        addi    a0, zero, 1     # one\nloop:   addi    a0, a0, -1\n        bnez    a0, loop        ; two\n        # three\nmsg:    .asciz  \"a,  b\"         # four\n"},
+		{"x", "upper", ".text\n        ADDI    x10, x0, 1      # one\nloop:   ADDI    x10, x10, -1\n        BNEZ    x10, loop       ; two\n        # three\nmsg:    .asciz  \"a,  b\"         # four\n"},
+		{"abi", "lower", ".text\n        addi    a0, zero, 1     # one\nloop:   addi    a0, a0, -1\n        bnez    a0, loop        ; two\n        # three\nmsg:    .asciz  \"a,  b\"         # four\n"},
+	}
+	for _, v := range cases {
+		got := formatSource(src, v.registers, v.mnemonicCase)
+		if got != v.want {
+			t.Errorf("%s %s\n%s", v.registers, v.mnemonicCase, got)
+		}
+		if formatSource(got, v.registers, v.mnemonicCase) != got {
+			t.Errorf("not idempotent\n%s", got)
+		}
+	}
+
+	for _, fileName := range []string{"examples/ex01.asm", "examples/ex02.asm"} {
+		b, _ := os.ReadFile(fileName)
+		formatted := formatSource(string(b), "", "lower")
+		if !slices.Equal(splitLines(string(b)), splitLines(formatted)) {
+			t.Errorf("%s changed", fileName)
+		}
+	}
+}
+
+// the parsed lines without the comments
+func splitLines(src string) [][3]string {
+	lines := [][3]string{}
+	for _, v := range strings.Split(src, "\n") {
+		lines = append(lines, splitLine(v))
+	}
+	return lines
+}
+
+func TestFmtCommand(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "main.s")
+	os.WriteFile(fileName, []byte("addi a0,a0,1\n"), 0o644)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if status := fmtCommand([]string{"-l", fileName}, stdout, stderr); status != 1 || stdout.String() != fileName+"\n" {
+		t.Errorf("-l %d %q %q", status, stdout, stderr)
+	}
+	stdout.Reset()
+	if status := fmtCommand([]string{"-d", "-regs", "x", fileName}, stdout, stderr); status != 1 || !strings.Contains(stdout.String(), "-addi a0,a0,1\n+    addi    x10, x10, 1\n") {
+		t.Errorf("-d %d %q %q", status, stdout, stderr)
+	}
+	stdout.Reset()
+	if status := fmtCommand([]string{fileName}, stdout, stderr); status != 0 || stdout.Len() != 0 {
+		t.Errorf("%d %q %q", status, stdout, stderr)
+	}
+	if b, _ := os.ReadFile(fileName); string(b) != "    addi    a0, a0, 1\n" {
+		t.Errorf("rewritten %q", b)
+	}
+	if status := fmtCommand([]string{"-l", fileName}, stdout, stderr); status != 0 || stdout.Len() != 0 {
+		t.Errorf("-l %d %q", status, stdout)
+	}
+	if status := fmtCommand([]string{"-regs", "y", fileName}, stdout, io.Discard); status != 2 {
+		t.Errorf("-regs y %d", status)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "main.s")
+	os.WriteFile(fileName, []byte("li a0, 42\nsw a0, 0x104(x0)\nli a7, 1\necall\nli a7, 17\nli a0, 3\necall\n"), 0o644)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if status := runCommand([]string{"-json", fileName}, strings.NewReader(""), stdout, stderr); status != 0 {
+		t.Fatalf("status = %d %s", status, stderr)
+	}
+	var result RunResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "exited" || *result.ExitCode != 3 || result.Console != "42" || result.Registers[10] != 3 {
+		t.Errorf("%+v", result)
+	}
+	if len(result.Memory) != 1 || result.Memory[0] != (MemoryDump{0x100, "00 00 00 00 2a 00 00 00 00 00 00 00 00 00 00 00"}) {
+		t.Errorf("memory = %v", result.Memory)
+	}
+
+	stdout.Reset()
+	if status := runCommand([]string{fileName}, strings.NewReader(""), stdout, stderr); status != 0 || !strings.HasPrefix(stdout.String(), "status: exited(3)\n") {
+		t.Errorf("status = %d %s", status, stdout)
+	}
+
+	stdout.Reset()
+	if status := runCommand([]string{"-syscalls", "linux", fileName}, strings.NewReader(""), stdout, stderr); status != 3 || !strings.HasPrefix(stdout.String(), "status: fault unknown system call(a7=1) in linux environment\n") {
+		t.Errorf("status = %d %s", status, stdout)
+	}
+	if status := runCommand([]string{"-syscalls", "spim", fileName}, strings.NewReader(""), io.Discard, io.Discard); status != 2 {
+		t.Errorf("status = %d", status)
+	}
+
+	dataFile := filepath.Join(dir, "data.s")
+	os.WriteFile(dataFile, []byte("la a0, msg\nlb a1, 0(a0)\n.data\nmsg: .byte 7\n"), 0o644)
+	stdout.Reset()
+	if status := runCommand([]string{"-json", "-data", "0x20000", dataFile}, strings.NewReader(""), stdout, stderr); status != 0 {
+		t.Errorf("status = %d %s", status, stderr)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil || result.Registers[10] != 0x20000 || result.Registers[11] != 7 {
+		t.Errorf("%v %+v", err, result)
+	}
+	if status := runCommand([]string{"-data", "0x20001", dataFile}, strings.NewReader(""), io.Discard, io.Discard); status != 2 {
+		t.Errorf("status = %d", status)
+	}
+
+	os.WriteFile(fileName, []byte("addi x55, x0, 1\n"), 0o644)
+	if status := runCommand([]string{fileName}, strings.NewReader(""), io.Discard, io.Discard); status != 1 {
+		t.Errorf("invalid status = %d", status)
+	}
+
+	os.WriteFile(fileName, []byte("loop: j loop\n"), 0o644)
+	sim := NewSimulator(fileName, entryPoint, nil, io.Discard)
+	sim.timeout, sim.maxSteps = time.Millisecond, 0
+	sim.init()
+	if result := sim.run(); result.Status != "timeout" {
+		t.Errorf("%+v", result)
+	}
+
+	stdout.Reset()
+	if status := runCommand([]string{"-json", "-steps", "1000", fileName}, strings.NewReader(""), stdout, io.Discard); status != 2 {
+		t.Errorf("status = %d", status)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil || result.Status != "limit" || result.Executed != 1000 {
+		t.Errorf("%v %+v", err, result)
+	}
+}
+
 func TestStatusCode(t *testing.T) {
 	handler, _ := newTestSimulatorHandler()
 
@@ -585,7 +2209,7 @@ func TestStatusCode(t *testing.T) {
 		{"POST", "/?", "", http.StatusNotFound},
 		{"GET", "/?button=STOP", "", http.StatusNotFound},
 		{"POST", "/?button=STOP", "", http.StatusNotFound},
-		{"POST", "/", "12345678901234567", http.StatusRequestEntityTooLarge},
+		{"POST", "/", strings.Repeat("1234567890", 103), http.StatusRequestEntityTooLarge},
 		{"GET", "/", "a", http.StatusBadRequest},
 		{"POST", "/", "", http.StatusBadRequest},
 		{"POST", "/", "a", http.StatusBadRequest},
@@ -617,6 +2241,7 @@ func TestDisabled(t *testing.T) {
 	}{
 		{"button=RUN", DisabledButton{true, false, false, false}, http.StatusBadRequest},
 		{"button=STEP", DisabledButton{false, true, false, false}, http.StatusBadRequest},
+		{"button=STEP10", DisabledButton{false, true, false, false}, http.StatusBadRequest},
 		{"button=STOP", DisabledButton{false, false, true, false}, http.StatusBadRequest},
 		{"button=STOP", DisabledButton{true, true, false, true}, http.StatusOK},
 		{"button=RELOAD", DisabledButton{false, false, false, true}, http.StatusBadRequest},
@@ -701,6 +2326,407 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunN(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+	sim.maxSteps = 1000
+
+	sim.load([][3]string{{"loop:", "addi", "x5, x5, 1"}, {"", "jal", "x0, loop"}, {"end:", "", ""}})
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STEP10"))
+	if sim.registers[5] != 5 || sim.view.Executed != 10 || sim.view.Limit {
+		t.Errorf("x5 = %d, executed = %d", sim.registers[5], sim.view.Executed)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RUN"))
+	if sim.registers[5] != 505 || sim.view.Executed != 1000 || !sim.view.Limit || sim.view.Timeout {
+		t.Errorf("x5 = %d, executed = %d", sim.registers[5], sim.view.Executed)
+	}
+	if sim.view.Disabled != running {
+		t.Errorf("disabled = %v", sim.view.Disabled)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STEP"))
+	if sim.view.Executed != 0 || sim.view.Limit {
+		t.Errorf("executed = %d", sim.view.Executed)
+	}
+
+	sim.maxSteps = 10 // the same as STEP10
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STEP10"))
+	if sim.view.Executed != 10 || sim.view.Limit {
+		t.Errorf("executed = %d", sim.view.Executed)
+	}
+
+	sim.timeout = time.Nanosecond // expires before the first instruction. the loop never ends
+	for _, req := range []string{RUN, STEP10, STEP100, OVER, OUT} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(req))
+		if w.Code != http.StatusOK || sim.view.Executed < 1 {
+			t.Errorf("%s Code = %d, executed = %d", req, w.Code, sim.view.Executed)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+	handler.maxSteps = 1000
+	sim.load([][3]string{{"loop:", "addi", "x5, x5, 1"}, {"", "jal", "x0, loop"}, {"end:", "", ""}})
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("steps=5&timeout=1m"))
+	if sim.maxSteps != 5 || sim.timeout != time.Minute || sim.view.MaxSteps != 5 || sim.view.TimeLimit != "1m0s" || sim.view.InputError != "" {
+		t.Errorf("steps = %d, timeout = %v %q", sim.maxSteps, sim.timeout, sim.view.InputError)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest(RUN))
+	if sim.view.Executed != 5 || !sim.view.Limit {
+		t.Errorf("executed = %d", sim.view.Executed)
+	}
+
+	for _, req := range []string{"steps=-1&timeout=1s", "steps=10&timeout=1", "timeout=-1s"} {
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(req))
+		if sim.maxSteps != 5 || sim.timeout != time.Minute || sim.view.InputError == "" {
+			t.Errorf("%s steps = %d, timeout = %v", req, sim.maxSteps, sim.timeout)
+		}
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("steps=0"))
+	if sim.maxSteps != 0 || sim.timeout != time.Minute || handler.maxSteps != 1000 {
+		t.Errorf("steps = %d, timeout = %v", sim.maxSteps, sim.timeout)
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "main.s")
+	source := "    li t0, 3\nloop:\n    addi a0, a0, 1\n    addi t0, t0, -1\n    bnez t0, loop\nend:\n"
+	os.WriteFile(fileName, []byte(source), 0o644)
+
+	handler := NewSimulatorHandler(fileName, entryPoint)
+	handler.init("shared")
+	sim := handler.sharedSimulator()
+	sim.validationError = io.Discard
+
+	for _, v := range []string{"break=00001001", "break=00002000", "break=zz"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(v))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s Code = %d", v, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("break=00001008"))
+	if _, ok := sim.breakpoints[0x1008]; w.Code != 200 || !ok || !sim.view.Codes[2].Breakpoint {
+		t.Fatalf("Code = %d, breakpoints = %v", w.Code, sim.breakpoints)
+	}
+
+	for i := 1; i <= 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("button=RUN"))
+		if sim.pc != 0x1008 || sim.registers[10] != uint32(i) || sim.view.Breakpoint != "0x00001008" {
+			t.Errorf("pc = %x, a0 = %d", sim.pc, sim.registers[10])
+		}
+	}
+	if !strings.Contains(w.Body.String(), "breakpoint(0x00001008)") {
+		t.Error(w.Body.String())
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=STOP"))
+	if _, ok := sim.breakpoints[0x1008]; !ok || sim.view.Breakpoint != "" {
+		t.Errorf("breakpoints = %v", sim.breakpoints)
+	}
+
+	os.WriteFile(fileName, []byte("    nop\n"+source), 0o644) // shifted
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RELOAD"))
+	if _, ok := sim.breakpoints[0x100c]; !ok || len(sim.breakpoints) != 1 || !sim.view.Codes[3].Breakpoint {
+		t.Errorf("breakpoints = %v", sim.breakpoints)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("break=0000100c"))
+	if len(sim.breakpoints) != 0 || sim.view.Codes[3].Breakpoint {
+		t.Errorf("breakpoints = %v", sim.breakpoints)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("break=00001000"))
+	os.WriteFile(fileName, []byte("    addi t0, x0, 1\n"), 0o644)
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("button=RELOAD"))
+	if len(sim.breakpoints) != 0 {
+		t.Errorf("breakpoints = %v", sim.breakpoints)
+	}
+}
+
+func TestDebugPoints(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	sim.load([][3]string{
+		{"", "addi", "t1, x0, 10"},
+		{"loop:", "addi", "t0, t0, 1"},
+		{"", "sw", "t0, 0x100(x0)"},
+		{"", "blt", "t0, t1, loop"},
+		{"", "addi", "a0, x0, 7"},
+		{"end:", "", ""},
+	})
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(body))
+		return w
+	}
+
+	post("at=loop%2B4&if=t0+%3D%3D+3")
+	if bp := sim.breakpoints[0x1008]; bp.Condition != "t0 == 3" || sim.view.Codes[2].Condition != "t0 == 3" {
+		t.Errorf("breakpoints = %v", sim.breakpoints)
+	}
+	post("button=RUN")
+	if sim.pc != 0x1008 || sim.registers[5] != 3 || sim.view.Breakpoint != "0x00001008" {
+		t.Errorf("pc = %x, t0 = %d", sim.pc, sim.registers[5])
+	}
+
+	for _, v := range []string{"at=0x2000", "at=loop&if=t0+%3D%3D", "watch=pc", "watch=a0&on=r", "watch=mem%5B0x100%5D&on=x"} {
+		if w := post(v); w.Code != 200 || sim.view.InputError == "" || !strings.Contains(w.Body.String(), "invalid") {
+			t.Errorf("%s Code = %d, InputError = %s", v, w.Code, sim.view.InputError)
+		}
+	}
+	if w := post("unwatch=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("Code = %d", w.Code)
+	}
+
+	post("break=00001008")
+	post("watch=mem%5B0x100..0x104%5D&on=r")
+	post("watch=a0&on=w")
+	if w := post("button=RUN"); sim.pc != 0x1014 || sim.view.Watch != "watchpoint(a0) written at 0x00001010" || !strings.Contains(w.Body.String(), sim.view.Watch) {
+		t.Errorf("pc = %x, watch = %s", sim.pc, sim.view.Watch)
+	}
+	if !slices.Equal(sim.view.Watchpoints, []string{"mem[0x100..0x104] on read", "a0 on write"}) {
+		t.Errorf("watchpoints = %v", sim.view.Watchpoints)
+	}
+
+	post("button=STOP")
+	post("unwatch=1")
+	post("watch=mem%5B0x103%5D&on=rw")
+	post("button=RUN")
+	if sim.pc != 0x100c || sim.view.Watch != "watchpoint(mem[0x103]) written at 0x00001008" {
+		t.Errorf("pc = %x, watch = %s", sim.pc, sim.view.Watch)
+	}
+	post("button=STEP")
+	if sim.view.Watch != "" || sim.view.InputError != "" {
+		t.Errorf("watch = %s", sim.view.Watch)
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	sim.load([][3]string{
+		{"", "addi", "t0, x0, 5"},
+		{"", "sw", "t0, 0x100(x0)"},
+		{"", "addi", "t0, t0, 1"},
+		{"", "sb", "t0, 0x101(x0)"},
+		{"", "addi", "a0, t0, 0"},
+		{"", "addi", "a7, x0, 1"},
+		{"", "ecall", ""},
+		{"end:", "", ""},
+	})
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(body))
+		return w.Code
+	}
+	type state struct {
+		pc        uint32
+		registers [32]uint32
+		memory    string
+		console   string
+		view      SinglePageView
+	}
+	snapshot := func() state {
+		return state{sim.pc, sim.registers, string(sim.memory[0x100][:8]), sim.console.String(), sim.view}
+	}
+
+	if code := post("button=STEP+BACK"); code != http.StatusBadRequest {
+		t.Errorf("Code = %d", code)
+	}
+	states := []state{}
+	for range 7 {
+		post("button=STEP")
+		states = append(states, snapshot())
+	}
+	if sim.console.String() != "6" || sim.view.Undoable != 7 {
+		t.Fatalf("console = %s, undoable = %d", sim.console.String(), sim.view.Undoable)
+	}
+	for i := 5; 0 <= i; i-- {
+		post("button=STEP+BACK")
+		if got := snapshot(); !reflect.DeepEqual(got, states[i]) {
+			t.Errorf("%d pc = %x, registers = %v, memory = %x, console = %s", i, got.pc, got.registers, got.memory, got.console)
+		}
+	}
+	post("button=STEP+BACK")
+	if sim.pc != 0x1000 || sim.registers != [32]uint32{} || sim.readMemory(0x100) != 0 || sim.view.Undoable != 0 {
+		t.Errorf("pc = %x, registers = %v", sim.pc, sim.registers)
+	}
+
+	post("break=00001008")
+	post("button=RUN")
+	post("button=RUN")
+	if sim.effectivePc() {
+		t.Fatalf("pc = %x", sim.pc)
+	}
+	post("button=REVERSE+RUN")
+	if sim.pc != 0x1008 || sim.registers[5] != 5 || sim.readMemory(0x100) != 5 || sim.readMemory(0x101) != 0 || sim.console.String() != "" || sim.view.Breakpoint != "0x00001008" {
+		t.Errorf("pc = %x, t0 = %d, console = %s", sim.pc, sim.registers[5], sim.console.String())
+	}
+
+	post("button=STOP")
+	sim.historyDepth = 3
+	post("button=RUN")
+	post("button=RUN")
+	if len(sim.history) != 3 {
+		t.Errorf("history = %d", len(sim.history))
+	}
+	for range 3 {
+		post("button=STEP+BACK")
+	}
+	if code := post("button=STEP+BACK"); code != http.StatusBadRequest || sim.pc != 0x1014 {
+		t.Errorf("Code = %d, pc = %x", code, sim.pc)
+	}
+}
+
+func TestStepOver(t *testing.T) {
+	handler := NewSimulatorHandler("examples/ex01.asm", entryPoint)
+	handler.init("shared")
+	sim := handler.sharedSimulator()
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(body))
+		return w.Code
+	}
+
+	post("button=STEP+OVER") // not a call
+	if sim.pc != 0x1004 || sim.view.Executed != 1 {
+		t.Errorf("pc = %x, executed = %d", sim.pc, sim.view.Executed)
+	}
+	for sim.pc != 0x1014 { // jal mulu
+		post("button=STEP")
+	}
+	post("button=STEP+OVER")
+	if sim.pc != 0x1018 || sim.registers[10] != 2047*(0x87000-1162) || sim.view.Executed < 10 {
+		t.Errorf("pc = %x, x10 = %d, executed = %d", sim.pc, sim.registers[10], sim.view.Executed)
+	}
+
+	post("button=STOP")
+	loop := sim.labelMapping["mulu_loop"]
+	if code := post(fmt.Sprintf("to=%08x", loop)); code != 200 || sim.pc != loop {
+		t.Errorf("Code = %d, pc = %x", code, sim.pc)
+	}
+	post("button=STEP+OUT")
+	if sim.pc != 0x1018 || sim.registers[10] != 2047*(0x87000-1162) {
+		t.Errorf("pc = %x, x10 = %d", sim.pc, sim.registers[10])
+	}
+
+	if code := post("to=00000ffc"); code != http.StatusBadRequest {
+		t.Errorf("Code = %d", code)
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	handler, sim := newTestSimulatorHandler()
+
+	lines := [][3]string{
+		{"main:", "addi", "a0, x0, 2"},
+		{"", "jal", "ra, f"},
+		{"", "jal", "x0, end"},
+		{"f:", "addi", "sp, sp, -8"},
+		{"", "sw", "ra, 4(sp)"},
+		{"", "beq", "a0, x0, base"},
+		{"", "addi", "a0, a0, -1"},
+		{"", "jal", "ra, f"},
+		{"base:", "lw", "ra, 4(sp)"},
+		{"", "addi", "sp, sp, 8"},
+		{"", "jalr", "x0, 0(ra)"},
+		{"end:", "", ""},
+	}
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+
+	post := func(body string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(body))
+		return w.Body.String()
+	}
+
+	post("break=00001020")
+	body := post("button=RUN")
+	want := []FrameRow{
+		{0, "f", "0x0000101c", "f+0x10", "0xfffffff0"},
+		{1, "f", "0x0000101c", "f+0x10", "0xfffffff8"},
+		{2, "f", "0x00001004", "main+0x4", "0x00000000"},
+	}
+	if sim.pc != 0x1020 || !slices.Equal(sim.view.Backtrace, want) || !strings.Contains(body, "Backtrace") {
+		t.Errorf("pc = %x, backtrace = %v", sim.pc, sim.view.Backtrace)
+	}
+	for range 3 {
+		post("button=STEP")
+	}
+	if len(sim.calls) != 2 {
+		t.Errorf("calls = %v", sim.calls)
+	}
+	post("button=STEP+BACK")
+	if len(sim.calls) != 3 {
+		t.Errorf("calls = %v", sim.calls)
+	}
+	post("break=00001020")
+	post("button=RUN")
+	if len(sim.calls) != 0 || len(sim.warnings) != 0 || len(sim.view.Backtrace) != 0 {
+		t.Errorf("calls = %v, warnings = %v", sim.calls, sim.warnings)
+	}
+
+	lines[8] = [3]string{"base:", "addi", "x0, x0, 0"} // ra is not restored
+	sim.load(lines)
+	sim.reset()
+	sim.view.setStatus(ready)
+	sim.maxSteps = 200
+	post("button=RUN")
+	if len(sim.warnings) != 1 || sim.warnings[0].Code != "mismatched-return" || sim.warnings[0].LineNo != 11 {
+		t.Fatalf("warnings = %v", sim.warnings)
+	}
+	if n := len(sim.view.Diagnostics); n == 0 || sim.view.Diagnostics[n-1].Message != "mismatched return(jalr) to 0x00001020 not after a call" {
+		t.Errorf("diagnostics = %v", sim.view.Diagnostics)
+	}
+	post("button=STOP")
+	if len(sim.warnings) != 0 || len(sim.view.Diagnostics) != 0 {
+		t.Errorf("warnings = %v", sim.warnings)
+	}
+
+	sim.load([][3]string{
+		{"main:", "la", "t0, next"},
+		{"", "jr", "t0"}, // not a return
+		{"next:", "jal", "t0, g"},
+		{"", "jal", "x0, end"},
+		{"g:", "jr", "t0"},
+		{"end:", "", ""},
+	})
+	sim.reset()
+	sim.view.setStatus(ready)
+	post("break=00001014")
+	post("button=RUN")
+	if len(sim.calls) != 1 || sim.calls[0].Link != 5 {
+		t.Errorf("calls = %v", sim.calls)
+	}
+	post("button=RUN")
+	if len(sim.calls) != 0 || len(sim.warnings) != 0 {
+		t.Errorf("calls = %v, warnings = %v", sim.calls, sim.warnings)
+	}
+}
+
 func TestStop(t *testing.T) {
 	handler, sim := newTestSimulatorHandler()
 	sim.view.Disabled.Stop = false